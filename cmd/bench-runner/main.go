@@ -49,6 +49,19 @@ type benchResult struct {
 	FinalP90LatencyMs  float64        `json:"final_p90_latency_ms"`
 	FinalP95LatencyMs  float64        `json:"final_p95_latency_ms"`
 	FinalP99LatencyMs  float64        `json:"final_p99_latency_ms"`
+	// 2PC: режим рассылки координатора и время участников по фазам ("inventory.prepare").
+	TwoPCFanout        string                    `json:"twopc_fanout,omitempty"`
+	ParticipantLatency map[string]latencySummary `json:"participant_latency,omitempty"`
+	StockFixture       string                    `json:"stock_fixture,omitempty"`
+	StockAfter         []stockLevel              `json:"stock_after,omitempty"`
+}
+
+type latencySummary struct {
+	Count int     `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
 }
 
 type operation struct {
@@ -70,12 +83,15 @@ type metrics struct {
 	statusCounts map[string]int
 	errorClasses map[string]int
 	firstError   string
+	fanout       string
+	participants map[string][]float64
 }
 
 func newMetrics() *metrics {
 	return &metrics{
 		statusCounts: make(map[string]int),
 		errorClasses: make(map[string]int),
+		participants: make(map[string][]float64),
 	}
 }
 
@@ -119,6 +135,20 @@ func (m *metrics) recordStatus(status int, err error, class string) {
 	}
 }
 
+func (m *metrics) recordParticipants(fanout string, latencies map[string]float64) {
+	if len(latencies) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fanout != "" {
+		m.fanout = fanout
+	}
+	for key, ms := range latencies {
+		m.participants[key] = append(m.participants[key], ms)
+	}
+}
+
 func main() {
 	baseURLFlag := flag.String("base-url", getenv("ORDER_BASE_URL", "http://localhost:8080"), "order-service base URL (comma-separated for multiple endpoints)")
 	inventoryURL := flag.String("inventory-url", getenv("INVENTORY_BASE_URL", ""), "inventory-service base URL")
@@ -132,6 +162,7 @@ func main() {
 	finalTimeout := flag.Duration("final-timeout", 30*time.Second, "timeout for final status polling")
 	finalInterval := flag.Duration("final-interval", 500*time.Millisecond, "poll interval for final status")
 	finalStatuses := flag.String("final-statuses", "CONFIRMED,COMMITTED", "comma-separated list of final order statuses")
+	stockFixture := flag.String("stock-fixture", getenv("STOCK_FIXTURE", ""), "reset inventory stock to this fixture before the run and report final stock (requires -inventory-url)")
 	output := flag.String("output", "", "optional output path for JSON result")
 	flag.Parse()
 
@@ -151,6 +182,17 @@ func main() {
 	}
 	baseURLValue := strings.Join(baseURLs, ",")
 
+	if *stockFixture != "" {
+		if *inventoryURL == "" {
+			fmt.Fprintln(os.Stderr, "inventory-url is required for stock-fixture")
+			os.Exit(1)
+		}
+		if err := resetStock(*inventoryURL, *stockFixture); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reset stock: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	opsSets := make([][]operation, len(baseURLs))
 	for i, baseURL := range baseURLs {
 		ops, err := buildOperations(*scenario, baseURL, *inventoryURL, *paymentURL, *shippingURL)
@@ -232,6 +274,16 @@ func main() {
 		FinalP90LatencyMs:  finalP90,
 		FinalP95LatencyMs:  finalP95,
 		FinalP99LatencyMs:  finalP99,
+		TwoPCFanout:        m.fanout,
+		ParticipantLatency: summarizeParticipants(m.participants),
+	}
+	if *stockFixture != "" {
+		result.StockFixture = *stockFixture
+		stock, err := fetchStock(*inventoryURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to fetch final stock: %v\n", err)
+		}
+		result.StockAfter = stock
 	}
 
 	encoder := json.NewEncoder(os.Stdout)
@@ -283,7 +335,8 @@ func buildOperations(scenario, orderURL, inventoryURL, paymentURL, shippingURL s
 					return map[string]any{
 						"txid":     txid,
 						"order_id": orderID,
-						"items":    []map[string]any{{"product_id": "sku-1", "quantity": 1}},
+						"step":     "reserve_inventory",
+						"payload":  map[string]any{"items": []map[string]any{{"product_id": "sku-1", "quantity": 1}}},
 					}
 				},
 			},
@@ -305,7 +358,7 @@ func buildOperations(scenario, orderURL, inventoryURL, paymentURL, shippingURL s
 				name: "payment-2pc-prepare",
 				url:  strings.TrimRight(paymentURL, "/") + "/2pc/prepare",
 				payload: func(txid, orderID string) any {
-					return map[string]any{"txid": txid, "order_id": orderID, "total": int64(1200)}
+					return map[string]any{"txid": txid, "order_id": orderID, "step": "authorize_payment", "payload": map[string]any{"amount": int64(1200)}}
 				},
 			},
 			operation{
@@ -326,7 +379,7 @@ func buildOperations(scenario, orderURL, inventoryURL, paymentURL, shippingURL s
 				name: "shipping-2pc-prepare",
 				url:  strings.TrimRight(shippingURL, "/") + "/2pc/prepare",
 				payload: func(txid, orderID string) any {
-					return map[string]any{"txid": txid, "order_id": orderID}
+					return map[string]any{"txid": txid, "order_id": orderID, "step": "create_shipment", "payload": map[string]any{}}
 				},
 			},
 			operation{
@@ -352,7 +405,7 @@ func buildOperations(scenario, orderURL, inventoryURL, paymentURL, shippingURL s
 				name: "inventory-tcc-try",
 				url:  strings.TrimRight(inventoryURL, "/") + "/tcc/try",
 				payload: func(txid, orderID string) any {
-					return map[string]any{"txid": txid, "order_id": orderID, "step": "reserve_inventory"}
+					return map[string]any{"txid": txid, "order_id": orderID, "step": "reserve_inventory", "items": []map[string]any{{"product_id": "sku-1", "quantity": 1}}}
 				},
 			},
 			operation{
@@ -429,6 +482,7 @@ func runTransaction(ops []operation, txid, orderID string, client *http.Client,
 		if op.name == "checkout" {
 			checkoutOrderID = info.OrderID
 			checkoutStatus = info.OrderStatus
+			m.recordParticipants(info.Fanout, info.ParticipantLatencyMS)
 		}
 	}
 	if awaitFinal && len(ops) == 1 && ops[0].name == "checkout" && checkoutOrderID != "" {
@@ -439,10 +493,12 @@ func runTransaction(ops []operation, txid, orderID string, client *http.Client,
 }
 
 type responseInfo struct {
-	StatusCode  int
-	Body        string
-	OrderID     string
-	OrderStatus string
+	StatusCode           int
+	Body                 string
+	OrderID              string
+	OrderStatus          string
+	Fanout               string
+	ParticipantLatencyMS map[string]float64
 }
 
 func doCheckout(url string, payload any, client *http.Client, timeout time.Duration) (responseInfo, string, error) {
@@ -463,11 +519,14 @@ func doCheckout(url string, payload any, client *http.Client, timeout time.Durat
 	body, _ := io.ReadAll(resp.Body)
 	bodyStr := strings.TrimSpace(string(body))
 	orderID, status := parseCheckoutBody(bodyStr)
+	fanout, participants := parseParticipantLatency(bodyStr)
 	info := responseInfo{
-		StatusCode:  resp.StatusCode,
-		Body:        bodyStr,
-		OrderID:     orderID,
-		OrderStatus: status,
+		StatusCode:           resp.StatusCode,
+		Body:                 bodyStr,
+		OrderID:              orderID,
+		OrderStatus:          status,
+		Fanout:               fanout,
+		ParticipantLatencyMS: participants,
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		class := classifyError(resp.StatusCode, bodyStr)
@@ -506,8 +565,8 @@ func splitBaseURLs(raw string) []string {
 }
 
 func classifyError(status int, body string) string {
-	if isBusinessRejection(body) {
-		return "business_rejected"
+	if class := classifyRejection(body); class != "" {
+		return class
 	}
 	switch {
 	case status >= 500:
@@ -519,17 +578,25 @@ func classifyError(status int, body string) string {
 	}
 }
 
-func isBusinessRejection(body string) bool {
+// classifyRejection разделяет отказы /checkout: бизнес-отказ (голос "нет" участника)
+// и откат из-за недоступности участника 2PC (abort_cause=participant_unavailable).
+func classifyRejection(body string) string {
 	if body == "" {
-		return false
+		return ""
 	}
 	var payload map[string]any
 	if err := json.Unmarshal([]byte(body), &payload); err != nil {
-		return false
+		return ""
 	}
 	status, _ := payload["status"].(string)
 	status = strings.ToUpper(strings.TrimSpace(status))
-	return status == "REJECTED" || status == "ABORTED"
+	if status != "REJECTED" && status != "ABORTED" {
+		return ""
+	}
+	if cause, _ := payload["abort_cause"].(string); cause == "participant_unavailable" {
+		return "participant_unavailable"
+	}
+	return "business_rejected"
 }
 
 func parseCheckoutBody(body string) (string, string) {
@@ -545,6 +612,20 @@ func parseCheckoutBody(body string) (string, string) {
 	return orderID, status
 }
 
+func parseParticipantLatency(body string) (string, map[string]float64) {
+	if body == "" {
+		return "", nil
+	}
+	var payload struct {
+		Fanout               string             `json:"fanout"`
+		ParticipantLatencyMS map[string]float64 `json:"participant_latency_ms"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return "", nil
+	}
+	return payload.Fanout, payload.ParticipantLatencyMS
+}
+
 func parseFinalStatuses(input string) map[string]struct{} {
 	result := map[string]struct{}{}
 	for _, part := range strings.Split(input, ",") {
@@ -602,6 +683,62 @@ func fetchOrderStatus(client *http.Client, baseURL, orderID string) (string, err
 	return status, nil
 }
 
+// stockLevel — элемент ответа GET /stock inventory-service.
+type stockLevel struct {
+	ProductID string `json:"product_id"`
+	Available int    `json:"available"`
+	Reserved  int    `json:"reserved"`
+	Free      int    `json:"free"`
+	Committed int    `json:"committed"`
+}
+
+func resetStock(inventoryURL, fixture string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	body, _ := json.Marshal(map[string]string{"fixture": fixture})
+	url := strings.TrimRight(inventoryURL, "/") + "/stock/reset"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func fetchStock(inventoryURL string) ([]stockLevel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := strings.TrimRight(inventoryURL, "/") + "/stock"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var payload struct {
+		Items []stockLevel `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload.Items, nil
+}
+
 func calcPercentiles(values []float64) (float64, float64, float64, float64) {
 	if len(values) == 0 {
 		return 0, 0, 0, 0
@@ -623,6 +760,18 @@ func calcFinalPercentiles(values []float64) (float64, float64, float64, float64,
 	return avg, percentile(values, 0.50), percentile(values, 0.90), percentile(values, 0.95), percentile(values, 0.99)
 }
 
+func summarizeParticipants(values map[string][]float64) map[string]latencySummary {
+	if len(values) == 0 {
+		return nil
+	}
+	out := make(map[string]latencySummary, len(values))
+	for key, samples := range values {
+		avg, p50, _, p95, p99 := calcFinalPercentiles(samples)
+		out[key] = latencySummary{Count: len(samples), AvgMs: avg, P50Ms: p50, P95Ms: p95, P99Ms: p99}
+	}
+	return out
+}
+
 func percentile(sorted []float64, p float64) float64 {
 	if len(sorted) == 0 {
 		return 0
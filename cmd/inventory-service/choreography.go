@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+)
+
+// Шаг inventory в саге-хореографии (TX_MODE=saga-chor):
+//   order.created                     -> резерв (PREPARED) -> inventory.soft_reserved | inventory.rejected
+//   shipping.created                  -> списание резерва  -> inventory.deducted
+//   payment.failed / payment.refunded -> снятие резерва    -> inventory.released
+// Отметка в inbox, изменение остатков и исходящее событие в outbox пишутся одной транзакцией.
+
+// consumedEvents — события, которые обрабатывает сервис: он подписан только на их топики.
+var consumedEvents = []string{contracts.EventOrderCreated, contracts.EventShipmentCreated, contracts.EventPaymentFailed, contracts.EventPaymentRefunded}
+
+func consumeEvents(ctx context.Context, stock *stockStore, broker kafka.Broker, cfg cfg, m *metrics.ConsumerMetrics) {
+	kafka.Consume(ctx, broker, cfg.Routing.TopicsFor(consumedEvents...), cfg.KafkaGroupID, cfg.Consumer, func(ctx context.Context, msg kafka.Message) error {
+		meta, err := contracts.Peek(msg.HeaderMap(), msg.Value)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		start := time.Now()
+		status, err := handleEvent(ctx, stock, cfg, meta, msg.Value)
+		if err != nil || status == "" {
+			return err
+		}
+		logging.Log(logging.Fields{Service: "inventory-service", TxID: meta.TxID, OrderID: meta.OrderID, EventID: meta.EventID, Step: meta.Type, Status: status, DurationMS: time.Since(start).Milliseconds()})
+		return nil
+	}, m)
+}
+
+// handleEvent выполняет шаг для события meta и возвращает тип опубликованного события
+// ("duplicate" для повторной доставки, пусто — событие не для inventory). Тип и event_id берутся
+// из заголовков, поэтому чужие события и дубли отсекаются без разбора тела.
+func handleEvent(ctx context.Context, stock *stockStore, cfg cfg, meta contracts.Meta, body []byte) (string, error) {
+	switch meta.Type {
+	case contracts.EventOrderCreated, contracts.EventShipmentCreated, contracts.EventPaymentFailed, contracts.EventPaymentRefunded:
+	default:
+		return "", nil
+	}
+
+	next, reason := "", ""
+	fresh, err := outbox.Receive(ctx, stock.Pool, meta.EventID, func(ctx context.Context, tx pgx.Tx) error {
+		evt, err := meta.Decode(body)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		switch evt.Type {
+		case contracts.EventOrderCreated:
+			var payload contracts.OrderPayload
+			if err := evt.DecodePayload(&payload); err != nil {
+				return err
+			}
+			// Частичный резерв при отказе откатывается до savepoint, отметка inbox остаётся.
+			sp, err := tx.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			err = stock.reserve(ctx, sp, evt.OrderID, evt.TxID, payload.Items)
+			var vote *common.VoteNoError
+			switch {
+			case errors.As(err, &vote):
+				_ = sp.Rollback(ctx)
+				next, reason = contracts.EventInventoryRejected, vote.Reason
+			case err != nil:
+				return err
+			default:
+				if err := sp.Commit(ctx); err != nil {
+					return err
+				}
+				next = contracts.EventInventorySoft
+			}
+		case contracts.EventShipmentCreated:
+			if err := commitReservations(ctx, tx, evt.TxID); err != nil {
+				return err
+			}
+			next = contracts.EventInventoryDeducted
+		default:
+			if err := releaseReservations(ctx, tx, evt.TxID); err != nil {
+				return err
+			}
+			next = contracts.EventInventoryReleased
+		}
+		return enqueueEvent(ctx, tx, cfg, evt, next, reason)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "duplicate", nil
+	}
+	return next, nil
+}
+
+// enqueueEvent кладёт в outbox событие eventType, вызванное cause. Payload заказа
+// (позиции, сумма) передаётся дальше по цепочке без изменений.
+func enqueueEvent(ctx context.Context, tx pgx.Tx, cfg cfg, cause contracts.Event, eventType, reason string) error {
+	var payload contracts.OrderPayload
+	if err := cause.DecodePayload(&payload); err != nil {
+		return err
+	}
+	if reason != "" {
+		payload.Reason = reason
+	}
+	evt, err := contracts.Caused(cause, eventType, "inventory-service", &payload)
+	if err != nil {
+		return err
+	}
+	return outbox.InsertEvent(ctx, tx, cfg.Routing, evt)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// enqueueStateEvent пишет в outbox изменение состояния участника в 2PC/TCC/саге-оркестрации
+// в той же транзакции, что и само изменение; публикует его outbox.Relay.
+func enqueueStateEvent(ctx context.Context, tx pgx.Tx, cfg cfg, txid, orderID, eventType string, payload *contracts.StatePayload) error {
+	if !cfg.Broker.Enabled() {
+		// Без брокера relay не запущен и событие некому публиковать.
+		return nil
+	}
+	evt, err := contracts.New(eventType, "inventory-service", txid, orderID, payload)
+	if err != nil {
+		return err
+	}
+	return outbox.InsertEvent(ctx, tx, cfg.Routing, evt)
+}
@@ -4,38 +4,63 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/idempotency"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/tcc"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/participant"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/store/postgres"
 )
 
 type cfg struct {
-	Port        string
-	DatabaseURL string
-}
-
-type Item struct {
-	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	Port               string
+	DatabaseURL        string
+	CoordinatorBaseURL string
+	PreparedTTL        time.Duration
+	ResolveInterval    time.Duration
+	Broker             kafka.Config
+	Routing            contracts.Routing
+	KafkaGroupID       string
+	Outbox             outbox.RelayConfig
+	Consumer           kafka.ConsumerConfig
+	Idempotency        idempotency.Config
+	LockStrategy       lockStrategy
+	EscrowShards       int
+	OptimisticRetries  int
 }
 
+// PrepareRequest — protocol.PrepareRequest с типизированным payload участника.
+// Для /2pc/commit и /2pc/abort используются только txid и order_id.
 type PrepareRequest struct {
-	TxID    string `json:"txid"`
-	OrderID string `json:"order_id"`
-	Items   []Item `json:"items"`
+	TxID    string                           `json:"txid"`
+	OrderID string                           `json:"order_id"`
+	Step    string                           `json:"step"`
+	Payload protocol.InventoryReservePayload `json:"payload"`
 }
 
+// TCCRequest — тело /tcc/*. Шаги саги-оркестрации приходят с префиксом step "saga_orch_".
+// items нужны только для try.
 type TCCRequest struct {
-	TxID    string `json:"txid"`
-	OrderID string `json:"order_id"`
-	Step    string `json:"step"`
+	TxID    string              `json:"txid"`
+	OrderID string              `json:"order_id"`
+	Step    string              `json:"step"`
+	Items   []protocol.LineItem `json:"items"`
 }
 
 func main() {
@@ -43,6 +68,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	outbox.Notify = cfg.Outbox.Notify
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -52,7 +78,48 @@ func main() {
 	}
 	defer pool.Close()
 
+	if cfg.CoordinatorBaseURL != "" {
+		resolver := &participant.Resolver{
+			Service:   "inventory-service",
+			Store:     postgres.NewParticipantStore(pool),
+			Decisions: participant.NewHTTPDecisionClient(cfg.CoordinatorBaseURL, &http.Client{Timeout: 5 * time.Second}),
+			Apply: func(ctx context.Context, tx participant.PreparedTx, status string) error {
+				return update2PCStatus(ctx, pool, cfg, tx.TxID, status)
+			},
+			Interval:  cfg.ResolveInterval,
+			Lease:     cfg.PreparedTTL,
+			BatchSize: 50,
+		}
+		resolver.Start(context.Background())
+	} else {
+		log.Printf("COORDINATOR_BASE_URL is empty: expired 2PC prepares will not be resolved")
+	}
+
 	srvMetrics := metrics.NewServerMetrics("inventory_service")
+	stock := &stockStore{
+		Pool:       pool,
+		Strategy:   cfg.LockStrategy,
+		Shards:     cfg.EscrowShards,
+		MaxRetries: cfg.OptimisticRetries,
+		Metrics:    metrics.NewStockMetrics("inventory_service"),
+	}
+	log.Printf("inventory lock strategy: %s", cfg.LockStrategy)
+	tccParticipant := tcc.NewParticipant(pool)
+	if cfg.Broker.Enabled() {
+		broker, err := kafka.Open(cfg.Broker)
+		if err != nil {
+			log.Fatalf("broker error: %v", err)
+		}
+		if err := kafka.EnsureTopics(ctx, broker, cfg.Routing.Topics()); err != nil {
+			log.Printf("ensure topics error: %v", err)
+		}
+		// Relay публикует и события хореографии, и изменения состояния участника (2PC/TCC/саги).
+		outbox.NewRelay(pool, broker, cfg.Outbox, metrics.NewOutboxMetrics("inventory_service")).Start(context.Background())
+		go consumeEvents(context.Background(), stock, broker, cfg, metrics.NewConsumerMetrics("inventory_service"))
+	}
+
+	idem := idempotency.New(pool, cfg.Idempotency, metrics.NewIdempotencyMetrics("inventory_service"))
+	idem.Start(context.Background())
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -70,26 +137,33 @@ func main() {
 	mux.Handle("/metrics", metrics.Handler())
 
 	mux.HandleFunc("/2pc/prepare", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "prepare", w, r)
+		handle2PC(stock, cfg, srvMetrics, "prepare", w, r)
 	})
 	mux.HandleFunc("/2pc/commit", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "commit", w, r)
+		handle2PC(stock, cfg, srvMetrics, "commit", w, r)
 	})
 	mux.HandleFunc("/2pc/abort", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "abort", w, r)
+		handle2PC(stock, cfg, srvMetrics, "abort", w, r)
 	})
 
 	mux.HandleFunc("/tcc/try", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "try", w, r)
+		handleTCC(stock, cfg, tccParticipant, srvMetrics, "try", w, r)
 	})
 	mux.HandleFunc("/tcc/confirm", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "confirm", w, r)
+		handleTCC(stock, cfg, tccParticipant, srvMetrics, "confirm", w, r)
 	})
 	mux.HandleFunc("/tcc/cancel", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "cancel", w, r)
+		handleTCC(stock, cfg, tccParticipant, srvMetrics, "cancel", w, r)
+	})
+
+	mux.HandleFunc("/stock", func(w http.ResponseWriter, r *http.Request) {
+		handleStockCollection(stock, srvMetrics, w, r)
+	})
+	mux.HandleFunc("/stock/", func(w http.ResponseWriter, r *http.Request) {
+		handleStockItem(stock, srvMetrics, w, r)
 	})
 
-	srv := &http.Server{Addr: ":" + cfg.Port, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: idem.Wrap(mux), ReadHeaderTimeout: 5 * time.Second}
 	log.Printf("inventory-service listening on :%s", cfg.Port)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -100,10 +174,86 @@ func readCfg() (cfg, error) {
 	if db == "" {
 		return cfg{}, errors.New("DATABASE_URL is required")
 	}
-	return cfg{Port: port, DatabaseURL: db}, nil
+	ttlMS, _ := strconv.Atoi(getenv("TWOPC_PREPARED_TTL_MS", "30000"))
+	resolveMS, _ := strconv.Atoi(getenv("TWOPC_RESOLVE_MS", "5000"))
+	outboxPollMS, _ := strconv.Atoi(getenv("OUTBOX_POLL_MS", "500"))
+	outboxBatch, _ := strconv.Atoi(getenv("OUTBOX_BATCH", "100"))
+	outboxLeaseMS, _ := strconv.Atoi(getenv("OUTBOX_LEASE_MS", "30000"))
+	outboxLingerMS, _ := strconv.Atoi(getenv("OUTBOX_LINGER_MS", "5"))
+	outboxMaxAttempts, _ := strconv.Atoi(getenv("OUTBOX_MAX_ATTEMPTS", "10"))
+	outboxBackoffMS, _ := strconv.Atoi(getenv("OUTBOX_RETRY_BACKOFF_MS", "1000"))
+	outboxRetentionMS, _ := strconv.Atoi(getenv("OUTBOX_RETENTION_MS", "86400000"))
+	routes, err := contracts.ParseRoutes(os.Getenv("EVENT_ROUTES"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("EVENT_ROUTES: %w", err)
+	}
+	topicPartitions, err := contracts.ParsePartitions(os.Getenv("KAFKA_TOPIC_PARTITIONS"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("KAFKA_TOPIC_PARTITIONS: %w", err)
+	}
+	partitions, _ := strconv.Atoi(getenv("KAFKA_PARTITIONS", "3"))
+	consumerAttempts, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_ATTEMPTS", "5"))
+	consumerBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_BACKOFF_MS", "200"))
+	consumerMaxBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_BACKOFF_MS", "5000"))
+	idemTTLMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_TTL_MS", "86400000"))
+	idemLeaseMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_LEASE_MS", "60000"))
+	notify := strings.ToLower(getenv("OUTBOX_NOTIFY", "false"))
+	strategy, err := parseLockStrategy(getenv("INVENTORY_LOCK_STRATEGY", string(lockPessimistic)))
+	if err != nil {
+		return cfg{}, err
+	}
+	shards, _ := strconv.Atoi(getenv("INVENTORY_ESCROW_SHARDS", "8"))
+	if shards <= 0 {
+		shards = 1
+	}
+	retries, _ := strconv.Atoi(getenv("INVENTORY_OPTIMISTIC_RETRIES", "20"))
+	if retries <= 0 {
+		retries = 1
+	}
+	return cfg{
+		Port:               port,
+		DatabaseURL:        db,
+		CoordinatorBaseURL: strings.TrimRight(getenv("COORDINATOR_BASE_URL", ""), "/"),
+		PreparedTTL:        time.Duration(ttlMS) * time.Millisecond,
+		ResolveInterval:    time.Duration(resolveMS) * time.Millisecond,
+		KafkaGroupID:       getenv("KAFKA_GROUP_ID", "inventory-service"),
+		Broker: kafka.Config{
+			Kind:      getenv("BROKER", "kafka"),
+			Brokers:   getenv("KAFKA_BROKERS", ""),
+			RedisAddr: getenv("REDIS_ADDR", ""),
+		},
+		Routing: contracts.Routing{
+			Topic:           getenv("KAFKA_TOPIC", "txlab.events"),
+			Routes:          routes,
+			Partitions:      partitions,
+			TopicPartitions: topicPartitions,
+		},
+		Outbox: outbox.RelayConfig{
+			PollInterval: time.Duration(outboxPollMS) * time.Millisecond,
+			BatchSize:    outboxBatch,
+			Lease:        time.Duration(outboxLeaseMS) * time.Millisecond,
+			Linger:       time.Duration(outboxLingerMS) * time.Millisecond,
+			MaxAttempts:  outboxMaxAttempts,
+			RetryBackoff: time.Duration(outboxBackoffMS) * time.Millisecond,
+			Retention:    time.Duration(outboxRetentionMS) * time.Millisecond,
+			Notify:       notify == "1" || notify == "true" || notify == "yes",
+		},
+		Consumer: kafka.ConsumerConfig{
+			MaxAttempts: consumerAttempts,
+			Backoff:     time.Duration(consumerBackoffMS) * time.Millisecond,
+			MaxBackoff:  time.Duration(consumerMaxBackoffMS) * time.Millisecond,
+		},
+		Idempotency: idempotency.Config{
+			TTL:   time.Duration(idemTTLMS) * time.Millisecond,
+			Lease: time.Duration(idemLeaseMS) * time.Millisecond,
+		},
+		LockStrategy:      strategy,
+		EscrowShards:      shards,
+		OptimisticRetries: retries,
+	}, nil
 }
 
-func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
+func handle2PC(stock *stockStore, cfg cfg, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
@@ -122,19 +272,37 @@ func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 
 	switch action {
 	case "prepare":
-		if err := prepareInventory(r.Context(), pool, req); err != nil {
-			writeJSON(w, http.StatusConflict, map[string]any{"error": err.Error()})
-			metrics.Requests.WithLabelValues("2pc_"+action, "409").Inc()
+		if err := prepareInventory(r.Context(), stock, cfg, req); err != nil {
+			var vote *common.VoteNoError
+			if errors.As(err, &vote) {
+				logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_prepare", Status: "vote_no", Message: vote.Reason})
+				writeJSON(w, http.StatusConflict, protocol.PrepareResponse{VoteYes: false, Reason: vote.Reason})
+				metrics.Requests.WithLabelValues("2pc_"+action, "409").Inc()
+				metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("2pc_"+action, "500").Inc()
 			metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 			return
 		}
 		logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_prepare", Status: "prepared"})
-	case "commit":
-		_ = update2PCStatus(r.Context(), pool, req.TxID, req.OrderID, "COMMITTED")
-		logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_commit", Status: "committed"})
-	case "abort":
-		_ = update2PCStatus(r.Context(), pool, req.TxID, req.OrderID, "ABORTED")
-		logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_abort", Status: "aborted"})
+		writeJSON(w, http.StatusOK, protocol.PrepareResponse{VoteYes: true})
+		metrics.Requests.WithLabelValues("2pc_"+action, "200").Inc()
+		metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+		return
+	case "commit", "abort":
+		status := "COMMITTED"
+		if action == "abort" {
+			status = "ABORTED"
+		}
+		if err := update2PCStatus(r.Context(), stock.Pool, cfg, req.TxID, status); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("2pc_"+action, "500").Inc()
+			metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+			return
+		}
+		logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_" + action, Status: strings.ToLower(status)})
 	}
 
 	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
@@ -142,39 +310,81 @@ func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 	metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 }
 
-func prepareInventory(ctx context.Context, pool *pgxpool.Pool, req PrepareRequest) error {
-	tx, err := pool.Begin(ctx)
+func prepareInventory(ctx context.Context, stock *stockStore, cfg cfg, req PrepareRequest) error {
+	tx, err := stock.Pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
-	_, err = tx.Exec(ctx, `INSERT INTO twopc_prepared_tx(txid, order_id, step, status, payload)
-		VALUES ($1, $2, 'reserve_inventory', 'PREPARED', $3)
-		ON CONFLICT (txid) DO NOTHING`, req.TxID, req.OrderID, jsonPayload(req))
+	tag, err := tx.Exec(ctx, `INSERT INTO twopc_prepared_tx(txid, order_id, step, status, payload, expires_at)
+		VALUES ($1, $2, 'reserve_inventory', 'PREPARED', $3, now() + make_interval(secs => $4))
+		ON CONFLICT (txid) DO NOTHING`, req.TxID, req.OrderID, jsonPayload(req), cfg.PreparedTTL.Seconds())
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return revote(ctx, tx, req.TxID)
+	}
 
-	for _, item := range req.Items {
-		_, err = tx.Exec(ctx, `INSERT INTO inventory_reservations(order_id, txid, product_id, quantity, status)
-			VALUES ($1, $2, $3, $4, 'PREPARED')
-			ON CONFLICT (txid, product_id) DO NOTHING`, req.OrderID, req.TxID, item.ProductID, item.Quantity)
-		if err != nil {
-			return err
-		}
+	if err := stock.reserve(ctx, tx, req.OrderID, req.TxID, req.Payload.Items); err != nil {
+		return err
+	}
+	err = enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventInventoryReserved,
+		&contracts.StatePayload{Protocol: "2pc", Step: "reserve_inventory", Items: req.Payload.Items})
+	if err != nil {
+		return err
 	}
 
 	return tx.Commit(ctx)
 }
 
-func update2PCStatus(ctx context.Context, pool *pgxpool.Pool, txid, orderID, status string) error {
-	_, _ = pool.Exec(ctx, `UPDATE twopc_prepared_tx SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
-	_, _ = pool.Exec(ctx, `UPDATE inventory_reservations SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
+// revote повторяет голос для уже известного txid: повторный PREPARE (ретрай координатора)
+// получает прежнее "да", а PREPARE после ABORT — "нет".
+func revote(ctx context.Context, tx pgx.Tx, txid string) error {
+	var status string
+	if err := tx.QueryRow(ctx, `SELECT status FROM twopc_prepared_tx WHERE txid=$1`, txid).Scan(&status); err != nil {
+		return err
+	}
+	if status == "ABORTED" {
+		return common.VoteNo("transaction already aborted")
+	}
 	return nil
 }
 
-func handleTCC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
+// update2PCStatus фиксирует решение координатора: COMMITTED списывает резервы txid,
+// ABORTED — освобождает и публикует inventory.compensated. Повторная доставка решения ничего не меняет.
+func update2PCStatus(ctx context.Context, pool *pgxpool.Pool, cfg cfg, txid, status string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var orderID, step string
+	err = tx.QueryRow(ctx, `UPDATE twopc_prepared_tx SET status=$2, updated_at=now() WHERE txid=$1 AND status='PREPARED'
+		RETURNING order_id, step`, txid, status).Scan(&orderID, &step)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	settle := releaseReservations
+	if status == "COMMITTED" {
+		settle = commitReservations
+	}
+	if err := settle(ctx, tx, txid); err != nil {
+		return err
+	}
+	if orderID != "" && status == "ABORTED" {
+		err := enqueueStateEvent(ctx, tx, cfg, txid, orderID, contracts.EventInventoryCompensated,
+			&contracts.StatePayload{Protocol: "2pc", Step: step})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func handleTCC(stock *stockStore, cfg cfg, participant *tcc.Participant, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
@@ -190,17 +400,70 @@ func handleTCC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 		return
 	}
 
-	status := strings.ToUpper(action)
-	_, _ = pool.Exec(r.Context(), `INSERT INTO tcc_operations(txid, order_id, step, status)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (txid) DO UPDATE SET status=EXCLUDED.status, updated_at=now()`, req.TxID, req.OrderID, req.Step, status)
+	res, err := applyTCC(r.Context(), stock, cfg, participant, action, req)
+	if err != nil {
+		var vote *common.VoteNoError
+		switch {
+		case errors.As(err, &vote):
+			logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: "rejected", Message: vote.Reason})
+			writeJSON(w, http.StatusConflict, map[string]any{"status": "REJECTED", "reason": vote.Reason})
+			metrics.Requests.WithLabelValues("tcc_"+action, "409").Inc()
+		case errors.Is(err, tcc.ErrCancelled), errors.Is(err, tcc.ErrNotTried):
+			logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: "refused", Message: err.Error()})
+			writeJSON(w, http.StatusConflict, map[string]any{"status": res.Status, "error": err.Error()})
+			metrics.Requests.WithLabelValues("tcc_"+action, "409").Inc()
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("tcc_"+action, "500").Inc()
+		}
+		metrics.LatencyMS.WithLabelValues("tcc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+		return
+	}
 
-	logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: status})
-	writeJSON(w, http.StatusOK, map[string]any{"status": status})
+	logging.Log(logging.Fields{Service: "inventory-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: res.Status, Message: res.Note()})
+	writeJSON(w, http.StatusOK, map[string]any{"status": res.Status, "empty_rollback": res.EmptyRollback})
 	metrics.Requests.WithLabelValues("tcc_"+action, "200").Inc()
 	metrics.LatencyMS.WithLabelValues("tcc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 }
 
+// applyTCC выполняет шаг TCC/саги над остатками под защитой tcc.Participant.
+// TCC: try резервирует, confirm списывает, cancel снимает резерв (или возвращает уже списанное).
+// Сага-оркестрация: действие (try) сразу списывает товар, компенсация (cancel) возвращает его.
+// try публикует inventory.reserved, cancel — inventory.compensated.
+func applyTCC(ctx context.Context, stock *stockStore, cfg cfg, participant *tcc.Participant, action string, req TCCRequest) (tcc.Result, error) {
+	op := tcc.Op{TxID: req.TxID, OrderID: req.OrderID, Step: req.Step}
+	switch action {
+	case "try":
+		return participant.Try(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			if err := stock.reserve(ctx, tx, req.OrderID, req.TxID, req.Items); err != nil {
+				return err
+			}
+			if strings.HasPrefix(req.Step, "saga_orch_") {
+				if err := commitReservations(ctx, tx, req.TxID); err != nil {
+					return err
+				}
+			}
+			return enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventInventoryReserved,
+				&contracts.StatePayload{Protocol: "tcc", Step: req.Step, Items: req.Items})
+		})
+	case "confirm":
+		return participant.Confirm(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			return commitReservations(ctx, tx, req.TxID)
+		})
+	default:
+		return participant.Cancel(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			if err := releaseReservations(ctx, tx, req.TxID); err != nil {
+				return err
+			}
+			if err := compensateReservations(ctx, tx, req.TxID); err != nil {
+				return err
+			}
+			return enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventInventoryCompensated,
+				&contracts.StatePayload{Protocol: "tcc", Step: req.Step})
+		})
+	}
+}
+
 func jsonPayload(req any) string {
 	data, _ := json.Marshal(req)
 	return string(data)
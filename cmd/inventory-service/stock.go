@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// Модель остатков: inventory_stock.available — физический остаток, inventory_stock.reserved —
+// сумма PREPARED-резервов. Свободно к резерву available - reserved.
+//   reserve: reserved += n (если хватает свободного), резерв PREPARED;
+//   commit:  available -= n, reserved -= n, резерв COMMITTED;
+//   release: reserved -= n, резерв ABORTED.
+// В стратегии escrow те же счётчики ведутся по шардам inventory_stock_shards,
+// а резерв помнит свой шард (inventory_reservations.shard); позиция, не влезшая в один шард,
+// резервируется частями — по строке резерва на шард.
+
+// lockStrategy — способ сериализации конкурентных резервов одного SKU (INVENTORY_LOCK_STRATEGY).
+type lockStrategy string
+
+const (
+	// lockPessimistic — SELECT ... FOR UPDATE строки остатка, проверка и UPDATE.
+	lockPessimistic lockStrategy = "pessimistic"
+	// lockOptimistic — чтение без блокировки и UPDATE ... WHERE version=$v с повтором при конфликте.
+	lockOptimistic lockStrategy = "optimistic"
+	// lockConditional — один атомарный UPDATE ... WHERE available - reserved >= n.
+	lockConditional lockStrategy = "conditional"
+	// lockEscrow — остаток разбит на шарды, резерв берётся условным UPDATE одного шарда
+	// (или частями из нескольких, если ни один шард не вмещает позицию).
+	lockEscrow lockStrategy = "escrow"
+)
+
+func parseLockStrategy(s string) (lockStrategy, error) {
+	switch l := lockStrategy(s); l {
+	case lockPessimistic, lockOptimistic, lockConditional, lockEscrow:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown INVENTORY_LOCK_STRATEGY %q (want pessimistic|optimistic|conditional|escrow)", s)
+}
+
+// errStockContention — оптимистичный резерв не смог закоммитить версию за отведённые попытки.
+var errStockContention = errors.New("stock version conflict: retries exhausted")
+
+// stockStore резервирует остатки выбранной стратегией и пишет метрики конкуренции.
+type stockStore struct {
+	Pool       *pgxpool.Pool
+	Strategy   lockStrategy
+	Shards     int
+	MaxRetries int
+	Metrics    *metrics.StockMetrics
+}
+
+// reserve резервирует позиции под txid в транзакции tx. SKU обрабатываются в порядке product_id,
+// чтобы параллельные заказы не ловили дедлоки. Нехватка товара или неизвестный SKU —
+// бизнес-отказ (common.VoteNoError).
+func (s *stockStore) reserve(ctx context.Context, tx pgx.Tx, orderID, txid string, items []protocol.LineItem) error {
+	quantities := map[string]int32{}
+	for _, it := range items {
+		quantities[it.ProductID] += it.Quantity
+	}
+	productIDs := make([]string, 0, len(quantities))
+	for id := range quantities {
+		productIDs = append(productIDs, id)
+	}
+	sort.Strings(productIDs)
+
+	for _, productID := range productIDs {
+		qty := quantities[productID]
+		parts := []reservation{{ProductID: productID, Quantity: qty}}
+		var err error
+		switch s.Strategy {
+		case lockOptimistic:
+			err = s.reserveOptimistic(ctx, tx, productID, qty)
+		case lockConditional:
+			err = s.reserveConditional(ctx, tx, productID, qty)
+		case lockEscrow:
+			parts, err = s.reserveEscrow(ctx, tx, productID, qty)
+		default:
+			err = s.reservePessimistic(ctx, tx, productID, qty)
+		}
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			_, err = tx.Exec(ctx, `INSERT INTO inventory_reservations(order_id, txid, product_id, quantity, status, shard)
+				VALUES ($1, $2, $3, $4, 'PREPARED', $5)`, orderID, txid, productID, part.Quantity, part.Shard)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *stockStore) reservePessimistic(ctx context.Context, tx pgx.Tx, productID string, qty int32) error {
+	var available, reserved int32
+	start := time.Now()
+	err := tx.QueryRow(ctx, `SELECT available, reserved FROM inventory_stock WHERE product_id=$1 FOR UPDATE`, productID).
+		Scan(&available, &reserved)
+	s.observeWait(start)
+	if err == pgx.ErrNoRows {
+		return unknownProduct(productID)
+	}
+	if err != nil {
+		return err
+	}
+	if free := available - reserved; free < qty {
+		return insufficientStock(productID, qty, free)
+	}
+	_, err = tx.Exec(ctx, `UPDATE inventory_stock SET reserved = reserved + $2, version = version + 1, updated_at=now() WHERE product_id=$1`, productID, qty)
+	return err
+}
+
+func (s *stockStore) reserveOptimistic(ctx context.Context, tx pgx.Tx, productID string, qty int32) error {
+	for attempt := 1; ; attempt++ {
+		var available, reserved int32
+		var version int64
+		err := tx.QueryRow(ctx, `SELECT available, reserved, version FROM inventory_stock WHERE product_id=$1`, productID).
+			Scan(&available, &reserved, &version)
+		if err == pgx.ErrNoRows {
+			return unknownProduct(productID)
+		}
+		if err != nil {
+			return err
+		}
+		if free := available - reserved; free < qty {
+			return insufficientStock(productID, qty, free)
+		}
+		start := time.Now()
+		tag, err := tx.Exec(ctx, `UPDATE inventory_stock SET reserved = reserved + $2, version = version + 1, updated_at=now()
+			WHERE product_id=$1 AND version=$3`, productID, qty, version)
+		s.observeWait(start)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil
+		}
+		s.Metrics.Retries.WithLabelValues(string(s.Strategy), "version_conflict").Inc()
+		if attempt >= s.MaxRetries {
+			return fmt.Errorf("%s: %w", productID, errStockContention)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Intn(attempt)+1) * time.Millisecond):
+		}
+	}
+}
+
+func (s *stockStore) reserveConditional(ctx context.Context, tx pgx.Tx, productID string, qty int32) error {
+	start := time.Now()
+	tag, err := tx.Exec(ctx, `UPDATE inventory_stock SET reserved = reserved + $2, version = version + 1, updated_at=now()
+		WHERE product_id=$1 AND available - reserved >= $2`, productID, qty)
+	s.observeWait(start)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 1 {
+		return nil
+	}
+	// Строка не подошла: различаем неизвестный SKU и нехватку для причины отказа.
+	var available, reserved int32
+	err = tx.QueryRow(ctx, `SELECT available, reserved FROM inventory_stock WHERE product_id=$1`, productID).Scan(&available, &reserved)
+	if err == pgx.ErrNoRows {
+		return unknownProduct(productID)
+	}
+	if err != nil {
+		return err
+	}
+	return insufficientStock(productID, qty, available-reserved)
+}
+
+// reserveEscrow пробует шарды SKU по кругу со случайного, чтобы конкурентные резервы
+// расходились по разным строкам, и берёт позицию целиком из первого подходящего шарда.
+// Если ни один шард не вмещает позицию, она набирается частями (reserveEscrowSplit).
+// Возвращает части резерва с номерами шардов.
+func (s *stockStore) reserveEscrow(ctx context.Context, tx pgx.Tx, productID string, qty int32) ([]reservation, error) {
+	for initialized := false; ; initialized = true {
+		offset := rand.Intn(s.Shards)
+		misses := 0
+		for i := 0; i < s.Shards; i++ {
+			shard := int32((offset + i) % s.Shards)
+			start := time.Now()
+			tag, err := tx.Exec(ctx, `UPDATE inventory_stock_shards SET reserved = reserved + $3, updated_at=now()
+				WHERE product_id=$1 AND shard=$2 AND available - reserved >= $3`, productID, shard, qty)
+			s.observeWait(start)
+			if err != nil {
+				return nil, err
+			}
+			if tag.RowsAffected() == 1 {
+				s.countShardMisses(misses)
+				return []reservation{{ProductID: productID, Quantity: qty, Shard: &shard}}, nil
+			}
+			misses++
+		}
+
+		var shards int
+		if err := tx.QueryRow(ctx, `SELECT count(*) FROM inventory_stock_shards WHERE product_id=$1`, productID).Scan(&shards); err != nil {
+			return nil, err
+		}
+		if shards > 0 {
+			// Промахи считаются только по существующим шардам: первый резерв SKU без шардов
+			// конкуренцией не является.
+			s.countShardMisses(misses)
+			return s.reserveEscrowSplit(ctx, tx, productID, qty)
+		}
+		if initialized {
+			return nil, insufficientStock(productID, qty, 0)
+		}
+		// Шардов ещё нет (SKU засеян напрямую в inventory_stock) — раскладываем остаток под
+		// блокировкой строки остатка и повторяем. Конкурент мог успеть раньше — тогда шарды уже есть.
+		var available int32
+		err := tx.QueryRow(ctx, `SELECT available - reserved FROM inventory_stock WHERE product_id=$1 FOR UPDATE`, productID).Scan(&available)
+		if err == pgx.ErrNoRows {
+			return nil, unknownProduct(productID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRow(ctx, `SELECT count(*) FROM inventory_stock_shards WHERE product_id=$1`, productID).Scan(&shards); err != nil {
+			return nil, err
+		}
+		if shards == 0 {
+			if err := s.splitShards(ctx, tx, productID, available); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// reserveEscrowSplit набирает позицию из нескольких шардов: блокирует все шарды SKU и, если
+// в сумме свободного хватает, берёт из каждого сколько есть. Каждая часть — отдельная строка
+// резерва со своим шардом. Дедлока нет: сюда попадают, только когда быстрый путь не взял ни одной
+// строки шардов этого SKU (неудавшийся UPDATE строку не блокирует), шарды блокируются по номерам,
+// а позиции заказа резервируются по порядку product_id.
+func (s *stockStore) reserveEscrowSplit(ctx context.Context, tx pgx.Tx, productID string, qty int32) ([]reservation, error) {
+	start := time.Now()
+	rows, err := tx.Query(ctx, `SELECT shard, available - reserved FROM inventory_stock_shards
+		WHERE product_id=$1 ORDER BY shard FOR UPDATE`, productID)
+	s.observeWait(start)
+	if err != nil {
+		return nil, err
+	}
+	type shardFree struct{ shard, free int32 }
+	var shards []shardFree
+	var total int32
+	for rows.Next() {
+		var sf shardFree
+		if err := rows.Scan(&sf.shard, &sf.free); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		shards = append(shards, sf)
+		total += sf.free
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if total < qty {
+		return nil, insufficientStock(productID, qty, total)
+	}
+	s.Metrics.Retries.WithLabelValues(string(s.Strategy), "shard_split").Inc()
+
+	var parts []reservation
+	for _, sf := range shards {
+		if qty == 0 {
+			break
+		}
+		take := min(sf.free, qty)
+		if take <= 0 {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `UPDATE inventory_stock_shards SET reserved = reserved + $3, updated_at=now()
+			WHERE product_id=$1 AND shard=$2`, productID, sf.shard, take); err != nil {
+			return nil, err
+		}
+		shard := sf.shard
+		parts = append(parts, reservation{ProductID: productID, Quantity: take, Shard: &shard})
+		qty -= take
+	}
+	return parts, nil
+}
+
+func (s *stockStore) countShardMisses(n int) {
+	if n > 0 {
+		s.Metrics.Retries.WithLabelValues(string(s.Strategy), "shard_miss").Add(float64(n))
+	}
+}
+
+// splitShards раскладывает available SKU поровну по шардам. Существующие шарды SKU
+// вызывающий удаляет сам.
+func (s *stockStore) splitShards(ctx context.Context, tx pgx.Tx, productID string, available int32) error {
+	n := int32(s.Shards)
+	for shard := int32(0); shard < n; shard++ {
+		share := available / n
+		if shard < available%n {
+			share++
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO inventory_stock_shards(product_id, shard, available) VALUES ($1, $2, $3)
+			ON CONFLICT (product_id, shard) DO NOTHING`, productID, shard, share)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stockStore) observeWait(start time.Time) {
+	s.Metrics.LockWaitMS.WithLabelValues(string(s.Strategy)).Observe(float64(time.Since(start).Microseconds()) / 1000)
+}
+
+func unknownProduct(productID string) error {
+	return common.VoteNo(fmt.Sprintf("unknown product %s", productID))
+}
+
+func insufficientStock(productID string, qty, free int32) error {
+	return common.VoteNo(fmt.Sprintf("insufficient stock for %s: requested %d, free %d", productID, qty, free))
+}
+
+// reservation — строка inventory_reservations, для escrow-резерва с номером шарда.
+type reservation struct {
+	ProductID string
+	Quantity  int32
+	Shard     *int32
+}
+
+// commitReservations списывает PREPARED-резервы txid. Повторный вызов ничего не меняет.
+func commitReservations(ctx context.Context, tx pgx.Tx, txid string) error {
+	return settleReservations(ctx, tx, txid, "PREPARED", "COMMITTED", "available = available - $2, reserved = reserved - $2")
+}
+
+// releaseReservations снимает PREPARED-резервы txid. Повторный вызов ничего не меняет.
+func releaseReservations(ctx context.Context, tx pgx.Tx, txid string) error {
+	return settleReservations(ctx, tx, txid, "PREPARED", "ABORTED", "reserved = reserved - $2")
+}
+
+// compensateReservations возвращает на склад уже списанные (COMMITTED) резервы txid —
+// компенсация шага саги, где действие сразу списывает товар.
+func compensateReservations(ctx context.Context, tx pgx.Tx, txid string) error {
+	return settleReservations(ctx, tx, txid, "COMMITTED", "ABORTED", "available = available + $2")
+}
+
+// settleReservations переводит резервы txid из from в to и применяет set к счётчикам
+// остатка (или шарда, из которого брался резерв). $1 — SKU, $2 — количество.
+func settleReservations(ctx context.Context, tx pgx.Tx, txid, from, to, set string) error {
+	rows, err := tx.Query(ctx, `UPDATE inventory_reservations SET status=$3, updated_at=now()
+		WHERE txid=$1 AND status=$2
+		RETURNING product_id, quantity, shard`, txid, from, to)
+	if err != nil {
+		return err
+	}
+	moved, err := collectReservations(rows)
+	if err != nil {
+		return err
+	}
+	// Тот же порядок блокировок, что и в reserve.
+	sort.Slice(moved, func(i, j int) bool { return moved[i].ProductID < moved[j].ProductID })
+	for _, m := range moved {
+		if m.Shard != nil {
+			_, err = tx.Exec(ctx, `UPDATE inventory_stock_shards SET `+set+`, updated_at=now() WHERE product_id=$1 AND shard=$3`, m.ProductID, m.Quantity, *m.Shard)
+		} else {
+			_, err = tx.Exec(ctx, `UPDATE inventory_stock SET `+set+`, version = version + 1, updated_at=now() WHERE product_id=$1`, m.ProductID, m.Quantity)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectReservations(rows pgx.Rows) ([]reservation, error) {
+	defer rows.Close()
+	var out []reservation
+	for rows.Next() {
+		var r reservation
+		if err := rows.Scan(&r.ProductID, &r.Quantity, &r.Shard); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// Админ-API остатков: засев перед прогоном бенчмарка и сверка итогов после него.
+//   GET  /stock            — все SKU;
+//   POST /stock            — пакетный upsert {"items":[{"product_id","available"}]};
+//   GET  /stock/{sku}      — один SKU;
+//   PUT  /stock/{sku}      — upsert {"available": n};
+//   POST /stock/reset      — сброс каталога к фикстуре {"fixture": "default"}.
+
+// StockLevel — состояние SKU: available — физический остаток, reserved — незавершённые резервы,
+// free = available - reserved, committed — сколько списано подтверждёнными резервами.
+type StockLevel struct {
+	ProductID string `json:"product_id"`
+	Available int32  `json:"available"`
+	Reserved  int32  `json:"reserved"`
+	Free      int32  `json:"free"`
+	Committed int64  `json:"committed"`
+}
+
+type StockUpsert struct {
+	ProductID string `json:"product_id"`
+	Available int32  `json:"available"`
+}
+
+type StockBulkRequest struct {
+	Items []StockUpsert `json:"items"`
+}
+
+type StockResetRequest struct {
+	Fixture string `json:"fixture"`
+}
+
+// errBelowReserved — новый остаток меньше уже зарезервированного количества.
+var errBelowReserved = errors.New("available is below reserved quantity")
+
+// stockFixture возвращает именованный набор остатков для POST /stock/reset.
+func stockFixture(name string) ([]StockUpsert, bool) {
+	switch name {
+	case "default":
+		// Запас, которого хватает на любой прогон: отказов по остаткам нет.
+		return []StockUpsert{{ProductID: "sku-1", Available: 1000000}}, true
+	case "hot-sku":
+		// Один дефицитный SKU: конкуренция за строку и отказы после исчерпания.
+		return []StockUpsert{{ProductID: "sku-1", Available: 100}}, true
+	case "catalog-100":
+		items := make([]StockUpsert, 0, 100)
+		for i := 1; i <= 100; i++ {
+			items = append(items, StockUpsert{ProductID: "sku-" + strconv.Itoa(i), Available: 10000})
+		}
+		return items, true
+	case "empty":
+		return nil, true
+	}
+	return nil, false
+}
+
+func handleStockCollection(stock *stockStore, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+		levels, err := readStock(r.Context(), stock.Pool, "")
+		if err != nil {
+			respondStock(w, m, "stock_list", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			return
+		}
+		respondStock(w, m, "stock_list", start, http.StatusOK, map[string]any{"items": levels})
+	case http.MethodPost:
+		var req StockBulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondStock(w, m, "stock_bulk", start, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+			return
+		}
+		if err := validateStock(req.Items); err != nil {
+			respondStock(w, m, "stock_bulk", start, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		if err := stock.write(r.Context(), false, req.Items); err != nil {
+			respondStockError(w, m, "stock_bulk", start, err)
+			return
+		}
+		logging.Log(logging.Fields{Service: "inventory-service", Step: "stock_bulk", Status: "ok", DurationMS: time.Since(start).Milliseconds(), Message: fmt.Sprintf("%d items", len(req.Items))})
+		respondStock(w, m, "stock_bulk", start, http.StatusOK, map[string]any{"updated": len(req.Items)})
+	default:
+		respondStock(w, m, "stock_list", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+	}
+}
+
+func handleStockItem(stock *stockStore, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	productID := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/stock/"))
+	if productID == "reset" {
+		handleStockReset(stock, m, w, r)
+		return
+	}
+	if productID == "" {
+		respondStock(w, m, "stock_item", start, http.StatusBadRequest, map[string]any{"error": "product id required"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		levels, err := readStock(r.Context(), stock.Pool, productID)
+		if err != nil {
+			respondStock(w, m, "stock_item", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			return
+		}
+		if len(levels) == 0 {
+			respondStock(w, m, "stock_item", start, http.StatusNotFound, map[string]any{"error": "not found"})
+			return
+		}
+		respondStock(w, m, "stock_item", start, http.StatusOK, levels[0])
+	case http.MethodPut:
+		var req StockUpsert
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondStock(w, m, "stock_upsert", start, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+			return
+		}
+		req.ProductID = productID
+		if err := validateStock([]StockUpsert{req}); err != nil {
+			respondStock(w, m, "stock_upsert", start, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		if err := stock.write(r.Context(), false, []StockUpsert{req}); err != nil {
+			respondStockError(w, m, "stock_upsert", start, err)
+			return
+		}
+		levels, err := readStock(r.Context(), stock.Pool, productID)
+		if err != nil || len(levels) == 0 {
+			respondStock(w, m, "stock_upsert", start, http.StatusOK, map[string]any{"product_id": productID})
+			return
+		}
+		respondStock(w, m, "stock_upsert", start, http.StatusOK, levels[0])
+	default:
+		respondStock(w, m, "stock_item", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+	}
+}
+
+func handleStockReset(stock *stockStore, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		respondStock(w, m, "stock_reset", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		return
+	}
+	var req StockResetRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondStock(w, m, "stock_reset", start, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+			return
+		}
+	}
+	if req.Fixture == "" {
+		req.Fixture = "default"
+	}
+	items, ok := stockFixture(req.Fixture)
+	if !ok {
+		respondStock(w, m, "stock_reset", start, http.StatusBadRequest, map[string]any{"error": "unknown fixture " + req.Fixture})
+		return
+	}
+	if err := stock.write(r.Context(), true, items); err != nil {
+		respondStockError(w, m, "stock_reset", start, err)
+		return
+	}
+	levels, err := readStock(r.Context(), stock.Pool, "")
+	if err != nil {
+		respondStock(w, m, "stock_reset", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	logging.Log(logging.Fields{Service: "inventory-service", Step: "stock_reset", Status: "ok", DurationMS: time.Since(start).Milliseconds(), Message: "fixture " + req.Fixture})
+	respondStock(w, m, "stock_reset", start, http.StatusOK, map[string]any{"fixture": req.Fixture, "items": levels})
+}
+
+func validateStock(items []StockUpsert) error {
+	for _, it := range items {
+		if strings.TrimSpace(it.ProductID) == "" || it.Available < 0 {
+			return errors.New("each item must have product_id and available >= 0")
+		}
+	}
+	return nil
+}
+
+// write применяет upsert остатков одной транзакцией. reset=true предварительно очищает
+// каталог вместе со всеми резервами, чтобы прогон начинался с известного состояния.
+// В стратегии escrow остаток SKU заново раскладывается по шардам.
+func (s *stockStore) write(ctx context.Context, reset bool, items []StockUpsert) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if reset {
+		if _, err := tx.Exec(ctx, `DELETE FROM inventory_reservations`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM inventory_stock_shards`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM inventory_stock`); err != nil {
+			return err
+		}
+	}
+
+	sorted := append([]StockUpsert(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ProductID < sorted[j].ProductID })
+	for _, it := range sorted {
+		tag, err := tx.Exec(ctx, `INSERT INTO inventory_stock(product_id, available) VALUES ($1, $2)
+			ON CONFLICT (product_id) DO UPDATE SET available=EXCLUDED.available, version=inventory_stock.version+1, updated_at=now()
+			WHERE inventory_stock.reserved <= EXCLUDED.available`, it.ProductID, it.Available)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("%s: %w", it.ProductID, errBelowReserved)
+		}
+		if s.Strategy == lockEscrow {
+			if err := s.resetShards(ctx, tx, it); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// resetShards раскладывает новый остаток SKU по шардам. Пока по шардам есть незавершённые
+// резервы, перераскладка отклоняется.
+func (s *stockStore) resetShards(ctx context.Context, tx pgx.Tx, it StockUpsert) error {
+	var reserved int32
+	err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(reserved), 0)::int FROM inventory_stock_shards WHERE product_id=$1`, it.ProductID).Scan(&reserved)
+	if err != nil {
+		return err
+	}
+	if reserved > 0 {
+		return fmt.Errorf("%s: %w", it.ProductID, errBelowReserved)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM inventory_stock_shards WHERE product_id=$1`, it.ProductID); err != nil {
+		return err
+	}
+	return s.splitShards(ctx, tx, it.ProductID, it.Available)
+}
+
+// readStock читает остатки одного SKU (productID != "") или всего каталога.
+// Для SKU, разложенных по escrow-шардам, счётчики суммируются по шардам.
+func readStock(ctx context.Context, pool *pgxpool.Pool, productID string) ([]StockLevel, error) {
+	rows, err := pool.Query(ctx, `SELECT s.product_id, COALESCE(sh.available, s.available), COALESCE(sh.reserved, s.reserved), COALESCE(c.committed, 0)
+		FROM inventory_stock s
+		LEFT JOIN (
+			SELECT product_id, SUM(available)::int AS available, SUM(reserved)::int AS reserved
+			FROM inventory_stock_shards
+			GROUP BY product_id
+		) sh USING (product_id)
+		LEFT JOIN (
+			SELECT product_id, SUM(quantity) AS committed
+			FROM inventory_reservations
+			WHERE status='COMMITTED'
+			GROUP BY product_id
+		) c USING (product_id)
+		WHERE $1 = '' OR s.product_id = $1
+		ORDER BY s.product_id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	levels := []StockLevel{}
+	for rows.Next() {
+		var l StockLevel
+		if err := rows.Scan(&l.ProductID, &l.Available, &l.Reserved, &l.Committed); err != nil {
+			return nil, err
+		}
+		l.Free = l.Available - l.Reserved
+		levels = append(levels, l)
+	}
+	return levels, rows.Err()
+}
+
+func respondStockError(w http.ResponseWriter, m *metrics.ServerMetrics, handler string, start time.Time, err error) {
+	if errors.Is(err, errBelowReserved) {
+		respondStock(w, m, handler, start, http.StatusConflict, map[string]any{"error": err.Error()})
+		return
+	}
+	respondStock(w, m, handler, start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+}
+
+func respondStock(w http.ResponseWriter, m *metrics.ServerMetrics, handler string, start time.Time, code int, v any) {
+	writeJSON(w, code, v)
+	m.Requests.WithLabelValues(handler, strconv.Itoa(code)).Inc()
+	m.LatencyMS.WithLabelValues(handler).Observe(float64(time.Since(start).Milliseconds()))
+}
@@ -4,33 +4,33 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/idempotency"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
 )
 
 type cfg struct {
-	Port         string
-	DatabaseURL  string
-	KafkaBrokers string
-	Topic        string
-	GroupID      string
-}
-
-type Event struct {
-	EventID string         `json:"event_id"`
-	TxID    string         `json:"txid"`
-	OrderID string         `json:"order_id"`
-	Type    string         `json:"type"`
-	Payload map[string]any `json:"payload"`
+	Port        string
+	DatabaseURL string
+	Broker      kafka.Config
+	Routing     contracts.Routing
+	GroupID     string
+	Consumer    kafka.ConsumerConfig
+	Idempotency idempotency.Config
 }
 
 func main() {
@@ -49,11 +49,20 @@ func main() {
 
 	srvMetrics := metrics.NewServerMetrics("notification_service")
 
-	kafkaClient := kafka.NewClient(cfg.KafkaBrokers)
-	if kafkaClient.Enabled() {
-		go consumeEvents(pool, kafkaClient, cfg)
+	if cfg.Broker.Enabled() {
+		broker, err := kafka.Open(cfg.Broker)
+		if err != nil {
+			log.Fatalf("broker error: %v", err)
+		}
+		if err := kafka.EnsureTopics(ctx, broker, cfg.Routing.Topics()); err != nil {
+			log.Printf("ensure topics error: %v", err)
+		}
+		go consumeEvents(pool, broker, cfg, metrics.NewConsumerMetrics("notification_service"))
 	}
 
+	idem := idempotency.New(pool, cfg.Idempotency, metrics.NewIdempotencyMetrics("notification_service"))
+	idem.Start(context.Background())
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -69,7 +78,7 @@ func main() {
 	})
 	mux.Handle("/metrics", metrics.Handler())
 
-	srv := &http.Server{Addr: ":" + cfg.Port, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: idem.Wrap(mux), ReadHeaderTimeout: 5 * time.Second}
 	log.Printf("notification-service listening on :%s", cfg.Port)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -80,51 +89,83 @@ func readCfg() (cfg, error) {
 	if db == "" {
 		return cfg{}, errors.New("DATABASE_URL is required")
 	}
+	routes, err := contracts.ParseRoutes(os.Getenv("EVENT_ROUTES"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("EVENT_ROUTES: %w", err)
+	}
+	topicPartitions, err := contracts.ParsePartitions(os.Getenv("KAFKA_TOPIC_PARTITIONS"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("KAFKA_TOPIC_PARTITIONS: %w", err)
+	}
+	partitions, _ := strconv.Atoi(getenv("KAFKA_PARTITIONS", "3"))
+	consumerAttempts, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_ATTEMPTS", "5"))
+	consumerBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_BACKOFF_MS", "200"))
+	consumerMaxBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_BACKOFF_MS", "5000"))
+	idemTTLMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_TTL_MS", "86400000"))
+	idemLeaseMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_LEASE_MS", "60000"))
 	return cfg{
-		Port:         port,
-		DatabaseURL:  db,
-		KafkaBrokers: getenv("KAFKA_BROKERS", ""),
-		Topic:        getenv("KAFKA_TOPIC", "txlab.events"),
-		GroupID:      getenv("KAFKA_GROUP_ID", "notification-service"),
+		Port:        port,
+		DatabaseURL: db,
+		GroupID:     getenv("KAFKA_GROUP_ID", "notification-service"),
+		Broker: kafka.Config{
+			Kind:      getenv("BROKER", "kafka"),
+			Brokers:   getenv("KAFKA_BROKERS", ""),
+			RedisAddr: getenv("REDIS_ADDR", ""),
+		},
+		Routing: contracts.Routing{
+			Topic:           getenv("KAFKA_TOPIC", "txlab.events"),
+			Routes:          routes,
+			Partitions:      partitions,
+			TopicPartitions: topicPartitions,
+		},
+		Consumer: kafka.ConsumerConfig{
+			MaxAttempts: consumerAttempts,
+			Backoff:     time.Duration(consumerBackoffMS) * time.Millisecond,
+			MaxBackoff:  time.Duration(consumerMaxBackoffMS) * time.Millisecond,
+		},
+		Idempotency: idempotency.Config{
+			TTL:   time.Duration(idemTTLMS) * time.Millisecond,
+			Lease: time.Duration(idemLeaseMS) * time.Millisecond,
+		},
 	}, nil
 }
 
-func consumeEvents(pool *pgxpool.Pool, client *kafka.Client, cfg cfg) {
-	reader := client.NewReader(cfg.Topic, cfg.GroupID)
-	defer reader.Close()
-	for {
-		msg, err := reader.ReadMessage(context.Background())
+func consumeEvents(pool *pgxpool.Pool, broker kafka.Broker, cfg cfg, m *metrics.ConsumerMetrics) {
+	// Уведомления строятся по всем событиям, поэтому сервис подписан на все топики маршрутизации.
+	var topics []string
+	for topic := range cfg.Routing.Topics() {
+		topics = append(topics, topic)
+	}
+	kafka.Consume(context.Background(), broker, topics, cfg.GroupID, cfg.Consumer, func(ctx context.Context, msg kafka.Message) error {
+		meta, err := contracts.Peek(msg.HeaderMap(), msg.Value)
 		if err != nil {
-			log.Printf("kafka read error: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
 		}
-		var evt Event
-		if err := json.Unmarshal(msg.Value, &evt); err != nil {
-			log.Printf("event decode error: %v", err)
-			continue
-		}
-		if evt.EventID == "" {
-			continue
+		// Дубль отсекается по event_id из заголовков, тело разбирается только у нового события.
+		fresh, err := outbox.Receive(ctx, pool, meta.EventID, func(ctx context.Context, tx pgx.Tx) error {
+			evt, err := meta.Decode(msg.Value)
+			if err != nil {
+				return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+			}
+			return saveNotification(ctx, tx, evt)
+		})
+		if err != nil {
+			return err
 		}
-		if err := saveNotification(context.Background(), pool, evt); err != nil {
-			log.Printf("notification save error: %v", err)
-			continue
+		status := "emitted"
+		if !fresh {
+			status = "duplicate"
 		}
-		logging.Log(logging.Fields{Service: "notification-service", TxID: evt.TxID, OrderID: evt.OrderID, EventID: evt.EventID, Step: evt.Type, Status: "emitted"})
-	}
+		logging.Log(logging.Fields{Service: "notification-service", TxID: meta.TxID, OrderID: meta.OrderID, EventID: meta.EventID, Step: meta.Type, Status: status})
+		return nil
+	}, m)
 }
 
-func saveNotification(ctx context.Context, pool *pgxpool.Pool, evt Event) error {
-	_, err := pool.Exec(ctx, `INSERT INTO inbox(event_id, received_at)
-		VALUES ($1, now()) ON CONFLICT (event_id) DO NOTHING`, evt.EventID)
-	if err != nil {
-		return err
-	}
-
-	data, _ := json.Marshal(evt.Payload)
-	_, err = pool.Exec(ctx, `INSERT INTO notifications(event_id, order_id, txid, type, payload)
-		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (event_id) DO NOTHING`, evt.EventID, evt.OrderID, evt.TxID, evt.Type, string(data))
+// saveNotification сохраняет уведомление в транзакции inbox: отметка о получении
+// и уведомление фиксируются вместе.
+func saveNotification(ctx context.Context, tx pgx.Tx, evt contracts.Event) error {
+	_, err := tx.Exec(ctx, `INSERT INTO notifications(event_id, order_id, txid, type, payload)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (event_id) DO NOTHING`, evt.EventID, evt.OrderID, evt.TxID, evt.Type, string(evt.Payload))
 	return err
 }
 
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// Завершение саги-хореографии (TX_MODE=saga-chor) на стороне order-service:
+//   shipping.created                       -> заказ CONFIRMED, order.confirmed
+//   inventory.rejected / inventory.released -> заказ REJECTED,  order.compensated
+// inventory.released приходит, когда откат платежа и резерва уже выполнен.
+
+// consumedEvents — события, которые обрабатывает сервис: он подписан только на их топики.
+var consumedEvents = []string{contracts.EventShipmentCreated, contracts.EventInventoryRejected, contracts.EventInventoryReleased}
+
+func consumeChoreography(ctx context.Context, pool *pgxpool.Pool, broker kafka.Broker, cfg cfg, m *metrics.ConsumerMetrics) {
+	kafka.Consume(ctx, broker, cfg.Routing.TopicsFor(consumedEvents...), cfg.KafkaGroupID, cfg.Consumer, func(ctx context.Context, msg kafka.Message) error {
+		meta, err := contracts.Peek(msg.HeaderMap(), msg.Value)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		start := time.Now()
+		status, reason, err := handleChoreographyEvent(ctx, pool, cfg, meta, msg.Value)
+		if err != nil || status == "" {
+			return err
+		}
+		logging.Log(logging.Fields{
+			Service:    "order-service",
+			TxID:       meta.TxID,
+			OrderID:    meta.OrderID,
+			EventID:    meta.EventID,
+			Step:       "saga_chor",
+			Status:     status,
+			DurationMS: time.Since(start).Milliseconds(),
+			Message:    reason,
+		})
+		return nil
+	}, m)
+}
+
+// handleChoreographyEvent переводит заказ в финальный статус и возвращает его в нижнем регистре
+// ("duplicate" для повторной доставки, "stale" — заказ уже в финальном статусе, пусто — событие не финальное)
+// и причину отказа из payload. Тип и event_id берутся из заголовков: тело разбирается только у нового
+// финального события.
+func handleChoreographyEvent(ctx context.Context, pool *pgxpool.Pool, cfg cfg, meta contracts.Meta, body []byte) (string, string, error) {
+	var status, next string
+	switch meta.Type {
+	case contracts.EventShipmentCreated:
+		status, next = "CONFIRMED", contracts.EventOrderConfirmed
+	case contracts.EventInventoryRejected, contracts.EventInventoryReleased:
+		status, next = "REJECTED", contracts.EventOrderCompensated
+	default:
+		return "", "", nil
+	}
+
+	stale, reason := false, ""
+	fresh, err := outbox.Receive(ctx, pool, meta.EventID, func(ctx context.Context, tx pgx.Tx) error {
+		evt, err := meta.Decode(body)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		var payload contracts.OrderPayload
+		if err := evt.DecodePayload(&payload); err != nil {
+			return err
+		}
+		reason = payload.Reason
+		tag, err := tx.Exec(ctx, `UPDATE orders SET status=$2, updated_at=now()
+			WHERE id=$1 AND status IN ('PENDING','PROCESSING')`, evt.OrderID, status)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			stale = true
+			return nil
+		}
+		return enqueueChoreographyEvent(ctx, tx, cfg, evt, next)
+	})
+	switch {
+	case err != nil:
+		return "", "", err
+	case !fresh:
+		return "duplicate", "", nil
+	case stale:
+		return "stale", reason, nil
+	case status == "CONFIRMED":
+		return "confirmed", reason, nil
+	}
+	return "rejected", reason, nil
+}
+
+// enqueueChoreographyEvent кладёт в outbox событие eventType, вызванное cause, с payload заказа cause.
+func enqueueChoreographyEvent(ctx context.Context, tx pgx.Tx, cfg cfg, cause contracts.Event, eventType string) error {
+	var payload contracts.OrderPayload
+	if err := cause.DecodePayload(&payload); err != nil {
+		return err
+	}
+	evt, err := contracts.Caused(cause, eventType, "order-service", &payload)
+	if err != nil {
+		return err
+	}
+	return outbox.InsertEvent(ctx, tx, cfg.Routing, evt)
+}
@@ -14,32 +14,46 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	segmentkafka "github.com/segmentio/kafka-go"
 
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/idempotency"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/coordinator"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
 )
 
-var errIdempotencyRace = errors.New("idempotency race")
-
 type cfg struct {
-	Port                string
-	DatabaseURL         string
-	TxMode              string // twopc | none
-	RequestTimeout      time.Duration
-	Mock2PCParticipants bool
-	InventoryBaseURL    string
-	PaymentBaseURL      string
-	ShippingBaseURL     string
-	KafkaBrokers        string
-	KafkaTopic          string
-	OutboxPollInterval  time.Duration
-	OutboxBatchSize     int
+	Port                  string
+	DatabaseURL           string
+	TxMode                string // twopc | tcc | saga-orch | saga-chor | outbox | outbox-cdc
+	RequestTimeout        time.Duration
+	Mock2PCParticipants   bool
+	InventoryBaseURL      string
+	PaymentBaseURL        string
+	ShippingBaseURL       string
+	Broker                kafka.Config
+	Routing               contracts.Routing
+	KafkaGroupID          string
+	Outbox                outbox.RelayConfig
+	Consumer              kafka.ConsumerConfig
+	Idempotency           idempotency.Config
+	OutboxCDCSlot         string
+	OutboxCDCPublication  string
+	OutboxCDCRetry        time.Duration
+	TwoPCFanout           coordinator.Fanout
+	TwoPCPhaseTimeout     time.Duration
+	RecoveryInterval      time.Duration
+	RecoveryGrace         time.Duration
+	RecoveryBatchSize     int
+	SagaRecoveryInterval  time.Duration
+	SagaRecoveryGrace     time.Duration
+	SagaRecoveryBatchSize int
 }
 
 func readCfg() (cfg, error) {
@@ -53,6 +67,34 @@ func readCfg() (cfg, error) {
 	mock := strings.ToLower(getenv("MOCK_2PC", "true"))
 	outboxPollMS, _ := strconv.Atoi(getenv("OUTBOX_POLL_MS", "500"))
 	outboxBatch, _ := strconv.Atoi(getenv("OUTBOX_BATCH", "100"))
+	outboxLeaseMS, _ := strconv.Atoi(getenv("OUTBOX_LEASE_MS", "30000"))
+	outboxLingerMS, _ := strconv.Atoi(getenv("OUTBOX_LINGER_MS", "5"))
+	outboxMaxAttempts, _ := strconv.Atoi(getenv("OUTBOX_MAX_ATTEMPTS", "10"))
+	outboxBackoffMS, _ := strconv.Atoi(getenv("OUTBOX_RETRY_BACKOFF_MS", "1000"))
+	outboxRetentionMS, _ := strconv.Atoi(getenv("OUTBOX_RETENTION_MS", "86400000"))
+	routes, err := contracts.ParseRoutes(os.Getenv("EVENT_ROUTES"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("EVENT_ROUTES: %w", err)
+	}
+	topicPartitions, err := contracts.ParsePartitions(os.Getenv("KAFKA_TOPIC_PARTITIONS"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("KAFKA_TOPIC_PARTITIONS: %w", err)
+	}
+	partitions, _ := strconv.Atoi(getenv("KAFKA_PARTITIONS", "3"))
+	consumerAttempts, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_ATTEMPTS", "5"))
+	consumerBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_BACKOFF_MS", "200"))
+	consumerMaxBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_BACKOFF_MS", "5000"))
+	idemTTLMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_TTL_MS", "86400000"))
+	idemLeaseMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_LEASE_MS", "60000"))
+	notify := strings.ToLower(getenv("OUTBOX_NOTIFY", "false"))
+	cdcRetryMS, _ := strconv.Atoi(getenv("OUTBOX_CDC_RETRY_MS", "5000"))
+	phaseTimeoutMS, _ := strconv.Atoi(getenv("TWOPC_PHASE_TIMEOUT_MS", "5000"))
+	recoveryMS, _ := strconv.Atoi(getenv("TWOPC_RECOVERY_MS", "5000"))
+	recoveryGraceMS, _ := strconv.Atoi(getenv("TWOPC_RECOVERY_GRACE_MS", "30000"))
+	recoveryBatch, _ := strconv.Atoi(getenv("TWOPC_RECOVERY_BATCH", "50"))
+	sagaRecoveryMS, _ := strconv.Atoi(getenv("SAGA_RECOVERY_MS", "5000"))
+	sagaRecoveryGraceMS, _ := strconv.Atoi(getenv("SAGA_RECOVERY_GRACE_MS", "30000"))
+	sagaRecoveryBatch, _ := strconv.Atoi(getenv("SAGA_RECOVERY_BATCH", "50"))
 
 	return cfg{
 		Port:                port,
@@ -63,10 +105,48 @@ func readCfg() (cfg, error) {
 		InventoryBaseURL:    strings.TrimRight(getenv("INVENTORY_BASE_URL", ""), "/"),
 		PaymentBaseURL:      strings.TrimRight(getenv("PAYMENT_BASE_URL", ""), "/"),
 		ShippingBaseURL:     strings.TrimRight(getenv("SHIPPING_BASE_URL", ""), "/"),
-		KafkaBrokers:        getenv("KAFKA_BROKERS", ""),
-		KafkaTopic:          getenv("KAFKA_TOPIC", "txlab.events"),
-		OutboxPollInterval:  time.Duration(outboxPollMS) * time.Millisecond,
-		OutboxBatchSize:     outboxBatch,
+		KafkaGroupID:        getenv("KAFKA_GROUP_ID", "order-service"),
+		Broker: kafka.Config{
+			Kind:      getenv("BROKER", "kafka"),
+			Brokers:   getenv("KAFKA_BROKERS", ""),
+			RedisAddr: getenv("REDIS_ADDR", ""),
+		},
+		Routing: contracts.Routing{
+			Topic:           getenv("KAFKA_TOPIC", "txlab.events"),
+			Routes:          routes,
+			Partitions:      partitions,
+			TopicPartitions: topicPartitions,
+		},
+		Outbox: outbox.RelayConfig{
+			PollInterval: time.Duration(outboxPollMS) * time.Millisecond,
+			BatchSize:    outboxBatch,
+			Lease:        time.Duration(outboxLeaseMS) * time.Millisecond,
+			Linger:       time.Duration(outboxLingerMS) * time.Millisecond,
+			MaxAttempts:  outboxMaxAttempts,
+			RetryBackoff: time.Duration(outboxBackoffMS) * time.Millisecond,
+			Retention:    time.Duration(outboxRetentionMS) * time.Millisecond,
+			Notify:       notify == "1" || notify == "true" || notify == "yes",
+		},
+		Consumer: kafka.ConsumerConfig{
+			MaxAttempts: consumerAttempts,
+			Backoff:     time.Duration(consumerBackoffMS) * time.Millisecond,
+			MaxBackoff:  time.Duration(consumerMaxBackoffMS) * time.Millisecond,
+		},
+		Idempotency: idempotency.Config{
+			TTL:   time.Duration(idemTTLMS) * time.Millisecond,
+			Lease: time.Duration(idemLeaseMS) * time.Millisecond,
+		},
+		OutboxCDCSlot:         getenv("OUTBOX_CDC_SLOT", "txlab_outbox"),
+		OutboxCDCPublication:  getenv("OUTBOX_CDC_PUBLICATION", "txlab_outbox"),
+		OutboxCDCRetry:        time.Duration(cdcRetryMS) * time.Millisecond,
+		TwoPCFanout:           coordinator.ParseFanout(getenv("TWOPC_FANOUT", "sequential")),
+		TwoPCPhaseTimeout:     time.Duration(phaseTimeoutMS) * time.Millisecond,
+		RecoveryInterval:      time.Duration(recoveryMS) * time.Millisecond,
+		RecoveryGrace:         time.Duration(recoveryGraceMS) * time.Millisecond,
+		RecoveryBatchSize:     recoveryBatch,
+		SagaRecoveryInterval:  time.Duration(sagaRecoveryMS) * time.Millisecond,
+		SagaRecoveryGrace:     time.Duration(sagaRecoveryGraceMS) * time.Millisecond,
+		SagaRecoveryBatchSize: sagaRecoveryBatch,
 	}, nil
 }
 
@@ -82,17 +162,14 @@ type CheckoutRequest struct {
 }
 
 type CheckoutResponse struct {
-	OrderID string `json:"order_id"`
-	TxID    string `json:"txid,omitempty"`
-	Status  string `json:"status"`
-}
-
-type Event struct {
-	EventID string         `json:"event_id"`
-	TxID    string         `json:"txid"`
-	OrderID string         `json:"order_id"`
-	Type    string         `json:"type"`
-	Payload map[string]any `json:"payload"`
+	OrderID    string `json:"order_id"`
+	TxID       string `json:"txid,omitempty"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+	AbortCause string `json:"abort_cause,omitempty"` // vote_no | participant_unavailable
+	// Только для twopc: режим рассылки и время участников по фазам ("inventory.prepare").
+	Fanout               string             `json:"fanout,omitempty"`
+	ParticipantLatencyMS map[string]float64 `json:"participant_latency_ms,omitempty"`
 }
 
 func main() {
@@ -100,6 +177,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	outbox.Notify = cfg.Outbox.Notify
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -116,12 +194,35 @@ func main() {
 	}
 
 	client := &http.Client{Timeout: cfg.RequestTimeout}
-	kafkaClient := kafka.NewClient(cfg.KafkaBrokers)
-	if kafkaClient.Enabled() {
-		startOutboxRelay(context.Background(), pool, kafkaClient, cfg)
+	if !strings.EqualFold(cfg.TxMode, "outbox-cdc") {
+		dropCDCSlot(context.Background(), pool, cfg)
 	}
+	if cfg.Broker.Enabled() {
+		broker, err := kafka.Open(cfg.Broker)
+		if err != nil {
+			log.Fatalf("broker error: %v", err)
+		}
+		if err := kafka.EnsureTopics(ctx, broker, cfg.Routing.Topics()); err != nil {
+			// Не фатально: без нужного числа партиций сервис работает, но не масштабируется по репликам.
+			log.Printf("ensure topics error: %v", err)
+		}
+		// polling outbox и log-tailing outbox сравниваются как разные режимы: relay один из двух.
+		if strings.EqualFold(cfg.TxMode, "outbox-cdc") {
+			startCDCRelay(context.Background(), pool, broker, cfg, metrics.NewOutboxMetrics("order_service"))
+		} else {
+			outbox.NewRelay(pool, broker, cfg.Outbox, metrics.NewOutboxMetrics("order_service")).Start(context.Background())
+		}
+		go consumeChoreography(context.Background(), pool, broker, cfg, metrics.NewConsumerMetrics("order_service"))
+	}
+	engine := newTwoPCEngine(pool, cfg)
+	startTwoPCRecovery(context.Background(), engine, client, cfg)
+	startSagaRecovery(context.Background(), pool, client, cfg)
 
 	srvMetrics := metrics.NewServerMetrics("order_service")
+	twopcMetrics := metrics.NewTwoPCMetrics("order_service")
+	idem := idempotency.New(pool, cfg.Idempotency, metrics.NewIdempotencyMetrics("order_service"))
+	idem.Start(context.Background())
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -163,6 +264,47 @@ func main() {
 		srvMetrics.LatencyMS.WithLabelValues("orders").Observe(float64(time.Since(start).Milliseconds()))
 	})
 	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/outbox/dead", func(w http.ResponseWriter, r *http.Request) {
+		handleOutboxDead(pool, srvMetrics, w, r)
+	})
+	mux.HandleFunc("/admin/outbox/dead/requeue", func(w http.ResponseWriter, r *http.Request) {
+		handleOutboxRequeue(pool, srvMetrics, w, r)
+	})
+	mux.HandleFunc("/admin/outbox/replay", func(w http.ResponseWriter, r *http.Request) {
+		handleOutboxReplay(pool, srvMetrics, w, r)
+	})
+	mux.HandleFunc("/2pc/tx/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+			srvMetrics.Requests.WithLabelValues("twopc_tx", "405").Inc()
+			srvMetrics.LatencyMS.WithLabelValues("twopc_tx").Observe(float64(time.Since(start).Milliseconds()))
+			return
+		}
+		txid := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/2pc/tx/"))
+		entry, err := engine.Log.Get(r.Context(), common.TxID(txid))
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Неизвестная координатору транзакция: участник применяет presumed abort.
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": "tx not found"})
+			srvMetrics.Requests.WithLabelValues("twopc_tx", "404").Inc()
+			srvMetrics.LatencyMS.WithLabelValues("twopc_tx").Observe(float64(time.Since(start).Milliseconds()))
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			srvMetrics.Requests.WithLabelValues("twopc_tx", "500").Inc()
+			srvMetrics.LatencyMS.WithLabelValues("twopc_tx").Observe(float64(time.Since(start).Milliseconds()))
+			return
+		}
+		writeJSON(w, http.StatusOK, protocol.DecisionResponse{
+			TxID:     txid,
+			OrderID:  entry.OrderID,
+			Status:   string(entry.Status),
+			Decision: coordinator.Decision(entry.Status),
+		})
+		srvMetrics.Requests.WithLabelValues("twopc_tx", "200").Inc()
+		srvMetrics.LatencyMS.WithLabelValues("twopc_tx").Observe(float64(time.Since(start).Milliseconds()))
+	})
 	mux.HandleFunc("/checkout", func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		if r.Method != http.MethodPost {
@@ -204,49 +346,16 @@ func main() {
 			orderID = uuid.NewString()
 		}
 
-		idemKey := idempotency.Key(r)
 		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 		defer cancel()
 
-		// Идемпотентность: если ключ уже есть, вернём существующий order_id.
-		if idemKey != "" {
-			if existing, err := getOrderByIdempotency(ctx, pool, idemKey); err == nil && existing != "" {
-				logging.Log(logging.Fields{
-					Service:    "order-service",
-					OrderID:    existing,
-					Step:       "checkout",
-					Status:     "idempotent_replay",
-					DurationMS: time.Since(start).Milliseconds(),
-				})
-				writeJSON(w, http.StatusOK, CheckoutResponse{OrderID: existing, Status: "IDEMPOTENT_REPLAY"})
-				srvMetrics.Requests.WithLabelValues("checkout", "200").Inc()
-				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
-				return
-			}
-		}
-
-		// 1) Создаём заказ + позиции + (опционально) лог 2PC (STARTED)
+		// 1) Создаём заказ + позиции (журнал 2PC создаёт coordinator.Engine)
 		txid := ""
 		if strings.EqualFold(cfg.TxMode, "twopc") {
 			txid = uuid.NewString()
 		}
 
-		if err := createOrder(ctx, pool, orderID, idemKey, req.Items, req.Total, txid, cfg); err != nil {
-			if errors.Is(err, errIdempotencyRace) && idemKey != "" {
-				if existing, qerr := getOrderByIdempotency(ctx, pool, idemKey); qerr == nil && existing != "" {
-					logging.Log(logging.Fields{
-						Service:    "order-service",
-						OrderID:    existing,
-						Step:       "checkout",
-						Status:     "idempotent_race",
-						DurationMS: time.Since(start).Milliseconds(),
-					})
-					writeJSON(w, http.StatusOK, CheckoutResponse{OrderID: existing, Status: "IDEMPOTENT_REPLAY"})
-					srvMetrics.Requests.WithLabelValues("checkout", "200").Inc()
-					srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
-					return
-				}
-			}
+		if err := createOrder(ctx, pool, orderID, req.Items, req.Total); err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
 			srvMetrics.Requests.WithLabelValues("checkout", "500").Inc()
 			srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
@@ -257,7 +366,7 @@ func main() {
 		switch strings.ToLower(cfg.TxMode) {
 		case "tcc":
 			txid := uuid.NewString()
-			if err := runTCC(ctx, client, pool, cfg, txid, orderID, req); err != nil {
+			if err := runTCC(ctx, client, cfg, txid, orderID, req); err != nil {
 				_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
 				logging.Log(logging.Fields{
 					Service:    "order-service",
@@ -272,7 +381,7 @@ func main() {
 				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 				return
 			}
-			_ = updateOrderStatus(ctx, pool, orderID, "CONFIRMED")
+			_ = updateOrderStatusWithEvent(ctx, pool, cfg, txid, orderID, "CONFIRMED", contracts.EventOrderConfirmed, req)
 			logging.Log(logging.Fields{
 				Service:    "order-service",
 				TxID:       txid,
@@ -287,7 +396,24 @@ func main() {
 			return
 		case "saga-orch":
 			txid := uuid.NewString()
-			if err := runSagaOrch(ctx, client, pool, cfg, txid, orderID, req); err != nil {
+			err := runSagaOrch(ctx, client, pool, cfg, txid, orderID, req)
+			if errors.Is(err, errSagaPending) {
+				// Состояние саги в журнале, её доведёт до финала восстановление.
+				logging.Log(logging.Fields{
+					Service:    "order-service",
+					TxID:       txid,
+					OrderID:    orderID,
+					Step:       "saga_orch",
+					Status:     "pending",
+					DurationMS: time.Since(start).Milliseconds(),
+					Message:    err.Error(),
+				})
+				writeJSON(w, http.StatusAccepted, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "PROCESSING", Reason: err.Error()})
+				srvMetrics.Requests.WithLabelValues("checkout", "202").Inc()
+				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
+				return
+			}
+			if err != nil {
 				_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
 				logging.Log(logging.Fields{
 					Service:    "order-service",
@@ -302,7 +428,6 @@ func main() {
 				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 				return
 			}
-			_ = updateOrderStatus(ctx, pool, orderID, "CONFIRMED")
 			logging.Log(logging.Fields{
 				Service:    "order-service",
 				TxID:       txid,
@@ -317,13 +442,13 @@ func main() {
 			return
 		case "saga-chor":
 			txid := uuid.NewString()
-			if err := enqueueOrderEvent(ctx, pool, cfg, txid, orderID, "OrderCreated", req); err != nil {
+			if err := updateOrderStatusWithEvent(ctx, pool, cfg, txid, orderID, "PENDING", contracts.EventOrderCreated, req); err != nil {
+				_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
 				writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
 				srvMetrics.Requests.WithLabelValues("checkout", "500").Inc()
 				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 				return
 			}
-			_ = updateOrderStatus(ctx, pool, orderID, "PENDING")
 			logging.Log(logging.Fields{
 				Service:    "order-service",
 				TxID:       txid,
@@ -336,20 +461,20 @@ func main() {
 			srvMetrics.Requests.WithLabelValues("checkout", "200").Inc()
 			srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 			return
-		case "outbox":
+		case "outbox", "outbox-cdc":
 			txid := uuid.NewString()
-			if err := enqueueOrderEvent(ctx, pool, cfg, txid, orderID, "OrderConfirmed", req); err != nil {
+			if err := updateOrderStatusWithEvent(ctx, pool, cfg, txid, orderID, "CONFIRMED", contracts.EventOrderConfirmed, req); err != nil {
+				_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
 				writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
 				srvMetrics.Requests.WithLabelValues("checkout", "500").Inc()
 				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 				return
 			}
-			_ = updateOrderStatus(ctx, pool, orderID, "CONFIRMED")
 			logging.Log(logging.Fields{
 				Service:    "order-service",
 				TxID:       txid,
 				OrderID:    orderID,
-				Step:       "outbox",
+				Step:       strings.ToLower(cfg.TxMode),
 				Status:     "confirmed",
 				DurationMS: time.Since(start).Milliseconds(),
 			})
@@ -359,76 +484,62 @@ func main() {
 			return
 		}
 
-		// 3) 2PC: prepare -> commit/abort
-		participants := buildParticipants(cfg)
-		_ = updateTxStatus(ctx, pool, txid, "PREPARING")
-
-		ok := true
-		if !cfg.Mock2PCParticipants {
-			ok = twopcPrepare(ctx, client, txid, orderID, req, participants)
-		}
-
-		if !ok {
-			_ = updateTxStatus(ctx, pool, txid, "ABORTING")
-			if !cfg.Mock2PCParticipants {
-				_ = twopcAbort(ctx, client, txid, orderID, participants)
+		// 3) 2PC: prepare -> commit/abort через coordinator.Engine
+		parts := buildParticipants(cfg, client, participantRefs(cfg), &req)
+		res, err := engine.Execute(ctx, common.TxID(txid), orderID, common.CorrelationID(orderID), parts)
+		latencies := observeParticipantLatencies(twopcMetrics, cfg.TwoPCFanout, res.Latencies)
+		switch {
+		case err == nil:
+			logging.Log(logging.Fields{
+				Service:    "order-service",
+				TxID:       txid,
+				OrderID:    orderID,
+				Step:       "twopc",
+				Status:     "committed",
+				DurationMS: time.Since(start).Milliseconds(),
+			})
+			writeJSON(w, http.StatusOK, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "COMMITTED", Fanout: string(cfg.TwoPCFanout), ParticipantLatencyMS: latencies})
+			srvMetrics.Requests.WithLabelValues("checkout", "200").Inc()
+		case errors.Is(err, common.ErrCommitPending):
+			// Решение COMMIT записано в журнал, оставшихся участников дожмёт восстановление.
+			logging.Log(logging.Fields{
+				Service:    "order-service",
+				TxID:       txid,
+				OrderID:    orderID,
+				Step:       "twopc",
+				Status:     "commit_pending",
+				DurationMS: time.Since(start).Milliseconds(),
+				Message:    err.Error(),
+			})
+			writeJSON(w, http.StatusAccepted, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "COMMITTING", Reason: res.Reason, Fanout: string(cfg.TwoPCFanout), ParticipantLatencyMS: latencies})
+			srvMetrics.Requests.WithLabelValues("checkout", "202").Inc()
+		case res.Status == common.TxAborted:
+			cause := "participant_unavailable"
+			if errors.Is(err, common.ErrVoteNo) {
+				cause = "vote_no"
 			}
-			_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
-			_ = updateTxStatus(ctx, pool, txid, "ABORTED")
 			logging.Log(logging.Fields{
 				Service:    "order-service",
 				TxID:       txid,
 				OrderID:    orderID,
 				Step:       "twopc",
-				Status:     "aborted",
+				Status:     "aborted_" + cause,
 				DurationMS: time.Since(start).Milliseconds(),
+				Message:    res.Reason,
 			})
-			writeJSON(w, http.StatusConflict, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "ABORTED"})
+			writeJSON(w, http.StatusConflict, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "ABORTED", Reason: res.Reason, AbortCause: cause, Fanout: string(cfg.TwoPCFanout), ParticipantLatencyMS: latencies})
 			srvMetrics.Requests.WithLabelValues("checkout", "409").Inc()
-			srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
-			return
-		}
-
-		_ = updateTxStatus(ctx, pool, txid, "COMMITTING")
-		if !cfg.Mock2PCParticipants {
-			if err := twopcCommit(ctx, client, txid, orderID, participants); err != nil {
-				_ = updateTxStatus(ctx, pool, txid, "ABORTING")
-				_ = twopcAbort(ctx, client, txid, orderID, participants)
-				_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
-				_ = updateTxStatus(ctx, pool, txid, "ABORTED")
-				logging.Log(logging.Fields{
-					Service:    "order-service",
-					TxID:       txid,
-					OrderID:    orderID,
-					Step:       "twopc",
-					Status:     "abort_after_commit_fail",
-					DurationMS: time.Since(start).Milliseconds(),
-				})
-				writeJSON(w, http.StatusConflict, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "ABORTED"})
-				srvMetrics.Requests.WithLabelValues("checkout", "409").Inc()
-				srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
-				return
-			}
+		default:
+			_ = updateOrderStatus(ctx, pool, orderID, "REJECTED")
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			srvMetrics.Requests.WithLabelValues("checkout", "500").Inc()
 		}
-
-		_ = updateOrderStatus(ctx, pool, orderID, "CONFIRMED")
-		_ = updateTxStatus(ctx, pool, txid, "COMMITTED")
-		logging.Log(logging.Fields{
-			Service:    "order-service",
-			TxID:       txid,
-			OrderID:    orderID,
-			Step:       "twopc",
-			Status:     "committed",
-			DurationMS: time.Since(start).Milliseconds(),
-		})
-		writeJSON(w, http.StatusOK, CheckoutResponse{OrderID: orderID, TxID: txid, Status: "COMMITTED"})
-		srvMetrics.Requests.WithLabelValues("checkout", "200").Inc()
 		srvMetrics.LatencyMS.WithLabelValues("checkout").Observe(float64(time.Since(start).Milliseconds()))
 	})
 
 	srv := &http.Server{
 		Addr:              ":" + cfg.Port,
-		Handler:           mux,
+		Handler:           idem.Wrap(mux),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -444,7 +555,7 @@ func pingDB(ctx context.Context, pool *pgxpool.Pool) error {
 	return pool.Ping(ctx)
 }
 
-func createOrder(ctx context.Context, pool *pgxpool.Pool, orderID, idemKey string, items []Item, total int64, txid string, cfg cfg) error {
+func createOrder(ctx context.Context, pool *pgxpool.Pool, orderID string, items []Item, total int64) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
@@ -472,105 +583,33 @@ func createOrder(ctx context.Context, pool *pgxpool.Pool, orderID, idemKey strin
 		}
 	}
 
-	if idemKey != "" {
-		_, err = tx.Exec(ctx,
-			`INSERT INTO order_idempotency(idempotency_key, order_id) VALUES($1, $2)`,
-			idemKey, orderID,
-		)
-		if err != nil {
-			// конфликт — значит повтор (в другой реплике) или гонка.
-			if isUniqueViolation(err) {
-				return errIdempotencyRace
-			}
-			return err
-		}
-	}
-
-	if txid != "" {
-		parts := buildParticipants(cfg)
-		participantsJSON, _ := json.Marshal(parts)
-		_, err = tx.Exec(ctx,
-			`INSERT INTO twopc_tx_log(txid, order_id, status, participants) VALUES($1, $2, $3, $4)`,
-			txid, orderID, "STARTED", participantsJSON,
-		)
-		if err != nil {
-			return err
-		}
-	}
-
 	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
 	return nil
 }
 
-func getOrderByIdempotency(ctx context.Context, pool *pgxpool.Pool, key string) (string, error) {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-	defer cancel()
-	var orderID string
-	err := pool.QueryRow(ctx, `SELECT order_id FROM order_idempotency WHERE idempotency_key=$1`, key).Scan(&orderID)
-	if err != nil {
-		return "", err
-	}
-	return orderID, nil
-}
-
 func updateOrderStatus(ctx context.Context, pool *pgxpool.Pool, orderID, status string) error {
 	_, err := pool.Exec(ctx, `UPDATE orders SET status=$2, updated_at=now() WHERE id=$1`, orderID, status)
 	return err
 }
 
-func updateTxStatus(ctx context.Context, pool *pgxpool.Pool, txid, status string) error {
-	_, err := pool.Exec(ctx, `UPDATE twopc_tx_log SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
-	return err
-}
-
-type participant struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
-}
-
-func buildParticipants(cfg cfg) []participant {
-	var ps []participant
-	if cfg.InventoryBaseURL != "" {
-		ps = append(ps, participant{Name: "inventory", URL: cfg.InventoryBaseURL})
-	}
-	if cfg.PaymentBaseURL != "" {
-		ps = append(ps, participant{Name: "payment", URL: cfg.PaymentBaseURL})
-	}
-	if cfg.ShippingBaseURL != "" {
-		ps = append(ps, participant{Name: "shipping", URL: cfg.ShippingBaseURL})
-	}
-	return ps
-}
-
-func twopcPrepare(ctx context.Context, client *http.Client, txid, orderID string, req CheckoutRequest, participants []participant) bool {
-	body := map[string]any{"txid": txid, "order_id": orderID, "items": req.Items, "total": req.Total}
-	for _, p := range participants {
-		if err := postJSON(ctx, client, p.URL+"/2pc/prepare", body); err != nil {
-			log.Printf("2PC prepare failed for %s: %v", p.Name, err)
-			return false
-		}
+// updateOrderStatusWithEvent меняет статус заказа и кладёт событие в outbox одной транзакцией:
+// событие публикуется тогда и только тогда, когда статус зафиксирован.
+func updateOrderStatusWithEvent(ctx context.Context, pool *pgxpool.Pool, cfg cfg, txid, orderID, status, eventType string, req CheckoutRequest) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
 	}
-	return true
-}
+	defer func() { _ = tx.Rollback(ctx) }()
 
-func twopcCommit(ctx context.Context, client *http.Client, txid, orderID string, participants []participant) error {
-	body := map[string]any{"txid": txid, "order_id": orderID}
-	for _, p := range participants {
-		if err := postJSON(ctx, client, p.URL+"/2pc/commit", body); err != nil {
-			return fmt.Errorf("commit failed for %s: %w", p.Name, err)
-		}
+	if _, err := tx.Exec(ctx, `UPDATE orders SET status=$2, updated_at=now() WHERE id=$1`, orderID, status); err != nil {
+		return err
 	}
-	return nil
-}
-
-func twopcAbort(ctx context.Context, client *http.Client, txid, orderID string, participants []participant) error {
-	body := map[string]any{"txid": txid, "order_id": orderID}
-	for _, p := range participants {
-		_ = postJSON(ctx, client, p.URL+"/2pc/abort", body)
+	if err := enqueueOrderEvent(ctx, tx, cfg, txid, orderID, eventType, req); err != nil {
+		return err
 	}
-	return nil
+	return tx.Commit(ctx)
 }
 
 type tccStep struct {
@@ -593,107 +632,53 @@ func buildTCCSteps(cfg cfg) []tccStep {
 	return steps
 }
 
-func runTCC(ctx context.Context, client *http.Client, pool *pgxpool.Pool, cfg cfg, txid, orderID string, req CheckoutRequest) error {
+func runTCC(ctx context.Context, client *http.Client, cfg cfg, txid, orderID string, req CheckoutRequest) error {
 	steps := buildTCCSteps(cfg)
 	body := func(step string) map[string]any {
-		return map[string]any{"txid": txid, "order_id": orderID, "step": step, "items": req.Items, "total": req.Total}
+		return map[string]any{"txid": txid, "order_id": orderID, "step": step, "items": req.Items, "total": req.Total, "amount": req.Total}
 	}
 	var completed []tccStep
 	for _, step := range steps {
 		if err := postJSON(ctx, client, step.URL+"/tcc/try", body(step.Step)); err != nil {
-			_ = compensateTCC(ctx, client, completed, txid, orderID)
+			// Try мог примениться у участника, даже если ответ не дошёл: Cancel получает и он.
+			// Если Try ещё не дошёл, Cancel станет пустым откатом и заблокирует опоздавший Try.
+			_ = compensateTCC(client, cfg, append(completed, step), txid, orderID)
 			return fmt.Errorf("tcc try failed for %s: %w", step.Name, err)
 		}
 		completed = append(completed, step)
 	}
 	for _, step := range completed {
 		if err := postJSON(ctx, client, step.URL+"/tcc/confirm", body(step.Step)); err != nil {
-			_ = compensateTCC(ctx, client, completed, txid, orderID)
+			_ = compensateTCC(client, cfg, completed, txid, orderID)
 			return fmt.Errorf("tcc confirm failed for %s: %w", step.Name, err)
 		}
 	}
-	_ = enqueueOrderEvent(ctx, pool, cfg, txid, orderID, "OrderConfirmed", req)
 	return nil
 }
 
-func compensateTCC(ctx context.Context, client *http.Client, steps []tccStep, txid, orderID string) error {
+// compensateTCC отправляет Cancel шагам в обратном порядке. Контекст запроса к этому моменту часто
+// уже истёк, поэтому у каждого Cancel свой таймаут RequestTimeout.
+func compensateTCC(client *http.Client, cfg cfg, steps []tccStep, txid, orderID string) error {
 	for i := len(steps) - 1; i >= 0; i-- {
 		step := steps[i]
 		body := map[string]any{"txid": txid, "order_id": orderID, "step": step.Step}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
 		_ = postJSON(ctx, client, step.URL+"/tcc/cancel", body)
+		cancel()
 	}
 	return nil
 }
 
-func runSagaOrch(ctx context.Context, client *http.Client, pool *pgxpool.Pool, cfg cfg, txid, orderID string, req CheckoutRequest) error {
-	steps := buildTCCSteps(cfg)
-	body := func(step string) map[string]any {
-		return map[string]any{"txid": txid, "order_id": orderID, "step": "saga_orch_" + step, "items": req.Items, "total": req.Total}
-	}
-	var completed []tccStep
-	for _, step := range steps {
-		if err := postJSON(ctx, client, step.URL+"/tcc/try", body(step.Step)); err != nil {
-			_ = compensateSaga(ctx, client, completed, txid, orderID)
-			return fmt.Errorf("saga action failed for %s: %w", step.Name, err)
-		}
-		completed = append(completed, step)
+func enqueueOrderEvent(ctx context.Context, q outbox.Querier, cfg cfg, txid, orderID, eventType string, req CheckoutRequest) error {
+	items := make([]protocol.LineItem, 0, len(req.Items))
+	for _, it := range req.Items {
+		items = append(items, protocol.LineItem{ProductID: it.ProductID, Quantity: int32(it.Quantity)})
 	}
-	_ = enqueueOrderEvent(ctx, pool, cfg, txid, orderID, "OrderConfirmed", req)
-	return nil
-}
-
-func compensateSaga(ctx context.Context, client *http.Client, steps []tccStep, txid, orderID string) error {
-	for i := len(steps) - 1; i >= 0; i-- {
-		step := steps[i]
-		body := map[string]any{"txid": txid, "order_id": orderID, "step": "saga_orch_" + step.Step}
-		_ = postJSON(ctx, client, step.URL+"/tcc/cancel", body)
-	}
-	return nil
-}
-
-func enqueueOrderEvent(ctx context.Context, pool *pgxpool.Pool, cfg cfg, txid, orderID, eventType string, req CheckoutRequest) error {
-	payload := map[string]any{
-		"items": req.Items,
-		"total": req.Total,
-	}
-	eventID := uuid.NewString()
-	event := Event{
-		EventID: eventID,
-		TxID:    txid,
-		OrderID: orderID,
-		Type:    eventType,
-		Payload: payload,
+	evt, err := contracts.New(eventType, "order-service", txid, orderID, &contracts.OrderPayload{Items: items, Total: req.Total})
+	if err != nil {
+		return err
 	}
-	return outbox.Insert(ctx, pool, eventID, cfg.KafkaTopic, orderID, event)
-}
-
-func startOutboxRelay(ctx context.Context, pool *pgxpool.Pool, client *kafka.Client, cfg cfg) {
-	writer := client.NewWriter(cfg.KafkaTopic)
-	go func() {
-		ticker := time.NewTicker(cfg.OutboxPollInterval)
-		defer ticker.Stop()
-		defer writer.Close()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				records, err := outbox.FetchPending(ctx, pool, cfg.OutboxBatchSize)
-				if err != nil {
-					log.Printf("outbox fetch error: %v", err)
-					continue
-				}
-				for _, rec := range records {
-					msg := segmentkafka.Message{Key: []byte(rec.Key), Value: rec.Payload, Time: time.Now().UTC()}
-					if err := writer.WriteMessages(ctx, msg); err != nil {
-						log.Printf("outbox publish error: %v", err)
-						break
-					}
-					_ = outbox.MarkSent(ctx, pool, rec.ID)
-				}
-			}
-		}
-	}()
+	return outbox.InsertEvent(ctx, q, cfg.Routing, evt)
 }
 
 func postJSON(ctx context.Context, client *http.Client, url string, body any) error {
@@ -727,20 +712,3 @@ func getenv(k, def string) string {
 	}
 	return v
 }
-
-// isUniqueViolation: минимальная проверка на нарушение UNIQUE.
-// Для pgx это может быть *pgconn.PgError с Code "23505", но в демо достаточно строки.
-func isUniqueViolation(err error) bool {
-	if err == nil {
-		return false
-	}
-	var pgErr *pgconn.PgError
-	if errors.As(err, &pgErr) {
-		return pgErr.Code == "23505"
-	}
-	// fallback
-	if strings.Contains(strings.ToLower(err.Error()), "duplicate") || strings.Contains(strings.ToLower(err.Error()), "unique") {
-		return true
-	}
-	return false
-}
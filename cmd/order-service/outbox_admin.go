@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// Админ-API outbox order-service:
+//   GET  /admin/outbox/dead?limit=N  — записи, исчерпавшие попытки публикации;
+//   POST /admin/outbox/dead/requeue  — вернуть в outbox {"ids":[...]}, пустой список — все;
+//   POST /admin/outbox/replay        — опубликовать повторно отправленные записи {"from","to"} (RFC3339).
+
+type OutboxRequeueRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+type OutboxReplayRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func handleOutboxDead(pool *pgxpool.Pool, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodGet {
+		respondAdmin(w, m, "outbox_dead", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondAdmin(w, m, "outbox_dead", start, http.StatusBadRequest, map[string]any{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	records, err := outbox.ListDead(r.Context(), pool, limit)
+	if err != nil {
+		respondAdmin(w, m, "outbox_dead", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	respondAdmin(w, m, "outbox_dead", start, http.StatusOK, map[string]any{"items": records})
+}
+
+func handleOutboxRequeue(pool *pgxpool.Pool, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		respondAdmin(w, m, "outbox_requeue", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		return
+	}
+	var req OutboxRequeueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondAdmin(w, m, "outbox_requeue", start, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+		return
+	}
+	n, err := outbox.Requeue(r.Context(), pool, req.IDs)
+	if err != nil {
+		respondAdmin(w, m, "outbox_requeue", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	logging.Log(logging.Fields{Service: "order-service", Step: "outbox_requeue", Status: "ok", DurationMS: time.Since(start).Milliseconds(), Message: fmt.Sprintf("%d records", n)})
+	respondAdmin(w, m, "outbox_requeue", start, http.StatusOK, map[string]any{"requeued": n})
+}
+
+func handleOutboxReplay(pool *pgxpool.Pool, m *metrics.ServerMetrics, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		respondAdmin(w, m, "outbox_replay", start, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		return
+	}
+	var req OutboxReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondAdmin(w, m, "outbox_replay", start, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+		return
+	}
+	if req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+		respondAdmin(w, m, "outbox_replay", start, http.StatusBadRequest, map[string]any{"error": "from and to are required, from < to"})
+		return
+	}
+	n, err := outbox.Replay(r.Context(), pool, req.From, req.To)
+	if err != nil {
+		respondAdmin(w, m, "outbox_replay", start, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	logging.Log(logging.Fields{Service: "order-service", Step: "outbox_replay", Status: "ok", DurationMS: time.Since(start).Milliseconds(), Message: fmt.Sprintf("%d records %s..%s", n, req.From.Format(time.RFC3339), req.To.Format(time.RFC3339))})
+	respondAdmin(w, m, "outbox_replay", start, http.StatusOK, map[string]any{"replayed": n})
+}
+
+func respondAdmin(w http.ResponseWriter, m *metrics.ServerMetrics, handler string, start time.Time, code int, v any) {
+	writeJSON(w, code, v)
+	m.Requests.WithLabelValues(handler, strconv.Itoa(code)).Inc()
+	m.LatencyMS.WithLabelValues(handler).Observe(float64(time.Since(start).Milliseconds()))
+}
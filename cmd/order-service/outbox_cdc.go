@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// startCDCRelay — relay для TX_MODE=outbox-cdc: вставки в outbox читаются из слота логической
+// репликации и публикуются транзакция за транзакцией в порядке коммитов. Слот читает одна
+// реплика; у остальных подключение к слоту падает, и они повторяют попытку каждые OutboxCDCRetry.
+func startCDCRelay(ctx context.Context, pool *pgxpool.Pool, broker kafka.Broker, cfg cfg, m *metrics.OutboxMetrics) {
+	writer := kafka.NewPublishers(broker, cfg.Outbox.BatchSize, cfg.Outbox.Linger)
+	go func() {
+		defer writer.Close()
+		for {
+			if err := runCDCRelay(ctx, pool, writer, cfg, m); err != nil && ctx.Err() == nil {
+				log.Printf("outbox cdc relay error: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cfg.OutboxCDCRetry):
+			}
+		}
+	}()
+}
+
+// dropCDCSlot удаляет слот CDC-relay в любом режиме, кроме outbox-cdc: после прогона в outbox-cdc
+// он иначе удерживал бы WAL. Пока слот читает старая реплика (rolling update при смене TX_MODE),
+// попытка повторяется каждые OutboxCDCRetry.
+func dropCDCSlot(ctx context.Context, pool *pgxpool.Pool, cfg cfg) {
+	go func() {
+		for {
+			busy, err := outbox.DropSlot(ctx, pool, cfg.OutboxCDCSlot)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("outbox cdc slot drop error: %v", err)
+			}
+			if err == nil && !busy {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cfg.OutboxCDCRetry):
+			}
+		}
+	}()
+}
+
+// runCDCRelay публикует поток до первой ошибки. Позиция подтверждается только после публикации
+// и записи sent_at, поэтому после ошибки или рестарта недоподтверждённая транзакция придёт снова
+// (at-least-once, как у polling relay).
+func runCDCRelay(ctx context.Context, pool *pgxpool.Pool, writer *kafka.Publishers, cfg cfg, m *metrics.OutboxMetrics) error {
+	stream := &outbox.CDCStream{
+		ConnString:     cfg.DatabaseURL,
+		Slot:           cfg.OutboxCDCSlot,
+		Publication:    cfg.OutboxCDCPublication,
+		StatusInterval: 10 * time.Second,
+	}
+	if err := stream.Setup(ctx, pool); err != nil {
+		return err
+	}
+	from, err := outbox.LoadOffset(ctx, pool, cfg.OutboxCDCSlot)
+	if err != nil {
+		return err
+	}
+	if err := stream.Start(ctx, from); err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	log.Printf("outbox cdc relay streaming slot %s from %s", cfg.OutboxCDCSlot, from)
+
+	purged := time.Now()
+	for {
+		records, lsn, err := stream.Next(ctx)
+		if err != nil {
+			return err
+		}
+		// После ошибки транзакция приходит из слота целиком: уже отправленное
+		// и перенесённое в outbox_dead пропускаем.
+		records, err = outbox.Pending(ctx, pool, records)
+		if err != nil {
+			return err
+		}
+		m.Claimed.Add(float64(len(records)))
+		res, err := outbox.Publish(ctx, writer, records)
+		if err := outbox.MarkSent(ctx, pool, res.Sent); err != nil {
+			return err
+		}
+		m.Published.Add(float64(len(res.Sent)))
+		for _, rec := range res.Sent {
+			m.LagMS.Observe(float64(time.Since(rec.CreatedAt).Milliseconds()))
+		}
+		if err != nil {
+			m.Failed.Add(float64(len(res.Failed)))
+			dead, ferr := outbox.Fail(ctx, pool, "", res.Failed, err.Error(), cfg.Outbox.MaxAttempts, cfg.Outbox.RetryBackoff)
+			if ferr != nil {
+				log.Printf("outbox fail error: %v", ferr)
+			}
+			m.Dead.Add(float64(dead))
+			return err
+		}
+		if err := outbox.CommitOffset(ctx, pool, cfg.OutboxCDCSlot, lsn, records); err != nil {
+			return err
+		}
+		if err := stream.Ack(lsn); err != nil {
+			return err
+		}
+		if cfg.Outbox.Retention > 0 && time.Since(purged) >= time.Minute {
+			purged = time.Now()
+			n, err := outbox.Purge(ctx, pool, cfg.Outbox.Retention, 1000)
+			if err != nil {
+				log.Printf("outbox purge error: %v", err)
+			}
+			m.Purged.Add(float64(n))
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+)
+
+// Статусы saga_instances.
+const (
+	sagaRunning      = "RUNNING"
+	sagaCompensating = "COMPENSATING"
+	sagaCompleted    = "COMPLETED"
+	sagaCompensated  = "COMPENSATED"
+)
+
+// Статусы saga_steps.
+const (
+	stepPending      = "PENDING"
+	stepRunning      = "RUNNING"
+	stepDone         = "DONE"
+	stepFailed       = "FAILED"
+	stepCompensating = "COMPENSATING"
+	stepCompensated  = "COMPENSATED"
+)
+
+// errSagaPending — сага не доведена до финала (не записался журнал или не прошла компенсация);
+// её продолжит восстановление.
+var errSagaPending = errors.New("saga pending recovery")
+
+type sagaInstance struct {
+	ID      string
+	OrderID string
+	Status  string
+	Reason  string
+	Request CheckoutRequest
+	Steps   []sagaStep
+}
+
+type sagaStep struct {
+	Index  int
+	Name   string
+	Step   string // step в теле /tcc/* ("saga_orch_reserve_inventory")
+	Status string
+}
+
+func runSagaOrch(ctx context.Context, client *http.Client, pool *pgxpool.Pool, cfg cfg, txid, orderID string, req CheckoutRequest) error {
+	saga, err := createSaga(ctx, pool, txid, orderID, req, buildTCCSteps(cfg))
+	if err != nil {
+		return err
+	}
+	return executeSaga(ctx, client, pool, cfg, saga)
+}
+
+// executeSaga продолжает сагу с состояния из журнала: RUNNING — вперёд с первого
+// незавершённого шага, COMPENSATING — компенсация. Статус шага пишется до и после
+// каждого вызова участника, поэтому после падения известно, какие шаги могли выполниться.
+func executeSaga(ctx context.Context, client *http.Client, pool *pgxpool.Pool, cfg cfg, saga *sagaInstance) error {
+	if saga.Status == sagaRunning {
+		urls := sagaStepURLs(cfg)
+		for i := range saga.Steps {
+			step := &saga.Steps[i]
+			if step.Status == stepDone {
+				continue
+			}
+			url, ok := urls[step.Name]
+			var callErr error
+			if !ok {
+				callErr = fmt.Errorf("participant %s is not configured", step.Name)
+			} else {
+				if err := setSagaStep(ctx, pool, saga.ID, step, stepRunning, ""); err != nil {
+					return fmt.Errorf("%w: %v", errSagaPending, err)
+				}
+				// Повтор try после падения безопасен: участник отвечает на дубль текущим статусом.
+				callErr = postJSON(ctx, client, url+"/tcc/try", sagaActionBody(saga, step))
+			}
+			if callErr != nil {
+				reason := fmt.Sprintf("saga action failed for %s: %v", step.Name, callErr)
+				if err := setSagaStep(ctx, pool, saga.ID, step, stepFailed, callErr.Error()); err != nil {
+					return fmt.Errorf("%w: %v", errSagaPending, err)
+				}
+				if err := setSagaStatus(ctx, pool, saga, sagaCompensating, reason); err != nil {
+					return fmt.Errorf("%w: %v", errSagaPending, err)
+				}
+				break
+			}
+			if err := setSagaStep(ctx, pool, saga.ID, step, stepDone, ""); err != nil {
+				return fmt.Errorf("%w: %v", errSagaPending, err)
+			}
+		}
+		if saga.Status == sagaRunning {
+			return completeSaga(ctx, pool, cfg, saga)
+		}
+	}
+	if err := compensateSaga(ctx, client, pool, cfg, saga); err != nil {
+		return err
+	}
+	return errors.New(saga.Reason)
+}
+
+// compensateSaga отменяет в обратном порядке все шаги, запрос по которым мог дойти до участника
+// (RUNNING/DONE/FAILED). Cancel без выполненного действия участник записывает как пустой откат.
+func compensateSaga(ctx context.Context, client *http.Client, pool *pgxpool.Pool, cfg cfg, saga *sagaInstance) error {
+	urls := sagaStepURLs(cfg)
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := &saga.Steps[i]
+		if step.Status == stepPending || step.Status == stepCompensated {
+			continue
+		}
+		url, ok := urls[step.Name]
+		if !ok {
+			return fmt.Errorf("%w: participant %s is not configured", errSagaPending, step.Name)
+		}
+		if err := setSagaStep(ctx, pool, saga.ID, step, stepCompensating, ""); err != nil {
+			return fmt.Errorf("%w: %v", errSagaPending, err)
+		}
+		body := map[string]any{"txid": saga.ID, "order_id": saga.OrderID, "step": step.Step}
+		if err := postJSON(ctx, client, url+"/tcc/cancel", body); err != nil {
+			_ = setSagaStep(ctx, pool, saga.ID, step, stepCompensating, err.Error())
+			return fmt.Errorf("%w: compensation failed for %s: %v", errSagaPending, step.Name, err)
+		}
+		if err := setSagaStep(ctx, pool, saga.ID, step, stepCompensated, ""); err != nil {
+			return fmt.Errorf("%w: %v", errSagaPending, err)
+		}
+	}
+	if err := finishSaga(ctx, pool, cfg, saga, sagaCompensated, "REJECTED", ""); err != nil {
+		return fmt.Errorf("%w: %v", errSagaPending, err)
+	}
+	return nil
+}
+
+func completeSaga(ctx context.Context, pool *pgxpool.Pool, cfg cfg, saga *sagaInstance) error {
+	if err := finishSaga(ctx, pool, cfg, saga, sagaCompleted, "CONFIRMED", contracts.EventOrderConfirmed); err != nil {
+		return fmt.Errorf("%w: %v", errSagaPending, err)
+	}
+	return nil
+}
+
+func sagaActionBody(saga *sagaInstance, step *sagaStep) map[string]any {
+	req := saga.Request
+	return map[string]any{"txid": saga.ID, "order_id": saga.OrderID, "step": step.Step, "items": req.Items, "total": req.Total, "amount": req.Total}
+}
+
+// sagaStepURLs — адреса участников берутся из текущей конфигурации, а не из журнала.
+func sagaStepURLs(cfg cfg) map[string]string {
+	urls := make(map[string]string)
+	for _, step := range buildTCCSteps(cfg) {
+		urls[step.Name] = step.URL
+	}
+	return urls
+}
+
+func createSaga(ctx context.Context, pool *pgxpool.Pool, txid, orderID string, req CheckoutRequest, steps []tccStep) (*sagaInstance, error) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `INSERT INTO saga_instances(saga_id, order_id, status, request) VALUES ($1, $2, $3, $4)`,
+		txid, orderID, sagaRunning, request); err != nil {
+		return nil, err
+	}
+	saga := &sagaInstance{ID: txid, OrderID: orderID, Status: sagaRunning, Request: req}
+	for i, step := range steps {
+		s := sagaStep{Index: i, Name: step.Name, Step: "saga_orch_" + step.Step, Status: stepPending}
+		if _, err := tx.Exec(ctx, `INSERT INTO saga_steps(saga_id, step_index, name, step, status) VALUES ($1, $2, $3, $4, $5)`,
+			txid, s.Index, s.Name, s.Step, s.Status); err != nil {
+			return nil, err
+		}
+		saga.Steps = append(saga.Steps, s)
+	}
+	return saga, tx.Commit(ctx)
+}
+
+// setSagaStep меняет статус шага и продлевает updated_at саги, чтобы живую сагу
+// не забрало восстановление. Пустой lastErr сохраняет прежнюю ошибку.
+func setSagaStep(ctx context.Context, pool *pgxpool.Pool, sagaID string, step *sagaStep, status, lastErr string) error {
+	_, err := pool.Exec(ctx, `WITH s AS (
+			UPDATE saga_steps SET status=$3, last_error=COALESCE(NULLIF($4, ''), last_error), updated_at=now()
+			WHERE saga_id=$1 AND step_index=$2
+		)
+		UPDATE saga_instances SET updated_at=now() WHERE saga_id=$1`, sagaID, step.Index, status, lastErr)
+	if err != nil {
+		return err
+	}
+	step.Status = status
+	return nil
+}
+
+func setSagaStatus(ctx context.Context, pool *pgxpool.Pool, saga *sagaInstance, status, reason string) error {
+	_, err := pool.Exec(ctx, `UPDATE saga_instances SET status=$2, reason=$3, updated_at=now() WHERE saga_id=$1`, saga.ID, status, reason)
+	if err != nil {
+		return err
+	}
+	saga.Status = status
+	saga.Reason = reason
+	return nil
+}
+
+// finishSaga записывает финальный статус саги, статус заказа и событие eventType (если задано)
+// одной транзакцией. Сагу, уже завершённую другим обработчиком, не трогает.
+func finishSaga(ctx context.Context, pool *pgxpool.Pool, cfg cfg, saga *sagaInstance, status, orderStatus, eventType string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, `UPDATE saga_instances SET status=$2, updated_at=now()
+		WHERE saga_id=$1 AND status IN ('RUNNING','COMPENSATING')`, saga.ID, status)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, `UPDATE orders SET status=$2, updated_at=now() WHERE id=$1`, saga.OrderID, orderStatus); err != nil {
+		return err
+	}
+	if eventType != "" {
+		if err := enqueueOrderEvent(ctx, tx, cfg, saga.ID, saga.OrderID, eventType, saga.Request); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	saga.Status = status
+	return nil
+}
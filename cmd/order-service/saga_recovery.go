@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+)
+
+// startSagaRecovery продолжает саги, брошенные оркестратором (падение order-service
+// между шагами или во время компенсации). Первый проход выполняется сразу при старте.
+func startSagaRecovery(ctx context.Context, pool *pgxpool.Pool, client *http.Client, cfg cfg) {
+	go func() {
+		ticker := time.NewTicker(cfg.SagaRecoveryInterval)
+		defer ticker.Stop()
+		for {
+			if err := recoverSagas(ctx, pool, client, cfg); err != nil {
+				log.Printf("saga recovery error: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func recoverSagas(ctx context.Context, pool *pgxpool.Pool, client *http.Client, cfg cfg) error {
+	claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	sagas, err := claimSagas(claimCtx, pool, cfg.SagaRecoveryGrace, cfg.SagaRecoveryBatchSize)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, saga := range sagas {
+		resumeSaga(ctx, pool, client, cfg, saga)
+	}
+	return nil
+}
+
+// resumeSaga доводит сагу до COMPLETED или COMPENSATED. Шаг в RUNNING мог дойти до участника,
+// поэтому вперёд он повторяется (try идемпотентен), а при компенсации отменяется.
+func resumeSaga(ctx context.Context, pool *pgxpool.Pool, client *http.Client, cfg cfg, saga *sagaInstance) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout*time.Duration(2*len(saga.Steps)+1))
+	defer cancel()
+
+	from := saga.Status
+	err := executeSaga(ctx, client, pool, cfg, saga)
+	status := "completed"
+	switch {
+	case errors.Is(err, errSagaPending):
+		// Повторим на следующем проходе, когда истечёт grace.
+		status = "pending"
+	case err != nil:
+		status = "compensated"
+	}
+	message := "from " + from
+	if err != nil {
+		message = err.Error()
+	}
+	logging.Log(logging.Fields{
+		Service:    "order-service",
+		TxID:       saga.ID,
+		OrderID:    saga.OrderID,
+		Step:       "saga_recovery",
+		Status:     status,
+		DurationMS: time.Since(start).Milliseconds(),
+		Message:    message,
+	})
+}
+
+// claimSagas забирает незавершённые саги, не менявшиеся дольше grace, и сдвигает их updated_at,
+// чтобы другие реплики не взяли те же саги до следующего истечения grace.
+func claimSagas(ctx context.Context, pool *pgxpool.Pool, grace time.Duration, limit int) ([]*sagaInstance, error) {
+	rows, err := pool.Query(ctx, `UPDATE saga_instances SET updated_at=now()
+		WHERE saga_id IN (
+			SELECT saga_id FROM saga_instances
+			WHERE status IN ('RUNNING','COMPENSATING') AND updated_at < now() - make_interval(secs => $1)
+			ORDER BY updated_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING saga_id, order_id, status, COALESCE(reason, ''), request`, grace.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sagas []*sagaInstance
+	for rows.Next() {
+		var saga sagaInstance
+		var request []byte
+		if err := rows.Scan(&saga.ID, &saga.OrderID, &saga.Status, &saga.Reason, &request); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(request, &saga.Request); err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, &saga)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, saga := range sagas {
+		if err := loadSagaSteps(ctx, pool, saga); err != nil {
+			return nil, err
+		}
+	}
+	return sagas, nil
+}
+
+func loadSagaSteps(ctx context.Context, pool *pgxpool.Pool, saga *sagaInstance) error {
+	rows, err := pool.Query(ctx, `SELECT step_index, name, step, status FROM saga_steps WHERE saga_id=$1 ORDER BY step_index`, saga.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var step sagaStep
+		if err := rows.Scan(&step.Index, &step.Name, &step.Step, &step.Status); err != nil {
+			return err
+		}
+		saga.Steps = append(saga.Steps, step)
+	}
+	return rows.Err()
+}
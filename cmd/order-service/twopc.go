@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/coordinator"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/store/postgres"
+)
+
+// newTwoPCEngine собирает координатор 2PC: журнал в twopc_tx_log, финальный статус
+// которого атомарно переносится в orders.
+func newTwoPCEngine(pool *pgxpool.Pool, cfg cfg) *coordinator.Engine {
+	txLog := postgres.NewCoordinatorLog(pool)
+	txLog.OnFinal = func(ctx context.Context, tx pgx.Tx, orderID string, status common.TxStatus) error {
+		orderStatus := "REJECTED"
+		if status == common.TxCommitted {
+			orderStatus = "CONFIRMED"
+		}
+		_, err := tx.Exec(ctx, `UPDATE orders SET status=$2, updated_at=now() WHERE id=$1`, orderID, orderStatus)
+		return err
+	}
+	return &coordinator.Engine{Log: txLog, Fanout: cfg.TwoPCFanout, PhaseTimeout: cfg.TwoPCPhaseTimeout}
+}
+
+// observeParticipantLatencies пишет время участников в метрики и возвращает его для ответа /checkout.
+func observeParticipantLatencies(m *metrics.TwoPCMetrics, fanout coordinator.Fanout, latencies []coordinator.ParticipantLatency) map[string]float64 {
+	if len(latencies) == 0 {
+		return nil
+	}
+	out := make(map[string]float64, len(latencies))
+	for _, l := range latencies {
+		ms := float64(l.Duration.Microseconds()) / 1000
+		m.ParticipantLatencyMS.WithLabelValues(l.Participant, l.Phase, string(fanout), l.Outcome).Observe(ms)
+		out[l.Participant+"."+l.Phase] = ms
+	}
+	return out
+}
+
+func participantRefs(cfg cfg) []coordinator.ParticipantRef {
+	var refs []coordinator.ParticipantRef
+	if cfg.InventoryBaseURL != "" {
+		refs = append(refs, coordinator.ParticipantRef{Name: "inventory", URL: cfg.InventoryBaseURL})
+	}
+	if cfg.PaymentBaseURL != "" {
+		refs = append(refs, coordinator.ParticipantRef{Name: "payment", URL: cfg.PaymentBaseURL})
+	}
+	if cfg.ShippingBaseURL != "" {
+		refs = append(refs, coordinator.ParticipantRef{Name: "shipping", URL: cfg.ShippingBaseURL})
+	}
+	return refs
+}
+
+// buildParticipants превращает ссылки (из конфига или из журнала при восстановлении)
+// в участников движка. req == nil — восстановление: PREPARE уже не отправляется.
+func buildParticipants(cfg cfg, client *http.Client, refs []coordinator.ParticipantRef, req *CheckoutRequest) []coordinator.Participant {
+	parts := make([]coordinator.Participant, 0, len(refs))
+	for _, ref := range refs {
+		var participantClient common.TwoPCParticipantClient = coordinator.NewHTTPParticipant(ref.URL, client)
+		if cfg.Mock2PCParticipants {
+			participantClient = mockParticipant{}
+		}
+		p := coordinator.Participant{Ref: ref, Client: participantClient, PayloadBuilder: func() any { return nil }}
+		switch ref.Name {
+		case "inventory":
+			p.Step = common.StepReserveInventory
+			if req != nil {
+				p.PayloadBuilder = func() any { return protocol.InventoryReservePayload{Items: lineItems(req.Items)} }
+			}
+		case "payment":
+			p.Step = common.StepAuthorizePayment
+			if req != nil {
+				p.PayloadBuilder = func() any { return protocol.PaymentAuthorizePayload{Amount: req.Total} }
+			}
+		case "shipping":
+			p.Step = common.StepCreateShipment
+			if req != nil {
+				p.PayloadBuilder = func() any { return protocol.ShippingCreatePayload{} }
+			}
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+func lineItems(items []Item) []protocol.LineItem {
+	out := make([]protocol.LineItem, 0, len(items))
+	for _, it := range items {
+		out = append(out, protocol.LineItem{ProductID: it.ProductID, Quantity: int32(it.Quantity)})
+	}
+	return out
+}
+
+// mockParticipant — участник для MOCK_2PC: всегда голосует "да" без сетевых вызовов.
+type mockParticipant struct{}
+
+func (mockParticipant) Prepare(context.Context, protocol.PrepareRequest) (protocol.PrepareResponse, error) {
+	return protocol.PrepareResponse{VoteYes: true}, nil
+}
+
+func (mockParticipant) Commit(context.Context, protocol.CommitRequest) error { return nil }
+
+func (mockParticipant) Abort(context.Context, protocol.AbortRequest) error { return nil }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/coordinator"
+)
+
+// startTwoPCRecovery доводит до финала транзакции, брошенные координатором
+// (например, при падении order-service между PREPARING и COMMITTED/ABORTED).
+// Первый проход выполняется сразу при старте, далее — по таймеру.
+func startTwoPCRecovery(ctx context.Context, engine *coordinator.Engine, client *http.Client, cfg cfg) {
+	go func() {
+		ticker := time.NewTicker(cfg.RecoveryInterval)
+		defer ticker.Stop()
+		for {
+			if err := recoverTwoPC(ctx, engine, client, cfg); err != nil {
+				log.Printf("2PC recovery error: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func recoverTwoPC(ctx context.Context, engine *coordinator.Engine, client *http.Client, cfg cfg) error {
+	claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	entries, err := engine.Log.ClaimInDoubt(claimCtx, cfg.RecoveryGrace, cfg.RecoveryBatchSize)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		resolveInDoubtTx(ctx, engine, client, cfg, entry)
+	}
+	return nil
+}
+
+// resolveInDoubtTx применяет правило presumed abort: решение COMMIT уже зафиксировано
+// только для COMMITTING, всё остальное безопасно откатывать.
+func resolveInDoubtTx(ctx context.Context, engine *coordinator.Engine, client *http.Client, cfg cfg, entry coordinator.TxLogEntry) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout*time.Duration(len(entry.Participants)+1))
+	defer cancel()
+
+	parts := buildParticipants(cfg, client, entry.Participants, nil)
+	res, err := engine.Resolve(ctx, entry, parts)
+	status := "committed"
+	switch {
+	case errors.Is(err, common.ErrCommitPending):
+		// Решение уже принято — откатывать нельзя, повторим на следующем проходе.
+		status = "commit_retry"
+	case err != nil:
+		status = "error"
+	case res.Status == common.TxAborted:
+		status = "aborted"
+	}
+	message := "from " + string(entry.Status)
+	if err != nil {
+		message = err.Error()
+	}
+	logging.Log(logging.Fields{
+		Service:    "order-service",
+		TxID:       string(entry.TxID),
+		OrderID:    entry.OrderID,
+		Step:       "twopc_recovery",
+		Status:     status,
+		DurationMS: time.Since(start).Milliseconds(),
+		Message:    message,
+	})
+}
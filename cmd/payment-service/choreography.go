@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+)
+
+// Шаг payment в саге-хореографии (TX_MODE=saga-chor):
+//   inventory.soft_reserved -> списание суммы заказа (COMMITTED) -> payment.created | payment.failed
+//   shipping.failed         -> возврат (ABORTED)                 -> payment.refunded
+// Отметка в inbox, платёжная операция и исходящее событие в outbox пишутся одной транзакцией.
+
+// consumedEvents — события, которые обрабатывает сервис: он подписан только на их топики.
+var consumedEvents = []string{contracts.EventInventorySoft, contracts.EventShipmentFailed}
+
+func consumeEvents(ctx context.Context, pool *pgxpool.Pool, broker kafka.Broker, cfg cfg, m *metrics.ConsumerMetrics) {
+	kafka.Consume(ctx, broker, cfg.Routing.TopicsFor(consumedEvents...), cfg.KafkaGroupID, cfg.Consumer, func(ctx context.Context, msg kafka.Message) error {
+		meta, err := contracts.Peek(msg.HeaderMap(), msg.Value)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		start := time.Now()
+		status, err := handleEvent(ctx, pool, cfg, meta, msg.Value)
+		if err != nil || status == "" {
+			return err
+		}
+		logging.Log(logging.Fields{Service: "payment-service", TxID: meta.TxID, OrderID: meta.OrderID, EventID: meta.EventID, Step: meta.Type, Status: status, DurationMS: time.Since(start).Milliseconds()})
+		return nil
+	}, m)
+}
+
+// handleEvent выполняет шаг для события meta и возвращает тип опубликованного события
+// ("duplicate" для повторной доставки, пусто — событие не для payment). Тип и event_id берутся
+// из заголовков, поэтому чужие события и дубли отсекаются без разбора тела.
+func handleEvent(ctx context.Context, pool *pgxpool.Pool, cfg cfg, meta contracts.Meta, body []byte) (string, error) {
+	switch meta.Type {
+	case contracts.EventInventorySoft, contracts.EventShipmentFailed:
+	default:
+		return "", nil
+	}
+
+	next, reason := "", ""
+	fresh, err := outbox.Receive(ctx, pool, meta.EventID, func(ctx context.Context, tx pgx.Tx) error {
+		evt, err := meta.Decode(body)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		if evt.Type == contracts.EventInventorySoft {
+			var payload contracts.OrderPayload
+			if err := evt.DecodePayload(&payload); err != nil {
+				return err
+			}
+			err := chargePayment(ctx, tx, evt, payload.Total)
+			var vote *common.VoteNoError
+			switch {
+			case errors.As(err, &vote):
+				next, reason = contracts.EventPaymentFailed, vote.Reason
+			case err != nil:
+				return err
+			default:
+				next = contracts.EventPaymentCreated
+			}
+		} else {
+			if _, err := tx.Exec(ctx, `UPDATE payment_operations SET status='ABORTED', updated_at=now() WHERE txid=$1 AND status<>'ABORTED'`, evt.TxID); err != nil {
+				return err
+			}
+			next = contracts.EventPaymentRefunded
+		}
+		return enqueueEvent(ctx, tx, cfg, evt, next, reason)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "duplicate", nil
+	}
+	return next, nil
+}
+
+// chargePayment списывает сумму заказа. Операция, уже отменённая по этому txid, повторно не создаётся.
+func chargePayment(ctx context.Context, tx pgx.Tx, evt contracts.Event, amount int64) error {
+	if amount < 0 {
+		return common.VoteNo("negative amount")
+	}
+	tag, err := tx.Exec(ctx, `INSERT INTO payment_operations(order_id, txid, amount, status)
+		VALUES ($1, $2, $3, 'COMMITTED')
+		ON CONFLICT (txid) DO NOTHING`, evt.OrderID, evt.TxID, amount)
+	if err != nil || tag.RowsAffected() == 1 {
+		return err
+	}
+	var status string
+	if err := tx.QueryRow(ctx, `SELECT status FROM payment_operations WHERE txid=$1`, evt.TxID).Scan(&status); err != nil {
+		return err
+	}
+	if status == "ABORTED" {
+		return common.VoteNo("payment already refunded")
+	}
+	return nil
+}
+
+// enqueueEvent кладёт в outbox событие eventType, вызванное cause. Payload заказа
+// (позиции, сумма) передаётся дальше по цепочке без изменений.
+func enqueueEvent(ctx context.Context, tx pgx.Tx, cfg cfg, cause contracts.Event, eventType, reason string) error {
+	var payload contracts.OrderPayload
+	if err := cause.DecodePayload(&payload); err != nil {
+		return err
+	}
+	if reason != "" {
+		payload.Reason = reason
+	}
+	evt, err := contracts.Caused(cause, eventType, "payment-service", &payload)
+	if err != nil {
+		return err
+	}
+	return outbox.InsertEvent(ctx, tx, cfg.Routing, evt)
+}
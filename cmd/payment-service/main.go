@@ -4,27 +4,51 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/idempotency"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
 	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/tcc"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/participant"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/store/postgres"
 )
 
 type cfg struct {
-	Port        string
-	DatabaseURL string
+	Port               string
+	DatabaseURL        string
+	CoordinatorBaseURL string
+	PreparedTTL        time.Duration
+	ResolveInterval    time.Duration
+	Broker             kafka.Config
+	Routing            contracts.Routing
+	KafkaGroupID       string
+	Outbox             outbox.RelayConfig
+	Consumer           kafka.ConsumerConfig
+	Idempotency        idempotency.Config
 }
 
+// PrepareRequest — protocol.PrepareRequest с типизированным payload участника.
+// Для /2pc/commit и /2pc/abort используются только txid и order_id.
 type PrepareRequest struct {
-	TxID    string `json:"txid"`
-	OrderID string `json:"order_id"`
-	Total   int64  `json:"total"`
+	TxID    string                           `json:"txid"`
+	OrderID string                           `json:"order_id"`
+	Step    string                           `json:"step"`
+	Payload protocol.PaymentAuthorizePayload `json:"payload"`
 }
 
 type TCCRequest struct {
@@ -39,6 +63,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	outbox.Notify = cfg.Outbox.Notify
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -48,7 +73,40 @@ func main() {
 	}
 	defer pool.Close()
 
+	if cfg.CoordinatorBaseURL != "" {
+		resolver := &participant.Resolver{
+			Service:   "payment-service",
+			Store:     postgres.NewParticipantStore(pool),
+			Decisions: participant.NewHTTPDecisionClient(cfg.CoordinatorBaseURL, &http.Client{Timeout: 5 * time.Second}),
+			Apply: func(ctx context.Context, tx participant.PreparedTx, status string) error {
+				return update2PCStatus(ctx, pool, cfg, tx.TxID, status)
+			},
+			Interval:  cfg.ResolveInterval,
+			Lease:     cfg.PreparedTTL,
+			BatchSize: 50,
+		}
+		resolver.Start(context.Background())
+	} else {
+		log.Printf("COORDINATOR_BASE_URL is empty: expired 2PC prepares will not be resolved")
+	}
+
 	srvMetrics := metrics.NewServerMetrics("payment_service")
+	tccParticipant := tcc.NewParticipant(pool)
+	if cfg.Broker.Enabled() {
+		broker, err := kafka.Open(cfg.Broker)
+		if err != nil {
+			log.Fatalf("broker error: %v", err)
+		}
+		if err := kafka.EnsureTopics(ctx, broker, cfg.Routing.Topics()); err != nil {
+			log.Printf("ensure topics error: %v", err)
+		}
+		// Relay публикует и события хореографии, и изменения состояния участника (2PC/TCC/саги).
+		outbox.NewRelay(pool, broker, cfg.Outbox, metrics.NewOutboxMetrics("payment_service")).Start(context.Background())
+		go consumeEvents(context.Background(), pool, broker, cfg, metrics.NewConsumerMetrics("payment_service"))
+	}
+
+	idem := idempotency.New(pool, cfg.Idempotency, metrics.NewIdempotencyMetrics("payment_service"))
+	idem.Start(context.Background())
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -66,26 +124,26 @@ func main() {
 	mux.Handle("/metrics", metrics.Handler())
 
 	mux.HandleFunc("/2pc/prepare", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "prepare", w, r)
+		handle2PC(pool, cfg, srvMetrics, "prepare", w, r)
 	})
 	mux.HandleFunc("/2pc/commit", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "commit", w, r)
+		handle2PC(pool, cfg, srvMetrics, "commit", w, r)
 	})
 	mux.HandleFunc("/2pc/abort", func(w http.ResponseWriter, r *http.Request) {
-		handle2PC(pool, srvMetrics, "abort", w, r)
+		handle2PC(pool, cfg, srvMetrics, "abort", w, r)
 	})
 
 	mux.HandleFunc("/tcc/try", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "try", w, r)
+		handleTCC(cfg, tccParticipant, srvMetrics, "try", w, r)
 	})
 	mux.HandleFunc("/tcc/confirm", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "confirm", w, r)
+		handleTCC(cfg, tccParticipant, srvMetrics, "confirm", w, r)
 	})
 	mux.HandleFunc("/tcc/cancel", func(w http.ResponseWriter, r *http.Request) {
-		handleTCC(pool, srvMetrics, "cancel", w, r)
+		handleTCC(cfg, tccParticipant, srvMetrics, "cancel", w, r)
 	})
 
-	srv := &http.Server{Addr: ":" + cfg.Port, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: idem.Wrap(mux), ReadHeaderTimeout: 5 * time.Second}
 	log.Printf("payment-service listening on :%s", cfg.Port)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -96,10 +154,71 @@ func readCfg() (cfg, error) {
 	if db == "" {
 		return cfg{}, errors.New("DATABASE_URL is required")
 	}
-	return cfg{Port: port, DatabaseURL: db}, nil
+	ttlMS, _ := strconv.Atoi(getenv("TWOPC_PREPARED_TTL_MS", "30000"))
+	resolveMS, _ := strconv.Atoi(getenv("TWOPC_RESOLVE_MS", "5000"))
+	outboxPollMS, _ := strconv.Atoi(getenv("OUTBOX_POLL_MS", "500"))
+	outboxBatch, _ := strconv.Atoi(getenv("OUTBOX_BATCH", "100"))
+	outboxLeaseMS, _ := strconv.Atoi(getenv("OUTBOX_LEASE_MS", "30000"))
+	outboxLingerMS, _ := strconv.Atoi(getenv("OUTBOX_LINGER_MS", "5"))
+	outboxMaxAttempts, _ := strconv.Atoi(getenv("OUTBOX_MAX_ATTEMPTS", "10"))
+	outboxBackoffMS, _ := strconv.Atoi(getenv("OUTBOX_RETRY_BACKOFF_MS", "1000"))
+	outboxRetentionMS, _ := strconv.Atoi(getenv("OUTBOX_RETENTION_MS", "86400000"))
+	routes, err := contracts.ParseRoutes(os.Getenv("EVENT_ROUTES"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("EVENT_ROUTES: %w", err)
+	}
+	topicPartitions, err := contracts.ParsePartitions(os.Getenv("KAFKA_TOPIC_PARTITIONS"))
+	if err != nil {
+		return cfg{}, fmt.Errorf("KAFKA_TOPIC_PARTITIONS: %w", err)
+	}
+	partitions, _ := strconv.Atoi(getenv("KAFKA_PARTITIONS", "3"))
+	consumerAttempts, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_ATTEMPTS", "5"))
+	consumerBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_BACKOFF_MS", "200"))
+	consumerMaxBackoffMS, _ := strconv.Atoi(getenv("KAFKA_CONSUMER_MAX_BACKOFF_MS", "5000"))
+	idemTTLMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_TTL_MS", "86400000"))
+	idemLeaseMS, _ := strconv.Atoi(getenv("IDEMPOTENCY_LEASE_MS", "60000"))
+	notify := strings.ToLower(getenv("OUTBOX_NOTIFY", "false"))
+	return cfg{
+		Port:               port,
+		DatabaseURL:        db,
+		CoordinatorBaseURL: strings.TrimRight(getenv("COORDINATOR_BASE_URL", ""), "/"),
+		PreparedTTL:        time.Duration(ttlMS) * time.Millisecond,
+		ResolveInterval:    time.Duration(resolveMS) * time.Millisecond,
+		KafkaGroupID:       getenv("KAFKA_GROUP_ID", "payment-service"),
+		Broker: kafka.Config{
+			Kind:      getenv("BROKER", "kafka"),
+			Brokers:   getenv("KAFKA_BROKERS", ""),
+			RedisAddr: getenv("REDIS_ADDR", ""),
+		},
+		Routing: contracts.Routing{
+			Topic:           getenv("KAFKA_TOPIC", "txlab.events"),
+			Routes:          routes,
+			Partitions:      partitions,
+			TopicPartitions: topicPartitions,
+		},
+		Outbox: outbox.RelayConfig{
+			PollInterval: time.Duration(outboxPollMS) * time.Millisecond,
+			BatchSize:    outboxBatch,
+			Lease:        time.Duration(outboxLeaseMS) * time.Millisecond,
+			Linger:       time.Duration(outboxLingerMS) * time.Millisecond,
+			MaxAttempts:  outboxMaxAttempts,
+			RetryBackoff: time.Duration(outboxBackoffMS) * time.Millisecond,
+			Retention:    time.Duration(outboxRetentionMS) * time.Millisecond,
+			Notify:       notify == "1" || notify == "true" || notify == "yes",
+		},
+		Consumer: kafka.ConsumerConfig{
+			MaxAttempts: consumerAttempts,
+			Backoff:     time.Duration(consumerBackoffMS) * time.Millisecond,
+			MaxBackoff:  time.Duration(consumerMaxBackoffMS) * time.Millisecond,
+		},
+		Idempotency: idempotency.Config{
+			TTL:   time.Duration(idemTTLMS) * time.Millisecond,
+			Lease: time.Duration(idemLeaseMS) * time.Millisecond,
+		},
+	}, nil
 }
 
-func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
+func handle2PC(pool *pgxpool.Pool, cfg cfg, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
@@ -118,19 +237,37 @@ func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 
 	switch action {
 	case "prepare":
-		if err := preparePayment(r.Context(), pool, req); err != nil {
-			writeJSON(w, http.StatusConflict, map[string]any{"error": err.Error()})
-			metrics.Requests.WithLabelValues("2pc_"+action, "409").Inc()
+		if err := preparePayment(r.Context(), pool, req, cfg.PreparedTTL); err != nil {
+			var vote *common.VoteNoError
+			if errors.As(err, &vote) {
+				logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_prepare", Status: "vote_no", Message: vote.Reason})
+				writeJSON(w, http.StatusConflict, protocol.PrepareResponse{VoteYes: false, Reason: vote.Reason})
+				metrics.Requests.WithLabelValues("2pc_"+action, "409").Inc()
+				metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("2pc_"+action, "500").Inc()
 			metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 			return
 		}
 		logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_prepare", Status: "prepared"})
-	case "commit":
-		_ = update2PCStatus(r.Context(), pool, req.TxID, "COMMITTED")
-		logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_commit", Status: "committed"})
-	case "abort":
-		_ = update2PCStatus(r.Context(), pool, req.TxID, "ABORTED")
-		logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_abort", Status: "aborted"})
+		writeJSON(w, http.StatusOK, protocol.PrepareResponse{VoteYes: true})
+		metrics.Requests.WithLabelValues("2pc_"+action, "200").Inc()
+		metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+		return
+	case "commit", "abort":
+		status := "COMMITTED"
+		if action == "abort" {
+			status = "ABORTED"
+		}
+		if err := update2PCStatus(r.Context(), pool, cfg, req.TxID, status); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("2pc_"+action, "500").Inc()
+			metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+			return
+		}
+		logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "2pc_" + action, Status: strings.ToLower(status)})
 	}
 
 	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
@@ -138,23 +275,26 @@ func handle2PC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 	metrics.LatencyMS.WithLabelValues("2pc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 }
 
-func preparePayment(ctx context.Context, pool *pgxpool.Pool, req PrepareRequest) error {
+func preparePayment(ctx context.Context, pool *pgxpool.Pool, req PrepareRequest, ttl time.Duration) error {
 	tx, err := pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
-	_, err = tx.Exec(ctx, `INSERT INTO twopc_prepared_tx(txid, order_id, step, status, payload)
-		VALUES ($1, $2, 'authorize_payment', 'PREPARED', $3)
-		ON CONFLICT (txid) DO NOTHING`, req.TxID, req.OrderID, jsonPayload(req))
+	tag, err := tx.Exec(ctx, `INSERT INTO twopc_prepared_tx(txid, order_id, step, status, payload, expires_at)
+		VALUES ($1, $2, 'authorize_payment', 'PREPARED', $3, now() + make_interval(secs => $4))
+		ON CONFLICT (txid) DO NOTHING`, req.TxID, req.OrderID, jsonPayload(req), ttl.Seconds())
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return revote(ctx, tx, req.TxID)
+	}
 
 	_, err = tx.Exec(ctx, `INSERT INTO payment_operations(order_id, txid, amount, status)
 		VALUES ($1, $2, $3, 'PREPARED')
-		ON CONFLICT (txid) DO NOTHING`, req.OrderID, req.TxID, req.Total)
+		ON CONFLICT (txid) DO NOTHING`, req.OrderID, req.TxID, req.Payload.Amount)
 	if err != nil {
 		return err
 	}
@@ -162,13 +302,52 @@ func preparePayment(ctx context.Context, pool *pgxpool.Pool, req PrepareRequest)
 	return tx.Commit(ctx)
 }
 
-func update2PCStatus(ctx context.Context, pool *pgxpool.Pool, txid, status string) error {
-	_, _ = pool.Exec(ctx, `UPDATE twopc_prepared_tx SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
-	_, _ = pool.Exec(ctx, `UPDATE payment_operations SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
+// revote повторяет голос для уже известного txid: повторный PREPARE (ретрай координатора)
+// получает прежнее "да", а PREPARE после ABORT — "нет".
+func revote(ctx context.Context, tx pgx.Tx, txid string) error {
+	var status string
+	if err := tx.QueryRow(ctx, `SELECT status FROM twopc_prepared_tx WHERE txid=$1`, txid).Scan(&status); err != nil {
+		return err
+	}
+	if status == "ABORTED" {
+		return common.VoteNo("transaction already aborted")
+	}
 	return nil
 }
 
-func handleTCC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
+// update2PCStatus фиксирует решение координатора над платежом и в той же транзакции публикует
+// payment.charged (COMMITTED) или payment.compensated (ABORTED). Повторная доставка решения ничего не меняет.
+func update2PCStatus(ctx context.Context, pool *pgxpool.Pool, cfg cfg, txid, status string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var orderID, step string
+	err = tx.QueryRow(ctx, `UPDATE twopc_prepared_tx SET status=$2, updated_at=now() WHERE txid=$1 AND status='PREPARED'
+		RETURNING order_id, step`, txid, status).Scan(&orderID, &step)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Решение уже применено (повторная доставка) или PREPARE не было.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE payment_operations SET status=$2, updated_at=now() WHERE txid=$1`, txid, status); err != nil {
+		return err
+	}
+	eventType := contracts.EventPaymentCharged
+	if status == "ABORTED" {
+		eventType = contracts.EventPaymentCompensated
+	}
+	if err := enqueueStateEvent(ctx, tx, cfg, txid, orderID, eventType, &contracts.StatePayload{Protocol: "2pc", Step: step}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func handleTCC(cfg cfg, participant *tcc.Participant, metrics *metrics.ServerMetrics, action string, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
@@ -184,17 +363,78 @@ func handleTCC(pool *pgxpool.Pool, metrics *metrics.ServerMetrics, action string
 		return
 	}
 
-	status := strings.ToUpper(action)
-	_, _ = pool.Exec(r.Context(), `INSERT INTO tcc_operations(txid, order_id, step, status, amount)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (txid) DO UPDATE SET status=EXCLUDED.status, updated_at=now()`, req.TxID, req.OrderID, req.Step, status, req.Amount)
+	res, err := applyTCC(r.Context(), cfg, participant, action, req)
+	if err != nil {
+		var vote *common.VoteNoError
+		switch {
+		case errors.As(err, &vote):
+			logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: "rejected", Message: vote.Reason})
+			writeJSON(w, http.StatusConflict, map[string]any{"status": "REJECTED", "reason": vote.Reason})
+			metrics.Requests.WithLabelValues("tcc_"+action, "409").Inc()
+		case errors.Is(err, tcc.ErrCancelled), errors.Is(err, tcc.ErrNotTried):
+			logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: "refused", Message: err.Error()})
+			writeJSON(w, http.StatusConflict, map[string]any{"status": res.Status, "error": err.Error()})
+			metrics.Requests.WithLabelValues("tcc_"+action, "409").Inc()
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+			metrics.Requests.WithLabelValues("tcc_"+action, "500").Inc()
+		}
+		metrics.LatencyMS.WithLabelValues("tcc_" + action).Observe(float64(time.Since(start).Milliseconds()))
+		return
+	}
 
-	logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: status})
-	writeJSON(w, http.StatusOK, map[string]any{"status": status})
+	logging.Log(logging.Fields{Service: "payment-service", TxID: req.TxID, OrderID: req.OrderID, Step: "tcc_" + action, Status: res.Status, Message: res.Note()})
+	writeJSON(w, http.StatusOK, map[string]any{"status": res.Status, "empty_rollback": res.EmptyRollback})
 	metrics.Requests.WithLabelValues("tcc_"+action, "200").Inc()
 	metrics.LatencyMS.WithLabelValues("tcc_" + action).Observe(float64(time.Since(start).Milliseconds()))
 }
 
+// applyTCC ведёт платёжный холд в payment_operations: try замораживает сумму (PREPARED),
+// confirm списывает её (COMMITTED) и публикует payment.charged, cancel снимает холд или
+// возвращает списанное (ABORTED) и публикует payment.compensated.
+// Сага-оркестрация подтверждения не присылает: действие (try) сразу списывает сумму.
+func applyTCC(ctx context.Context, cfg cfg, participant *tcc.Participant, action string, req TCCRequest) (tcc.Result, error) {
+	op := tcc.Op{TxID: req.TxID, OrderID: req.OrderID, Step: req.Step}
+	switch action {
+	case "try":
+		return participant.Try(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			if req.Amount < 0 {
+				return common.VoteNo("negative amount")
+			}
+			saga := strings.HasPrefix(req.Step, "saga_orch_")
+			status := "PREPARED"
+			if saga {
+				status = "COMMITTED"
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO payment_operations(order_id, txid, amount, status)
+				VALUES ($1, $2, $3, $4)`, req.OrderID, req.TxID, req.Amount, status)
+			if err != nil || !saga {
+				return err
+			}
+			return enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventPaymentCharged,
+				&contracts.StatePayload{Protocol: "tcc", Step: req.Step})
+		})
+	case "confirm":
+		return participant.Confirm(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `UPDATE payment_operations SET status='COMMITTED', updated_at=now() WHERE txid=$1 AND status='PREPARED'`, req.TxID)
+			if err != nil {
+				return err
+			}
+			return enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventPaymentCharged,
+				&contracts.StatePayload{Protocol: "tcc", Step: req.Step})
+		})
+	default:
+		return participant.Cancel(ctx, op, func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `UPDATE payment_operations SET status='ABORTED', updated_at=now() WHERE txid=$1 AND status<>'ABORTED'`, req.TxID)
+			if err != nil {
+				return err
+			}
+			return enqueueStateEvent(ctx, tx, cfg, req.TxID, req.OrderID, contracts.EventPaymentCompensated,
+				&contracts.StatePayload{Protocol: "tcc", Step: req.Step})
+		})
+	}
+}
+
 func jsonPayload(req any) string {
 	data, _ := json.Marshal(req)
 	return string(data)
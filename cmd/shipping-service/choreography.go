@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// Шаг shipping в саге-хореографии (TX_MODE=saga-chor):
+//   payment.created -> создание отгрузки (COMMITTED) -> shipping.created | shipping.failed
+// Отметка в inbox, отгрузка и исходящее событие в outbox пишутся одной транзакцией.
+// Отгрузка не создаётся, если в заказе больше SHIPPING_MAX_UNITS единиц товара.
+
+// consumedEvents — события, которые обрабатывает сервис: он подписан только на их топики.
+var consumedEvents = []string{contracts.EventPaymentCreated}
+
+func consumeEvents(ctx context.Context, pool *pgxpool.Pool, broker kafka.Broker, cfg cfg, m *metrics.ConsumerMetrics) {
+	kafka.Consume(ctx, broker, cfg.Routing.TopicsFor(consumedEvents...), cfg.KafkaGroupID, cfg.Consumer, func(ctx context.Context, msg kafka.Message) error {
+		meta, err := contracts.Peek(msg.HeaderMap(), msg.Value)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		start := time.Now()
+		status, err := handleEvent(ctx, pool, cfg, meta, msg.Value)
+		if err != nil || status == "" {
+			return err
+		}
+		logging.Log(logging.Fields{Service: "shipping-service", TxID: meta.TxID, OrderID: meta.OrderID, EventID: meta.EventID, Step: meta.Type, Status: status, DurationMS: time.Since(start).Milliseconds()})
+		return nil
+	}, m)
+}
+
+// handleEvent выполняет шаг для события meta и возвращает тип опубликованного события
+// ("duplicate" для повторной доставки, пусто — событие не для shipping). Тип и event_id берутся
+// из заголовков, поэтому чужие события и дубли отсекаются без разбора тела.
+func handleEvent(ctx context.Context, pool *pgxpool.Pool, cfg cfg, meta contracts.Meta, body []byte) (string, error) {
+	if meta.Type != contracts.EventPaymentCreated {
+		return "", nil
+	}
+
+	next, reason := contracts.EventShipmentCreated, ""
+	fresh, err := outbox.Receive(ctx, pool, meta.EventID, func(ctx context.Context, tx pgx.Tx) error {
+		evt, err := meta.Decode(body)
+		if err != nil {
+			return kafka.Permanent(fmt.Errorf("event decode: %w", err))
+		}
+		var payload contracts.OrderPayload
+		if err := evt.DecodePayload(&payload); err != nil {
+			return err
+		}
+		err = createShipment(ctx, tx, evt, payload.Items, cfg.MaxShipmentUnits)
+		var vote *common.VoteNoError
+		switch {
+		case errors.As(err, &vote):
+			next, reason = contracts.EventShipmentFailed, vote.Reason
+		case err != nil:
+			return err
+		}
+		return enqueueEvent(ctx, tx, cfg, evt, next, reason)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "duplicate", nil
+	}
+	return next, nil
+}
+
+// createShipment создаёт отгрузку заказа. Отгрузка больше maxUnits единиц (0 — без ограничения)
+// и отгрузка, уже отменённая по этому txid, не создаются.
+func createShipment(ctx context.Context, tx pgx.Tx, evt contracts.Event, items []protocol.LineItem, maxUnits int) error {
+	units := 0
+	for _, it := range items {
+		units += int(it.Quantity)
+	}
+	if maxUnits > 0 && units > maxUnits {
+		return common.VoteNo(fmt.Sprintf("shipment of %d units exceeds limit %d", units, maxUnits))
+	}
+	tag, err := tx.Exec(ctx, `INSERT INTO shipments(order_id, txid, status)
+		VALUES ($1, $2, 'COMMITTED')
+		ON CONFLICT (txid) DO NOTHING`, evt.OrderID, evt.TxID)
+	if err != nil || tag.RowsAffected() == 1 {
+		return err
+	}
+	var status string
+	if err := tx.QueryRow(ctx, `SELECT status FROM shipments WHERE txid=$1`, evt.TxID).Scan(&status); err != nil {
+		return err
+	}
+	if status == "ABORTED" {
+		return common.VoteNo("shipment already cancelled")
+	}
+	return nil
+}
+
+// enqueueEvent кладёт в outbox событие eventType, вызванное cause. Payload заказа
+// (позиции, сумма) передаётся дальше по цепочке без изменений.
+func enqueueEvent(ctx context.Context, tx pgx.Tx, cfg cfg, cause contracts.Event, eventType, reason string) error {
+	var payload contracts.OrderPayload
+	if err := cause.DecodePayload(&payload); err != nil {
+		return err
+	}
+	if reason != "" {
+		payload.Reason = reason
+	}
+	evt, err := contracts.Caused(cause, eventType, "shipping-service", &payload)
+	if err != nil {
+		return err
+	}
+	return outbox.InsertEvent(ctx, tx, cfg.Routing, evt)
+}
@@ -17,6 +17,8 @@ CREATE TABLE IF NOT EXISTS twopc_prepared_tx (
 
 CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_order_id ON twopc_prepared_tx(order_id);
 CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_status   ON twopc_prepared_tx(status);
+-- expires_at ставится на PREPARE; просроченные PREPARED разрешает резолвер участника
+CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_expires  ON twopc_prepared_tx(expires_at) WHERE status = 'PREPARED';
 
 -- Остатки (для демо можно заранее seed'ить)
 CREATE TABLE IF NOT EXISTS inventory_stock (
@@ -25,6 +27,26 @@ CREATE TABLE IF NOT EXISTS inventory_stock (
   updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Сумма незавершённых (PREPARED) резервов; к резерву доступно available - reserved
+ALTER TABLE inventory_stock ADD COLUMN IF NOT EXISTS reserved INT NOT NULL DEFAULT 0 CHECK (reserved >= 0);
+-- Версия строки для INVENTORY_LOCK_STRATEGY=optimistic (увеличивается при каждом изменении)
+ALTER TABLE inventory_stock ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+
+-- Escrow-шарды остатка (INVENTORY_LOCK_STRATEGY=escrow): остаток SKU разложен по N строкам,
+-- резерв берётся из одного шарда, чтобы конкурентные заказы не упирались в одну строку
+CREATE TABLE IF NOT EXISTS inventory_stock_shards (
+  product_id   TEXT NOT NULL,
+  shard        INT NOT NULL,
+  available    INT NOT NULL CHECK (available >= 0),
+  reserved     INT NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+  updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (product_id, shard)
+);
+
+-- SKU, который используют smoke-тесты и bench-runner
+INSERT INTO inventory_stock(product_id, available) VALUES ('sku-1', 1000000)
+ON CONFLICT (product_id) DO NOTHING;
+
 -- Резервы под заказ (создаются на PREPARE, финализируются на COMMIT, снимаются на ABORT)
 CREATE TABLE IF NOT EXISTS inventory_reservations (
   id           BIGSERIAL PRIMARY KEY,
@@ -41,6 +63,12 @@ CREATE TABLE IF NOT EXISTS inventory_reservations (
 CREATE INDEX IF NOT EXISTS idx_inventory_reservations_order_id ON inventory_reservations(order_id);
 CREATE INDEX IF NOT EXISTS idx_inventory_reservations_status   ON inventory_reservations(status);
 CREATE INDEX IF NOT EXISTS idx_inventory_reservations_product  ON inventory_reservations(product_id);
+-- Шард, из которого взят escrow-резерв (NULL — резерв по строке inventory_stock)
+ALTER TABLE inventory_reservations ADD COLUMN IF NOT EXISTS shard INT NULL;
+-- Escrow-резерв, не влезший в один шард, хранится частями — по строке на шард
+ALTER TABLE inventory_reservations DROP CONSTRAINT IF EXISTS inventory_reservations_txid_product_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS uq_inventory_reservations_txid_product_shard
+  ON inventory_reservations(txid, product_id, COALESCE(shard, -1));
 
 -- TCC operations
 CREATE TABLE IF NOT EXISTS tcc_operations (
@@ -52,6 +80,9 @@ CREATE TABLE IF NOT EXISTS tcc_operations (
   updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Cancel без Try (пустой откат): запись CANCEL блокирует опоздавший Try
+ALTER TABLE tcc_operations ADD COLUMN IF NOT EXISTS empty_rollback BOOLEAN NOT NULL DEFAULT false;
+
 -- Outbox / inbox for Kafka delivery
 CREATE TABLE IF NOT EXISTS outbox (
   id         BIGSERIAL PRIMARY KEY,
@@ -63,9 +94,56 @@ CREATE TABLE IF NOT EXISTS outbox (
   sent_at    TIMESTAMPTZ NULL
 );
 
+-- Аренда записи relay-ем: несколько реплик делят outbox без повторной публикации
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_by    TEXT NULL;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ NULL;
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE sent_at IS NULL;
+
+-- Неудачные попытки публикации; после OUTBOX_MAX_ATTEMPTS запись переносится в outbox_dead
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS attempts   INT  NOT NULL DEFAULT 0;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS last_error TEXT NULL;
+
+-- Очередь ключа: пока более ранняя запись ключа в аренде или отложена, следующие не берутся
+CREATE INDEX IF NOT EXISTS idx_outbox_pending_key ON outbox(key, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_sent_at     ON outbox(sent_at) WHERE sent_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_dead (
+  id          BIGINT PRIMARY KEY,
+  event_id    TEXT NOT NULL UNIQUE,
+  topic       TEXT NOT NULL,
+  key         TEXT NOT NULL,
+  payload     JSONB NOT NULL,
+  attempts    INT  NOT NULL,
+  last_error  TEXT NULL,
+  created_at  TIMESTAMPTZ NOT NULL,
+  dead_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Заголовки сообщения (event_id, тип, версия схемы, txid, correlation id, traceparent)
+ALTER TABLE outbox      ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE outbox_dead ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+
 CREATE TABLE IF NOT EXISTS inbox (
   event_id    TEXT PRIMARY KEY,
   received_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Ключи Idempotency-Key (pkg/idempotency): отпечаток запроса и сохранённый ответ;
+-- status IS NULL — первый запрос ещё выполняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key           TEXT NOT NULL,
+  scope         TEXT NOT NULL,
+  request_hash  TEXT NOT NULL,
+  status        INT  NULL,
+  headers       JSONB NULL,
+  body          BYTEA NULL,
+  locked_until  TIMESTAMPTZ NOT NULL,
+  expires_at    TIMESTAMPTZ NOT NULL,
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (key, scope)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
 COMMIT;
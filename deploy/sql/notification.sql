@@ -17,4 +17,21 @@ CREATE TABLE IF NOT EXISTS notifications (
   created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Ключи Idempotency-Key (pkg/idempotency): отпечаток запроса и сохранённый ответ;
+-- status IS NULL — первый запрос ещё выполняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key           TEXT NOT NULL,
+  scope         TEXT NOT NULL,
+  request_hash  TEXT NOT NULL,
+  status        INT  NULL,
+  headers       JSONB NULL,
+  body          BYTEA NULL,
+  locked_until  TIMESTAMPTZ NOT NULL,
+  expires_at    TIMESTAMPTZ NOT NULL,
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (key, scope)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
 COMMIT;
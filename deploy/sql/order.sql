@@ -24,13 +24,6 @@ CREATE TABLE IF NOT EXISTS order_items (
 
 CREATE INDEX IF NOT EXISTS idx_order_items_product_id ON order_items(product_id);
 
--- Идемпотентность checkout (рекомендуется для реплик и повторов запросов)
-CREATE TABLE IF NOT EXISTS order_idempotency (
-  idempotency_key TEXT PRIMARY KEY,
-  order_id        TEXT NOT NULL,
-  created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
 -- Журнал координатора 2PC
 CREATE TABLE IF NOT EXISTS twopc_tx_log (
   txid          TEXT PRIMARY KEY,
@@ -41,9 +34,37 @@ CREATE TABLE IF NOT EXISTS twopc_tx_log (
   updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Причина отказа: голос "нет" участника или его недоступность
+ALTER TABLE twopc_tx_log ADD COLUMN IF NOT EXISTS reason TEXT NULL;
+
 CREATE INDEX IF NOT EXISTS idx_twopc_tx_log_order_id ON twopc_tx_log(order_id);
 CREATE INDEX IF NOT EXISTS idx_twopc_tx_log_status   ON twopc_tx_log(status);
 
+-- Журнал оркестратора саги: экземпляр и состояние каждого шага
+CREATE TABLE IF NOT EXISTS saga_instances (
+  saga_id     TEXT PRIMARY KEY,
+  order_id    TEXT NOT NULL,
+  status      TEXT NOT NULL CHECK (status IN ('RUNNING','COMPENSATING','COMPLETED','COMPENSATED')),
+  request     JSONB NOT NULL,
+  reason      TEXT NULL,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_saga_instances_order_id ON saga_instances(order_id);
+CREATE INDEX IF NOT EXISTS idx_saga_instances_status   ON saga_instances(status, updated_at);
+
+CREATE TABLE IF NOT EXISTS saga_steps (
+  saga_id     TEXT NOT NULL REFERENCES saga_instances(saga_id) ON DELETE CASCADE,
+  step_index  INT  NOT NULL,
+  name        TEXT NOT NULL,
+  step        TEXT NOT NULL,
+  status      TEXT NOT NULL CHECK (status IN ('PENDING','RUNNING','DONE','FAILED','COMPENSATING','COMPENSATED')),
+  last_error  TEXT NULL,
+  updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (saga_id, step_index)
+);
+
 -- Outbox / inbox for Kafka delivery
 CREATE TABLE IF NOT EXISTS outbox (
   id         BIGSERIAL PRIMARY KEY,
@@ -55,9 +76,66 @@ CREATE TABLE IF NOT EXISTS outbox (
   sent_at    TIMESTAMPTZ NULL
 );
 
+-- Аренда записи relay-ем: несколько реплик делят outbox без повторной публикации
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_by    TEXT NULL;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ NULL;
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE sent_at IS NULL;
+
+-- Неудачные попытки публикации; после OUTBOX_MAX_ATTEMPTS запись переносится в outbox_dead
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS attempts   INT  NOT NULL DEFAULT 0;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS last_error TEXT NULL;
+
+-- Очередь ключа: пока более ранняя запись ключа в аренде или отложена, следующие не берутся
+CREATE INDEX IF NOT EXISTS idx_outbox_pending_key ON outbox(key, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_sent_at     ON outbox(sent_at) WHERE sent_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_dead (
+  id          BIGINT PRIMARY KEY,
+  event_id    TEXT NOT NULL UNIQUE,
+  topic       TEXT NOT NULL,
+  key         TEXT NOT NULL,
+  payload     JSONB NOT NULL,
+  attempts    INT  NOT NULL,
+  last_error  TEXT NULL,
+  created_at  TIMESTAMPTZ NOT NULL,
+  dead_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Заголовки сообщения (event_id, тип, версия схемы, txid, correlation id, traceparent)
+ALTER TABLE outbox      ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE outbox_dead ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Позиция CDC-relay (TX_MODE=outbox-cdc) в слоте логической репликации
+CREATE TABLE IF NOT EXISTS outbox_cdc_offsets (
+  slot       TEXT PRIMARY KEY,
+  lsn        TEXT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE TABLE IF NOT EXISTS inbox (
   event_id    TEXT PRIMARY KEY,
   received_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Ключи Idempotency-Key (pkg/idempotency): отпечаток запроса и сохранённый ответ;
+-- status IS NULL — первый запрос ещё выполняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key           TEXT NOT NULL,
+  scope         TEXT NOT NULL,
+  request_hash  TEXT NOT NULL,
+  status        INT  NULL,
+  headers       JSONB NULL,
+  body          BYTEA NULL,
+  locked_until  TIMESTAMPTZ NOT NULL,
+  expires_at    TIMESTAMPTZ NOT NULL,
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (key, scope)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- Идемпотентность checkout перенесена в idempotency_keys
+DROP TABLE IF EXISTS order_idempotency;
+
 COMMIT;
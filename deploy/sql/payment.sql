@@ -17,6 +17,8 @@ CREATE TABLE IF NOT EXISTS twopc_prepared_tx (
 
 CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_order_id ON twopc_prepared_tx(order_id);
 CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_status   ON twopc_prepared_tx(status);
+-- expires_at ставится на PREPARE; просроченные PREPARED разрешает резолвер участника
+CREATE INDEX IF NOT EXISTS idx_twopc_prepared_tx_expires  ON twopc_prepared_tx(expires_at) WHERE status = 'PREPARED';
 
 -- Платёжные операции (минимально для демо)
 -- В 2PC на PREPARE создаём запись со статусом PREPARED, на COMMIT -> COMMITTED, на ABORT -> ABORTED
@@ -44,6 +46,9 @@ CREATE TABLE IF NOT EXISTS tcc_operations (
   updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Cancel без Try (пустой откат): запись CANCEL блокирует опоздавший Try
+ALTER TABLE tcc_operations ADD COLUMN IF NOT EXISTS empty_rollback BOOLEAN NOT NULL DEFAULT false;
+
 -- Outbox / inbox for Kafka delivery
 CREATE TABLE IF NOT EXISTS outbox (
   id         BIGSERIAL PRIMARY KEY,
@@ -55,9 +60,56 @@ CREATE TABLE IF NOT EXISTS outbox (
   sent_at    TIMESTAMPTZ NULL
 );
 
+-- Аренда записи relay-ем: несколько реплик делят outbox без повторной публикации
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_by    TEXT NULL;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ NULL;
+
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE sent_at IS NULL;
+
+-- Неудачные попытки публикации; после OUTBOX_MAX_ATTEMPTS запись переносится в outbox_dead
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS attempts   INT  NOT NULL DEFAULT 0;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS last_error TEXT NULL;
+
+-- Очередь ключа: пока более ранняя запись ключа в аренде или отложена, следующие не берутся
+CREATE INDEX IF NOT EXISTS idx_outbox_pending_key ON outbox(key, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_sent_at     ON outbox(sent_at) WHERE sent_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_dead (
+  id          BIGINT PRIMARY KEY,
+  event_id    TEXT NOT NULL UNIQUE,
+  topic       TEXT NOT NULL,
+  key         TEXT NOT NULL,
+  payload     JSONB NOT NULL,
+  attempts    INT  NOT NULL,
+  last_error  TEXT NULL,
+  created_at  TIMESTAMPTZ NOT NULL,
+  dead_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Заголовки сообщения (event_id, тип, версия схемы, txid, correlation id, traceparent)
+ALTER TABLE outbox      ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE outbox_dead ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'::jsonb;
+
 CREATE TABLE IF NOT EXISTS inbox (
   event_id    TEXT PRIMARY KEY,
   received_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Ключи Idempotency-Key (pkg/idempotency): отпечаток запроса и сохранённый ответ;
+-- status IS NULL — первый запрос ещё выполняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key           TEXT NOT NULL,
+  scope         TEXT NOT NULL,
+  request_hash  TEXT NOT NULL,
+  status        INT  NULL,
+  headers       JSONB NULL,
+  body          BYTEA NULL,
+  locked_until  TIMESTAMPTZ NOT NULL,
+  expires_at    TIMESTAMPTZ NOT NULL,
+  created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (key, scope)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
 COMMIT;
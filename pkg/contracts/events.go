@@ -1,14 +1,35 @@
 package contracts
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// SchemaVersion — текущая версия схемы событий. Потребитель принимает версии от 1 до
+// зарегистрированной для типа (Registry) и отклоняет более новые.
+const SchemaVersion = 1
 
+// Event — единый конверт события для outbox и Kafka. CorrelationID общий для всех событий
+// одной бизнес-операции (по умолчанию txid оформления), CausationID — event_id события,
+// вызвавшего это. Payload — JSON типизированной структуры для Type (см. payloads.go).
+// Traceparent передаётся только заголовком сообщения (см. headers.go), в тело не пишется.
 type Event struct {
-	EventID   string         `json:"event_id"`
-	TxID      string         `json:"txid"`
-	OrderID   string         `json:"order_id"`
-	CreatedAt time.Time      `json:"created_at"`
-	Type      string         `json:"type"`
-	Payload   map[string]any `json:"payload"`
+	EventID       string          `json:"event_id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	Producer      string          `json:"producer"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id"`
+	CausationID   string          `json:"causation_id,omitempty"`
+	TxID          string          `json:"txid"`
+	OrderID       string          `json:"order_id"`
+	Payload       json.RawMessage `json:"payload"`
+	Traceparent   string          `json:"-"`
+}
+
+// DecodePayload разбирает Payload в v (указатель на структуру payload типа события).
+func (e Event) DecodePayload(v any) error {
+	return json.Unmarshal(e.Payload, v)
 }
 
 const (
@@ -28,4 +49,18 @@ const (
 	EventInventoryReleased   = "inventory.released"
 	EventShipmentCancelled   = "shipping.cancelled"
 	EventNotificationEmitted = "notification.emitted"
+
+	// Отказы шагов хореографии (payload.reason — причина).
+	EventInventoryRejected = "inventory.rejected"
+	EventPaymentFailed     = "payment.failed"
+	EventShipmentFailed    = "shipping.failed"
+
+	// Изменения состояния участников в 2PC, TCC и саге-оркестрации (payload.protocol — "2pc" или
+	// "tcc", payload.step — шаг). Хореография на них не реагирует.
+	EventInventoryReserved    = "inventory.reserved"
+	EventPaymentCharged       = "payment.charged"
+	EventShipmentBooked       = "shipping.booked"
+	EventInventoryCompensated = "inventory.compensated"
+	EventPaymentCompensated   = "payment.compensated"
+	EventShipmentCompensated  = "shipping.compensated"
 )
@@ -0,0 +1,130 @@
+package contracts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Заголовки сообщения с метаданными конверта. outbox хранит их рядом с payload, relay отправляет
+// вместе с сообщением, и потребитель по ним выбирает обработчик, отсекает дубль и продолжает
+// трассу, не разбирая тело.
+const (
+	HeaderEventID       = "event_id"
+	HeaderType          = "event_type"
+	HeaderSchemaVersion = "schema_version"
+	HeaderTxID          = "txid"
+	HeaderOrderID       = "order_id"
+	HeaderCorrelationID = "correlation_id"
+	HeaderTraceparent   = "traceparent"
+)
+
+// Headers — заголовки сообщения для события.
+func (e Event) Headers() map[string]string {
+	h := map[string]string{
+		HeaderEventID:       e.EventID,
+		HeaderType:          e.Type,
+		HeaderSchemaVersion: strconv.Itoa(e.SchemaVersion),
+		HeaderTxID:          e.TxID,
+		HeaderOrderID:       e.OrderID,
+		HeaderCorrelationID: e.CorrelationID,
+	}
+	if e.Traceparent != "" {
+		h[HeaderTraceparent] = e.Traceparent
+	}
+	return h
+}
+
+// Meta — метаданные события, известные до разбора тела.
+type Meta struct {
+	EventID       string
+	Type          string
+	SchemaVersion int
+	TxID          string
+	OrderID       string
+	CorrelationID string
+	Traceparent   string
+}
+
+// Peek возвращает метаданные из заголовков. Сообщение без них (записанное до введения заголовков)
+// разбирается целиком, и метаданные берутся из конверта.
+func Peek(headers map[string]string, body []byte) (Meta, error) {
+	if headers[HeaderEventID] != "" && headers[HeaderType] != "" {
+		version, err := strconv.Atoi(headers[HeaderSchemaVersion])
+		if err != nil {
+			return Meta{}, fmt.Errorf("header %s: %w", HeaderSchemaVersion, err)
+		}
+		return Meta{
+			EventID:       headers[HeaderEventID],
+			Type:          headers[HeaderType],
+			SchemaVersion: version,
+			TxID:          headers[HeaderTxID],
+			OrderID:       headers[HeaderOrderID],
+			CorrelationID: headers[HeaderCorrelationID],
+			Traceparent:   headers[HeaderTraceparent],
+		}, nil
+	}
+	evt, err := Decode(body)
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{
+		EventID:       evt.EventID,
+		Type:          evt.Type,
+		SchemaVersion: evt.SchemaVersion,
+		TxID:          evt.TxID,
+		OrderID:       evt.OrderID,
+		CorrelationID: evt.CorrelationID,
+	}, nil
+}
+
+// Decode разбирает тело сообщения с метаданными m и переносит в событие traceparent из заголовков.
+// Заголовки и конверт должны описывать одно событие.
+func (m Meta) Decode(body []byte) (Event, error) {
+	evt, err := Decode(body)
+	if err != nil {
+		return Event{}, err
+	}
+	if evt.EventID != m.EventID || evt.Type != m.Type {
+		return Event{}, fmt.Errorf("headers describe %s %q, payload %s %q", m.Type, m.EventID, evt.Type, evt.EventID)
+	}
+	evt.Traceparent = m.Traceparent
+	return evt, nil
+}
+
+// traceparent — W3C trace context (версия 00, sampled): trace-id общий для всех событий
+// оформления, span-id — event_id события.
+func traceparent(traceID, eventID string) string {
+	return "00-" + hexID(traceID, 32) + "-" + hexID(eventID, 16) + "-01"
+}
+
+// traceID — trace-id из traceparent; пусто, если заголовок не в формате W3C.
+func traceID(parent string) string {
+	parts := strings.Split(parent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || !isHex(parts[1]) {
+		return ""
+	}
+	return parts[1]
+}
+
+// hexID приводит идентификатор к n hex-символам: UUID (txid, event_id) берётся как есть без
+// дефисов, прочие строки хешируются.
+func hexID(id string, n int) string {
+	s := strings.ToLower(strings.ReplaceAll(id, "-", ""))
+	if len(s) >= n && isHex(s) {
+		return s[:n]
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])[:n]
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package contracts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// Payload — типизированное тело события; Validate проверяет обязательные поля.
+type Payload interface {
+	Validate() error
+}
+
+// OrderPayload — заказ, который передаётся по цепочке событий без изменений: события заказа
+// и шаги хореографии. Reason заполняют отказы и компенсации.
+type OrderPayload struct {
+	Items  []protocol.LineItem `json:"items"`
+	Total  int64               `json:"total"`
+	Reason string              `json:"reason,omitempty"`
+}
+
+func (p *OrderPayload) Validate() error {
+	if p.Total < 0 {
+		return errors.New("total must not be negative")
+	}
+	for _, it := range p.Items {
+		if it.ProductID == "" || it.Quantity <= 0 {
+			return fmt.Errorf("invalid item %q x %d", it.ProductID, it.Quantity)
+		}
+	}
+	return nil
+}
+
+// StatePayload — изменение состояния участника в 2PC/TCC/саге-оркестрации.
+// Items заполняет inventory для резерва.
+type StatePayload struct {
+	Protocol string              `json:"protocol"`
+	Step     string              `json:"step"`
+	Items    []protocol.LineItem `json:"items,omitempty"`
+}
+
+func (p *StatePayload) Validate() error {
+	if p.Protocol != "2pc" && p.Protocol != "tcc" {
+		return fmt.Errorf("unknown protocol %q", p.Protocol)
+	}
+	if p.Step == "" {
+		return errors.New("step is required")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package contracts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownType        = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+type schema struct {
+	version int
+	payload func() Payload
+}
+
+// Registry сопоставляет тип события с максимальной поддерживаемой версией схемы и структурой payload.
+type Registry struct {
+	schemas map[string]schema
+}
+
+func NewRegistry() *Registry {
+	return &Registry{schemas: make(map[string]schema)}
+}
+
+// Register добавляет тип события; version — максимальная поддерживаемая версия схемы.
+func (r *Registry) Register(eventType string, version int, payload func() Payload) {
+	r.schemas[eventType] = schema{version: version, payload: payload}
+}
+
+// Types — зарегистрированные типы событий по алфавиту.
+func (r *Registry) Types() []string {
+	out := make([]string, 0, len(r.schemas))
+	for t := range r.schemas {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Validate проверяет конверт, тип и версию и разбирает payload в зарегистрированную структуру.
+func (r *Registry) Validate(evt Event) (Payload, error) {
+	switch {
+	case evt.EventID == "":
+		return nil, errors.New("event_id is required")
+	case evt.OrderID == "":
+		return nil, errors.New("order_id is required")
+	case evt.Producer == "":
+		return nil, errors.New("producer is required")
+	case evt.OccurredAt.IsZero():
+		return nil, errors.New("occurred_at is required")
+	}
+	s, ok := r.schemas[evt.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, evt.Type)
+	}
+	if evt.SchemaVersion < 1 || evt.SchemaVersion > s.version {
+		return nil, fmt.Errorf("%w %d for %s", ErrUnsupportedVersion, evt.SchemaVersion, evt.Type)
+	}
+	payload := s.payload()
+	if err := json.Unmarshal(evt.Payload, payload); err != nil {
+		return nil, fmt.Errorf("%s payload: %w", evt.Type, err)
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, fmt.Errorf("%s payload: %w", evt.Type, err)
+	}
+	return payload, nil
+}
+
+// Decode разбирает и проверяет сообщение брокера.
+func (r *Registry) Decode(data []byte) (Event, error) {
+	var evt Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return Event{}, err
+	}
+	if _, err := r.Validate(evt); err != nil {
+		return Event{}, err
+	}
+	return evt, nil
+}
+
+// Default — реестр всех событий проекта.
+var Default = defaultRegistry()
+
+func defaultRegistry() *Registry {
+	r := NewRegistry()
+	order := func() Payload { return &OrderPayload{} }
+	for _, t := range []string{
+		EventOrderCreated, EventInventorySoft, EventPaymentCreated, EventPaymentCaptured, EventInventoryHard,
+		EventShipmentCreated, EventOrderConfirmed, EventOrderShipped, EventShipmentDelivered, EventInventoryDeducted,
+		EventOrderCompleted, EventOrderCompensated, EventPaymentRefunded, EventInventoryReleased, EventShipmentCancelled,
+		EventNotificationEmitted, EventInventoryRejected, EventPaymentFailed, EventShipmentFailed,
+	} {
+		r.Register(t, SchemaVersion, order)
+	}
+	state := func() Payload { return &StatePayload{} }
+	for _, t := range []string{
+		EventInventoryReserved, EventPaymentCharged, EventShipmentBooked,
+		EventInventoryCompensated, EventPaymentCompensated, EventShipmentCompensated,
+	} {
+		r.Register(t, SchemaVersion, state)
+	}
+	return r
+}
+
+// Decode разбирает и проверяет сообщение по реестру Default.
+func Decode(data []byte) (Event, error) {
+	return Default.Decode(data)
+}
+
+// New собирает событие текущей версии схемы и проверяет его по реестру Default.
+// CorrelationID — txid, trace-id в Traceparent выводится из txid.
+func New(eventType, producer, txid, orderID string, payload Payload) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	evt := Event{
+		EventID:       uuid.NewString(),
+		Type:          eventType,
+		SchemaVersion: SchemaVersion,
+		Producer:      producer,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: txid,
+		TxID:          txid,
+		OrderID:       orderID,
+		Payload:       data,
+	}
+	evt.Traceparent = traceparent(txid, evt.EventID)
+	if _, err := Default.Validate(evt); err != nil {
+		return Event{}, err
+	}
+	return evt, nil
+}
+
+// Caused собирает событие, вызванное cause: txid, заказ, CorrelationID и trace-id наследуются,
+// CausationID — event_id cause.
+func Caused(cause Event, eventType, producer string, payload Payload) (Event, error) {
+	evt, err := New(eventType, producer, cause.TxID, cause.OrderID, payload)
+	if err != nil {
+		return Event{}, err
+	}
+	evt.CorrelationID = cause.CorrelationID
+	evt.CausationID = cause.EventID
+	trace := traceID(cause.Traceparent)
+	if trace == "" {
+		trace = cause.CorrelationID
+	}
+	evt.Traceparent = traceparent(trace, evt.EventID)
+	return evt, nil
+}
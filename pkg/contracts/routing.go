@@ -0,0 +1,133 @@
+package contracts
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ключ партиционирования маршрута: поле события, значение которого становится ключом сообщения.
+const (
+	KeyOrderID = "order_id"
+	KeyTxID    = "txid"
+)
+
+// Route — маршрут типов событий: Pattern — тип или префикс со звёздочкой ("order.*", "*"),
+// в Topic подстановка "{type}" заменяется типом события.
+type Route struct {
+	Pattern string
+	Topic   string
+	Key     string
+}
+
+// Routing — топик и ключ для каждого типа события и число партиций топиков. Сервисы заполняют
+// его из KAFKA_TOPIC, EVENT_ROUTES, KAFKA_PARTITIONS и KAFKA_TOPIC_PARTITIONS. Без маршрутов
+// все события идут в Topic с ключом order_id.
+type Routing struct {
+	Topic           string         // KAFKA_TOPIC, топик типов без маршрута
+	Routes          []Route        // EVENT_ROUTES, выигрывает первый подходящий
+	Partitions      int            // KAFKA_PARTITIONS, партиций у топика по умолчанию
+	TopicPartitions map[string]int // KAFKA_TOPIC_PARTITIONS
+}
+
+// ParseRoutes разбирает EVENT_ROUTES: "pattern=topic[:key]" через запятую,
+// например "order.*=txlab.orders,*=txlab.{type}:txid".
+func ParseRoutes(spec string) ([]Route, error) {
+	var out []Route
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, target, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("route %q: want pattern=topic[:key]", item)
+		}
+		topic, key, _ := strings.Cut(target, ":")
+		route := Route{Pattern: strings.TrimSpace(pattern), Topic: strings.TrimSpace(topic), Key: strings.TrimSpace(key)}
+		if route.Topic == "" {
+			return nil, fmt.Errorf("route %q: empty topic", item)
+		}
+		switch route.Key {
+		case "":
+			route.Key = KeyOrderID
+		case KeyOrderID, KeyTxID:
+		default:
+			return nil, fmt.Errorf("route %q: key must be %s or %s", item, KeyOrderID, KeyTxID)
+		}
+		out = append(out, route)
+	}
+	return out, nil
+}
+
+// ParsePartitions разбирает KAFKA_TOPIC_PARTITIONS: "topic=N" через запятую.
+func ParsePartitions(spec string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		topic, count, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if !ok || err != nil || n <= 0 || strings.TrimSpace(topic) == "" {
+			return nil, fmt.Errorf("partitions %q: want topic=N, N > 0", item)
+		}
+		out[strings.TrimSpace(topic)] = n
+	}
+	return out, nil
+}
+
+// Route возвращает топик и ключ сообщения для события.
+func (r Routing) Route(evt Event) (string, string) {
+	topic, key := r.route(evt.Type)
+	if key == KeyTxID {
+		return topic, evt.TxID
+	}
+	return topic, evt.OrderID
+}
+
+func (r Routing) route(eventType string) (string, string) {
+	for _, route := range r.Routes {
+		if match(route.Pattern, eventType) {
+			return strings.ReplaceAll(route.Topic, "{type}", eventType), route.Key
+		}
+	}
+	return r.Topic, KeyOrderID
+}
+
+func match(pattern, eventType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(eventType, prefix)
+	}
+	return pattern == eventType
+}
+
+// TopicsFor — топики, куда публикуются типы types; на них подписывается потребитель этих типов.
+func (r Routing) TopicsFor(types ...string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range types {
+		topic, _ := r.route(t)
+		if !seen[topic] {
+			seen[topic] = true
+			out = append(out, topic)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Topics — все топики типов реестра Default с числом партиций.
+func (r Routing) Topics() map[string]int {
+	out := map[string]int{}
+	for _, topic := range r.TopicsFor(Default.Types()...) {
+		n, ok := r.TopicPartitions[topic]
+		if !ok {
+			n = r.Partitions
+		}
+		out[topic] = n
+	}
+	return out
+}
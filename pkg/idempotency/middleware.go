@@ -0,0 +1,237 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// ReplayedHeader отмечает ответ, повторённый из хранилища.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// maxBody — предел тела запроса с ключом: тело читается целиком ради отпечатка.
+const maxBody = 1 << 20
+
+// Config — параметры middleware; сервисы заполняют его из IDEMPOTENCY_*.
+type Config struct {
+	TTL   time.Duration // IDEMPOTENCY_TTL_MS, сколько хранится ответ на ключ
+	Lease time.Duration // IDEMPOTENCY_LEASE_MS, после этого незавершённый запрос (упала реплика) выполняется заново
+}
+
+// Middleware делает небезопасные запросы (не GET/HEAD/OPTIONS) с заголовком Idempotency-Key
+// идемпотентными. Ключ хранится в idempotency_keys вместе с отпечатком запроса (метод, путь,
+// тело); первый запрос выполняется, и его код, заголовки и тело сохраняются на TTL. Повтор
+// с тем же отпечатком получает сохранённый ответ без вызова обработчика, пока первый
+// выполняется — 409, с другим отпечатком — 422. Сохраняется и ответ 5xx: к нему обработчик
+// мог успеть записать состояние (заказ, журнал 2PC), и повтор не должен выполнить запрос ещё раз.
+// Запросы без ключа проходят как есть.
+type Middleware struct {
+	Pool    *pgxpool.Pool
+	Config  Config
+	Metrics *metrics.IdempotencyMetrics
+}
+
+func New(pool *pgxpool.Pool, cfg Config, m *metrics.IdempotencyMetrics) *Middleware {
+	return &Middleware{Pool: pool, Config: cfg, Metrics: m}
+}
+
+// Wrap оборачивает обработчик сервиса (обычно весь mux).
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := Key(r)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large for idempotent request")
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		scope := r.Method + " " + r.URL.Path
+		hash := fingerprint(r, body)
+
+		claimed, err := m.claim(r.Context(), key, scope, hash)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !claimed {
+			m.replay(r.Context(), w, key, scope, hash)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		done := false
+		defer func() {
+			if !done {
+				// Обработчик запаниковал, возможно после записи состояния: повтор получит 500
+				// (или уже начатый ответ), а не выполнит запрос заново. Панику дальше обрабатывает net/http.
+				if rec.status == 0 {
+					rec.status, rec.header = http.StatusInternalServerError, http.Header{"Content-Type": {"application/json"}}
+					_ = json.NewEncoder(&rec.body).Encode(map[string]any{"error": "internal error"})
+				}
+				if err := m.complete(key, scope, rec); err != nil {
+					log.Printf("idempotency store error: %v", err)
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		done = true
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.header == nil {
+			rec.header = rec.Header().Clone()
+		}
+		if err := m.complete(key, scope, rec); err != nil {
+			// Ответ уже отдан; ключ останется незавершённым до Lease, повтор получит 409.
+			log.Printf("idempotency store error: %v", err)
+			return
+		}
+		m.Metrics.Requests.WithLabelValues("stored").Inc()
+	})
+}
+
+// Start удаляет ключи с истёкшим TTL раз в минуту до отмены ctx.
+func (m *Middleware) Start(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if _, err := m.Pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at < now()`); err != nil && ctx.Err() == nil {
+					log.Printf("idempotency purge error: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// claim занимает ключ для запроса; ключ с истёкшим TTL или брошенный упавшей репликой
+// (Lease истёк, ответа нет) занимается заново. false — ключ занят, ответ решает replay.
+func (m *Middleware) claim(ctx context.Context, key, scope, hash string) (bool, error) {
+	tag, err := m.Pool.Exec(ctx, `INSERT INTO idempotency_keys(key, scope, request_hash, locked_until, expires_at)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4), now() + make_interval(secs => $5))
+		ON CONFLICT (key, scope) DO UPDATE SET
+			request_hash=EXCLUDED.request_hash, status=NULL, headers=NULL, body=NULL,
+			locked_until=EXCLUDED.locked_until, expires_at=EXCLUDED.expires_at, created_at=now()
+		WHERE idempotency_keys.expires_at < now()
+			OR (idempotency_keys.status IS NULL AND idempotency_keys.locked_until < now())`,
+		key, scope, hash, m.Config.Lease.Seconds(), m.Config.TTL.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// replay отвечает на повтор занятого ключа: сохранённый ответ, 409 или 422.
+func (m *Middleware) replay(ctx context.Context, w http.ResponseWriter, key, scope, hash string) {
+	var (
+		storedHash string
+		status     *int
+		header     http.Header
+		body       []byte
+	)
+	err := m.Pool.QueryRow(ctx, `SELECT request_hash, status, headers, body FROM idempotency_keys
+		WHERE key=$1 AND scope=$2`, key, scope).Scan(&storedHash, &status, &header, &body)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// Ключ удалили по TTL между claim и чтением; повтор может занять его заново.
+		m.Metrics.Requests.WithLabelValues("in_flight").Inc()
+		writeError(w, http.StatusConflict, "request with this idempotency key is in progress")
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	case storedHash != hash:
+		m.Metrics.Requests.WithLabelValues("mismatch").Inc()
+		writeError(w, http.StatusUnprocessableEntity, "idempotency key was used with a different request")
+	case status == nil:
+		m.Metrics.Requests.WithLabelValues("in_flight").Inc()
+		writeError(w, http.StatusConflict, "request with this idempotency key is in progress")
+	default:
+		m.Metrics.Requests.WithLabelValues("replayed").Inc()
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Header().Set(ReplayedHeader, "true")
+		w.WriteHeader(*status)
+		_, _ = w.Write(body)
+	}
+}
+
+// complete сохраняет ответ. Запрос клиента к этому моменту мог быть отменён, поэтому
+// запись идёт в собственном контексте.
+func (m *Middleware) complete(key, scope string, rec *recorder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := rec.header.Clone()
+	for _, name := range unstoredHeaders {
+		header.Del(name)
+	}
+	_, err := m.Pool.Exec(ctx, `UPDATE idempotency_keys SET status=$3, headers=$4, body=$5
+		WHERE key=$1 AND scope=$2`, key, scope, rec.status, header, rec.body.Bytes())
+	return err
+}
+
+// unstoredHeaders выставляет сервер при каждом ответе заново; остальные заголовки повторяются как есть.
+var unstoredHeaders = []string{"Date", "Content-Length", "Connection", "Transfer-Encoding"}
+
+// fingerprint — отпечаток запроса: метод, путь с query и тело.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder передаёт ответ клиенту и копирует код, заголовки (на момент отправки) и тело для сохранения.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": msg})
+}
@@ -0,0 +1,182 @@
+package idempotency_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/idempotency"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// Метрики регистрируются в глобальном реестре один раз на пакет.
+var testMetrics = metrics.NewIdempotencyMetrics("idempotency_test")
+
+var testConfig = idempotency.Config{TTL: time.Hour, Lease: time.Minute}
+
+// testPool подключается к IDEMPOTENCY_TEST_DATABASE_URL и готовит пустую idempotency_keys
+// по схеме order-service. Таблица очищается, поэтому переменная должна указывать на тестовую базу.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("IDEMPOTENCY_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("IDEMPOTENCY_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	schema, err := os.ReadFile("../../deploy/sql/order.sql")
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, string(schema)); err != nil {
+		t.Fatalf("apply schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `TRUNCATE idempotency_keys`); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	return pool
+}
+
+// serve выполняет запрос с ключом key через h.
+func serve(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader(body))
+	r.Header.Set(idempotency.Header, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// created — обработчик checkout: считает вызовы и отвечает 201 с заголовком и телом.
+func created(calls *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/orders/o-1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"order_id":"o-1","call":%d}`, n)
+	})
+}
+
+func TestReplaysStoredResponse(t *testing.T) {
+	pool := testPool(t)
+	var calls atomic.Int32
+	h := idempotency.New(pool, testConfig, testMetrics).Wrap(created(&calls))
+
+	first := serve(h, "k-1", `{"items":1}`)
+	second := serve(h, "k-1", `{"items":1}`)
+
+	if calls.Load() != 1 {
+		t.Fatalf("handler called %d times, want 1", calls.Load())
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	for _, name := range []string{"Content-Type", "Location"} {
+		if got, want := second.Header().Get(name), first.Header().Get(name); got != want {
+			t.Errorf("replayed %s = %q, want %q", name, got, want)
+		}
+	}
+	if second.Header().Get(idempotency.ReplayedHeader) != "true" || first.Header().Get(idempotency.ReplayedHeader) != "" {
+		t.Errorf("%s: first %q, second %q", idempotency.ReplayedHeader,
+			first.Header().Get(idempotency.ReplayedHeader), second.Header().Get(idempotency.ReplayedHeader))
+	}
+}
+
+func TestConflictWhileFirstRequestInFlight(t *testing.T) {
+	pool := testPool(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	h := idempotency.New(pool, testConfig, testMetrics).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h, "k-1", `{}`) }()
+	<-started
+	if got := serve(h, "k-1", `{}`).Code; got != http.StatusConflict {
+		t.Errorf("retry while in flight = %d, want 409", got)
+	}
+	close(release)
+	if got := (<-done).Code; got != http.StatusCreated {
+		t.Fatalf("first request = %d, want 201", got)
+	}
+	if got := serve(h, "k-1", `{}`).Code; got != http.StatusCreated {
+		t.Fatalf("retry after completion = %d, want replayed 201", got)
+	}
+}
+
+func TestRejectsKeyReusedWithDifferentRequest(t *testing.T) {
+	pool := testPool(t)
+	var calls atomic.Int32
+	h := idempotency.New(pool, testConfig, testMetrics).Wrap(created(&calls))
+
+	serve(h, "k-1", `{"items":1}`)
+	if got := serve(h, "k-1", `{"items":2}`).Code; got != http.StatusUnprocessableEntity {
+		t.Fatalf("different body = %d, want 422", got)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("handler called %d times, want 1", calls.Load())
+	}
+}
+
+func TestReclaimsAbandonedAndExpiredKeys(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	var calls atomic.Int32
+	h := idempotency.New(pool, testConfig, testMetrics).Wrap(created(&calls))
+
+	// Реплика заняла ключ и упала: ответа нет, аренда истекла.
+	if _, err := pool.Exec(ctx, `INSERT INTO idempotency_keys(key, scope, request_hash, locked_until, expires_at)
+		VALUES ('k-1', 'POST /checkout', 'stale', now() - interval '1 second', now() + interval '1 hour')`); err != nil {
+		t.Fatalf("insert abandoned key: %v", err)
+	}
+	if got := serve(h, "k-1", `{}`).Code; got != http.StatusCreated || calls.Load() != 1 {
+		t.Fatalf("abandoned key: status %d, calls %d, want 201 and 1 call", got, calls.Load())
+	}
+
+	// Сохранённый ответ пережил TTL: запрос выполняется заново.
+	if _, err := pool.Exec(ctx, `UPDATE idempotency_keys SET expires_at = now() - interval '1 second'`); err != nil {
+		t.Fatalf("expire key: %v", err)
+	}
+	if got := serve(h, "k-1", `{}`); got.Code != http.StatusCreated || got.Header().Get(idempotency.ReplayedHeader) != "" || calls.Load() != 2 {
+		t.Fatalf("expired key: status %d, calls %d, want fresh 201 and 2 calls", got.Code, calls.Load())
+	}
+}
+
+func TestPanicIsStoredAsServerError(t *testing.T) {
+	pool := testPool(t)
+	var calls atomic.Int32
+	h := idempotency.New(pool, testConfig, testMetrics).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		panic("order written, response lost")
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was not propagated to net/http")
+			}
+		}()
+		serve(h, "k-1", `{}`)
+	}()
+	got := serve(h, "k-1", `{}`)
+	if got.Code != http.StatusInternalServerError || got.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Fatalf("retry after panic = %d (replayed %q), want stored 500", got.Code, got.Header().Get(idempotency.ReplayedHeader))
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("handler called %d times, want 1", calls.Load())
+	}
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Admin — брокер, который создаёт топики явно. Redis Streams и память создают их при первой записи.
+type Admin interface {
+	EnsureTopics(ctx context.Context, topics map[string]int) error
+}
+
+// EnsureTopics создаёт недостающие топики (имя → число партиций) и добавляет партиции тем,
+// у которых их меньше. Для брокеров без Admin ничего не делает.
+func EnsureTopics(ctx context.Context, b Broker, topics map[string]int) error {
+	if a, ok := b.(Admin); ok {
+		return a.EnsureTopics(ctx, topics)
+	}
+	return nil
+}
+
+// EnsureTopics для Kafka: метаданные без автосоздания, затем CreateTopics и CreatePartitions.
+// Гонку с другой репликой, создавшей топик или партиции раньше, считает успехом. Партиции только
+// добавляются: после этого ключ может попасть в другую партицию, и порядок событий заказа,
+// начатого до расширения, не гарантируется.
+func (c *Client) EnsureTopics(ctx context.Context, topics map[string]int) error {
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	admin := &kafka.Client{Addr: kafka.TCP(c.Brokers...), Timeout: 10 * time.Second}
+	meta, err := admin.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]int, len(meta.Topics))
+	for _, t := range meta.Topics {
+		if t.Error == nil {
+			existing[t.Name] = len(t.Partitions)
+		}
+	}
+
+	var create []kafka.TopicConfig
+	var grow []kafka.TopicPartitionsConfig
+	for _, name := range names {
+		n, ok := existing[name]
+		switch {
+		case !ok:
+			create = append(create, kafka.TopicConfig{Topic: name, NumPartitions: topics[name], ReplicationFactor: c.ReplicationFactor})
+		case n < topics[name]:
+			grow = append(grow, kafka.TopicPartitionsConfig{Name: name, Count: int32(topics[name])})
+		}
+	}
+	if len(create) > 0 {
+		res, err := admin.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: create})
+		if err != nil {
+			return err
+		}
+		for name, err := range res.Errors {
+			if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+				return fmt.Errorf("create topic %s: %w", name, err)
+			}
+		}
+	}
+	if len(grow) > 0 {
+		res, err := admin.CreatePartitions(ctx, &kafka.CreatePartitionsRequest{Topics: grow})
+		if err != nil {
+			return err
+		}
+		for name, err := range res.Errors {
+			if err != nil && !errors.Is(err, kafka.InvalidPartitionNumber) {
+				return fmt.Errorf("create partitions %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
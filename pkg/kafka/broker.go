@@ -0,0 +1,161 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header — заголовок сообщения.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message — сообщение брокера. Partition, Offset и HighWaterMark заполняют брокеры с партициями
+// (Kafka, память); ID — идентификатор записи там, где он не числовой (Redis Streams).
+type Message struct {
+	Topic         string
+	Partition     int
+	Offset        int64
+	HighWaterMark int64
+	ID            string
+	Key           []byte
+	Value         []byte
+	Headers       []Header
+	Time          time.Time
+}
+
+// HeaderMap — заголовки словарём; при повторе ключа остаётся последнее значение.
+func (m Message) HeaderMap() map[string]string {
+	out := make(map[string]string, len(m.Headers))
+	for _, h := range m.Headers {
+		out[h.Key] = string(h.Value)
+	}
+	return out
+}
+
+// Broker — транспорт событий: публикация с ключом и заголовками и чтение в consumer group
+// с подтверждением (Ack). Реализации: Kafka (Client), Redis Streams (Redis), память (Memory).
+type Broker interface {
+	// Publisher возвращает отправителя в topic; batchSize и linger — размер пачки
+	// и ожидание её добора там, где брокер копит пачки.
+	Publisher(topic string, batchSize int, linger time.Duration) Publisher
+	// Subscribe подписывает group на topic. Неподтверждённые сообщения группы
+	// доставляются повторно (at-least-once).
+	Subscribe(topic, group string) Subscription
+	Close() error
+}
+
+// Publisher отправляет сообщения с сохранением порядка внутри ключа. При частичной ошибке
+// Publish возвращает WriteErrors (по ошибке на сообщение, nil — отправлено) или
+// MessageTooLargeError (ничего не отправлено).
+type Publisher interface {
+	Publish(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// Subscription — чтение topic в consumer group. Ack подтверждает сообщение и все предыдущие
+// в его партиции, поэтому сообщения подтверждаются в порядке получения.
+type Subscription interface {
+	Fetch(ctx context.Context) (Message, error)
+	Ack(ctx context.Context, msg Message) error
+	Close() error
+}
+
+// Publishers — отправители брокера по топикам с общими batchSize и linger; отправитель топика
+// создаётся при первой записи в него.
+type Publishers struct {
+	Broker    Broker
+	BatchSize int
+	Linger    time.Duration
+
+	mu   sync.Mutex
+	pubs map[string]Publisher
+}
+
+func NewPublishers(b Broker, batchSize int, linger time.Duration) *Publishers {
+	return &Publishers{Broker: b, BatchSize: batchSize, Linger: linger, pubs: map[string]Publisher{}}
+}
+
+func (p *Publishers) Topic(topic string) Publisher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pub, ok := p.pubs[topic]
+	if !ok {
+		pub = p.Broker.Publisher(topic, p.BatchSize, p.Linger)
+		p.pubs[topic] = pub
+	}
+	return pub
+}
+
+// Close закрывает всех отправителей и возвращает первую ошибку.
+func (p *Publishers) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var first error
+	for topic, pub := range p.pubs {
+		if err := pub.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(p.pubs, topic)
+	}
+	return first
+}
+
+// WriteErrors — ошибки публикации по сообщениям пачки в порядке отправки; nil — сообщение отправлено.
+type WriteErrors []error
+
+func (e WriteErrors) Error() string {
+	n := 0
+	for _, err := range e {
+		if err != nil {
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d messages failed", n, len(e))
+}
+
+// MessageTooLargeError — сообщение превышает лимит брокера; пачка не отправлялась.
+type MessageTooLargeError struct {
+	Message Message
+}
+
+func (e MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message at key %q is too large (%d bytes)", e.Message.Key, len(e.Message.Value))
+}
+
+// Config — выбор транспорта; сервисы заполняют его из BROKER, KAFKA_BROKERS и REDIS_ADDR.
+type Config struct {
+	Kind      string // BROKER: kafka (по умолчанию), redis, memory
+	Brokers   string // KAFKA_BROKERS, через запятую
+	RedisAddr string // REDIS_ADDR, host:port
+}
+
+// Enabled — транспорт настроен: для kafka заданы брокеры, для redis — адрес; память доступна всегда.
+func (c Config) Enabled() bool {
+	switch strings.ToLower(c.Kind) {
+	case "redis":
+		return c.RedisAddr != ""
+	case "memory":
+		return true
+	default:
+		return NewClient(c.Brokers).Enabled()
+	}
+}
+
+// Open создаёт брокер по конфигурации. memory живёт внутри процесса: события не покидают сервис.
+func Open(cfg Config) (Broker, error) {
+	switch strings.ToLower(cfg.Kind) {
+	case "", "kafka":
+		return NewClient(cfg.Brokers), nil
+	case "redis":
+		return NewRedis(cfg.RedisAddr), nil
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown broker %q", cfg.Kind)
+	}
+}
@@ -0,0 +1,204 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// Заголовки сообщения в DLQ: причина и исходная позиция.
+const (
+	HeaderError             = "x-error"
+	HeaderErrorAttempts     = "x-error-attempts"
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderFailedAt          = "x-failed-at"
+)
+
+// Handler обрабатывает одно сообщение. Ошибка — повторить; Permanent(err) — сразу в DLQ.
+type Handler func(ctx context.Context, msg Message) error
+
+// ConsumerConfig — политика повторов; сервисы заполняют её из KAFKA_CONSUMER_*.
+type ConsumerConfig struct {
+	MaxAttempts int           // KAFKA_CONSUMER_MAX_ATTEMPTS, попыток обработки до DLQ
+	Backoff     time.Duration // KAFKA_CONSUMER_BACKOFF_MS, пауза после первой ошибки, далее удваивается
+	MaxBackoff  time.Duration // KAFKA_CONSUMER_MAX_BACKOFF_MS
+}
+
+// minBackoff — нижняя граница паузы между попытками: с нулевым KAFKA_CONSUMER_BACKOFF_MS
+// повторы обработчика и записи в DLQ шли бы без пауз и грузили бы базу и брокер.
+const minBackoff = 10 * time.Millisecond
+
+// backoffs возвращает первую паузу и её потолок: не меньше minBackoff и не меньше первой паузы.
+func (cfg ConsumerConfig) backoffs() (first, limit time.Duration) {
+	first = max(cfg.Backoff, minBackoff)
+	return first, max(cfg.MaxBackoff, first)
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent помечает ошибку как неисправимую повтором (например, нечитаемое сообщение).
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Consumer читает топик в consumer group с подтверждением только после обработки
+// (at-least-once): сообщение, которое обработчик так и не принял за MaxAttempts попыток,
+// уходит в <topic>.dlq с заголовками ошибки, и только после этого подтверждается.
+// Сообщения обрабатываются по одному, поэтому порядок внутри партиции сохраняется.
+type Consumer struct {
+	Topic   string
+	Sub     Subscription
+	DLQ     Publisher
+	Config  ConsumerConfig
+	Handler Handler
+	Metrics *metrics.ConsumerMetrics
+}
+
+// NewConsumer создаёт потребителя topic в группе groupID с DLQ-топиком topic + ".dlq".
+func NewConsumer(b Broker, topic, groupID string, cfg ConsumerConfig, h Handler, m *metrics.ConsumerMetrics) *Consumer {
+	return &Consumer{
+		Topic:   topic,
+		Sub:     b.Subscribe(topic, groupID),
+		DLQ:     b.Publisher(topic+".dlq", 1, 0),
+		Config:  cfg,
+		Handler: h,
+		Metrics: m,
+	}
+}
+
+// Consume читает topics в группе groupID — по Consumer на топик — и возвращается после отмены ctx.
+// Порядок сохраняется внутри партиции каждого топика; h вызывается конкурентно из разных топиков.
+func Consume(ctx context.Context, b Broker, topics []string, groupID string, cfg ConsumerConfig, h Handler, m *metrics.ConsumerMetrics) {
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		wg.Add(1)
+		go func(c *Consumer) {
+			defer wg.Done()
+			c.Run(ctx)
+		}(NewConsumer(b, topic, groupID, cfg, h, m))
+	}
+	wg.Wait()
+}
+
+// Run обрабатывает сообщения до отмены ctx, затем закрывает подписку и отправителя DLQ.
+func (c *Consumer) Run(ctx context.Context) {
+	defer c.Sub.Close()
+	defer c.DLQ.Close()
+	for {
+		msg, err := c.Sub.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("broker fetch error: %v", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		if msg.HighWaterMark > 0 {
+			// Лаг известен только брокерам со смещениями; для Redis Streams метрика не заполняется.
+			c.Metrics.Lag.WithLabelValues(c.Topic, strconv.Itoa(msg.Partition)).Set(float64(msg.HighWaterMark - msg.Offset - 1))
+		}
+
+		outcome := "ok"
+		if attempts, err := c.handle(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := c.deadLetter(ctx, msg, attempts, err); err != nil {
+				// Отмена ctx: сообщение не подтверждаем, оно придёт снова.
+				return
+			}
+			outcome = "dlq"
+		}
+		if err := c.Sub.Ack(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Сообщение придёт повторно после ребалансировки; дубль отсекает inbox.
+			log.Printf("broker ack error: %v", err)
+		}
+		c.Metrics.Messages.WithLabelValues(c.Topic, outcome).Inc()
+	}
+}
+
+// handle вызывает обработчик с повторами и возвращает число попыток и последнюю ошибку.
+func (c *Consumer) handle(ctx context.Context, msg Message) (int, error) {
+	backoff, limit := c.Config.backoffs()
+	for attempt := 1; ; attempt++ {
+		err := c.Handler(ctx, msg)
+		if err == nil {
+			return attempt, nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) || attempt >= c.Config.MaxAttempts || ctx.Err() != nil {
+			return attempt, err
+		}
+		log.Printf("handler error %s (attempt %d): %v", position(msg), attempt, err)
+		c.Metrics.Retries.WithLabelValues(msg.Topic).Inc()
+		if !sleep(ctx, backoff) {
+			return attempt, ctx.Err()
+		}
+		backoff = min(2*backoff, limit)
+	}
+}
+
+// deadLetter публикует сообщение в DLQ, повторяя запись до успеха или отмены ctx:
+// без этого сообщение нельзя подтвердить.
+func (c *Consumer) deadLetter(ctx context.Context, msg Message, attempts int, cause error) error {
+	log.Printf("message %s moved to %s.dlq after %d attempts: %v", position(msg), c.Topic, attempts, cause)
+	offset := msg.ID
+	if offset == "" {
+		offset = strconv.FormatInt(msg.Offset, 10)
+	}
+	headers := append([]Header{}, msg.Headers...)
+	headers = append(headers,
+		Header{Key: HeaderError, Value: []byte(cause.Error())},
+		Header{Key: HeaderErrorAttempts, Value: []byte(strconv.Itoa(attempts))},
+		Header{Key: HeaderOriginalTopic, Value: []byte(msg.Topic)},
+		Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		Header{Key: HeaderOriginalOffset, Value: []byte(offset)},
+		Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+	dead := Message{Key: msg.Key, Value: msg.Value, Headers: headers, Time: time.Now().UTC()}
+	backoff, limit := c.Config.backoffs()
+	for {
+		err := c.DLQ.Publish(ctx, dead)
+		if err == nil {
+			return nil
+		}
+		log.Printf("dlq publish error: %v", err)
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, limit)
+	}
+}
+
+// position — позиция сообщения для логов: topic/partition@offset, для Redis Streams — topic@id.
+func position(msg Message) string {
+	if msg.ID != "" {
+		return msg.Topic + "@" + msg.ID
+	}
+	return msg.Topic + "/" + strconv.Itoa(msg.Partition) + "@" + strconv.FormatInt(msg.Offset, 10)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
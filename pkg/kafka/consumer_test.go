@@ -0,0 +1,282 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// Метрики регистрируются в глобальном реестре один раз на пакет.
+var testMetrics = metrics.NewConsumerMetrics("kafka_test")
+
+var testConfig = ConsumerConfig{MaxAttempts: 3, Backoff: minBackoff, MaxBackoff: 2 * minBackoff}
+
+// committed — подтверждённое смещение группы в брокере-памяти.
+func committed(b *Memory, topic, group string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.topic(topic).groups[group]
+	if !ok {
+		return 0
+	}
+	return g.committed
+}
+
+func publish(t *testing.T, b Broker, topic string, msgs ...Message) {
+	t.Helper()
+	if err := b.Publisher(topic, 1, 0).Publish(context.Background(), msgs...); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+}
+
+// consume запускает Consumer в фоне; stop отменяет его и ждёт возврата.
+func consume(b Broker, topic, group string, h Handler) (stop func()) {
+	c := NewConsumer(b, topic, group, testConfig, h, testMetrics)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func wait(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return Message{}
+	}
+}
+
+func header(msg Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestConsumerAcksAfterHandle(t *testing.T) {
+	b := NewMemory()
+	publish(t, b, "orders", Message{Key: []byte("o-1"), Value: []byte("created")})
+
+	handled := make(chan Message, 1)
+	var during int64 = -1
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		during = committed(b, "orders", "g")
+		handled <- msg
+		return nil
+	})
+	wait(t, handled)
+	stop()
+
+	if during != 0 {
+		t.Fatalf("offset committed before handler returned: %d", during)
+	}
+	if got := committed(b, "orders", "g"); got != 1 {
+		t.Fatalf("committed = %d after handle, want 1", got)
+	}
+}
+
+func TestConsumerRedeliversUnackedMessage(t *testing.T) {
+	b := NewMemory()
+	publish(t, b, "orders", Message{Key: []byte("o-1"), Value: []byte("created")})
+
+	// Обработчик не успевает до остановки потребителя: сообщение не подтверждается.
+	started := make(chan Message, 1)
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		started <- msg
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	wait(t, started)
+	stop()
+	if got := committed(b, "orders", "g"); got != 0 {
+		t.Fatalf("committed = %d after interrupted handler, want 0", got)
+	}
+
+	handled := make(chan Message, 1)
+	stop = consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		handled <- msg
+		return nil
+	})
+	defer stop()
+	if msg := wait(t, handled); msg.Offset != 0 || string(msg.Value) != "created" {
+		t.Fatalf("redelivered %s = %q, want offset 0", position(msg), msg.Value)
+	}
+}
+
+func TestConsumerRetriesHandlerError(t *testing.T) {
+	b := NewMemory()
+	publish(t, b, "orders", Message{Key: []byte("o-1"), Value: []byte("created")})
+
+	attempts := 0
+	handled := make(chan Message, 1)
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		attempts++
+		if attempts < testConfig.MaxAttempts {
+			return errors.New("db unavailable")
+		}
+		handled <- msg
+		return nil
+	})
+	wait(t, handled)
+	stop()
+
+	if attempts != testConfig.MaxAttempts {
+		t.Fatalf("attempts = %d, want %d", attempts, testConfig.MaxAttempts)
+	}
+	if got := committed(b, "orders", "g"); got != 1 {
+		t.Fatalf("committed = %d, want 1", got)
+	}
+	b.mu.Lock()
+	n := len(b.topic("orders.dlq").log)
+	b.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d messages in DLQ, want 0", n)
+	}
+}
+
+func TestConsumerDeadLettersAfterMaxAttempts(t *testing.T) {
+	b := NewMemory()
+	publish(t, b, "orders",
+		Message{Key: []byte("o-1"), Value: []byte("broken"), Headers: []Header{{Key: "event_type", Value: []byte("order.created")}}},
+		Message{Key: []byte("o-1"), Value: []byte("next")},
+	)
+
+	var mu sync.Mutex
+	attempts := 0
+	handled := make(chan Message, 1)
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		if string(msg.Value) == "broken" {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			return errors.New("cannot apply")
+		}
+		handled <- msg
+		return nil
+	})
+	dead := make(chan Message, 1)
+	stopDLQ := consume(b, "orders.dlq", "dlq", func(ctx context.Context, msg Message) error {
+		dead <- msg
+		return nil
+	})
+	defer stopDLQ()
+
+	msg := wait(t, dead)
+	if next := wait(t, handled); string(next.Value) != "next" {
+		t.Fatalf("after DLQ handled %q, want next", next.Value)
+	}
+	stop()
+
+	if attempts != testConfig.MaxAttempts {
+		t.Fatalf("attempts = %d, want %d", attempts, testConfig.MaxAttempts)
+	}
+	want := map[string]string{
+		"event_type":         "order.created",
+		HeaderError:          "cannot apply",
+		HeaderErrorAttempts:  fmt.Sprint(testConfig.MaxAttempts),
+		HeaderOriginalTopic:  "orders",
+		HeaderOriginalOffset: "0",
+	}
+	for k, v := range want {
+		if got := header(msg, k); got != v {
+			t.Errorf("DLQ header %s = %q, want %q", k, got, v)
+		}
+	}
+	if string(msg.Key) != "o-1" || string(msg.Value) != "broken" {
+		t.Errorf("DLQ message %q/%q, want o-1/broken", msg.Key, msg.Value)
+	}
+	if got := committed(b, "orders", "g"); got != 2 {
+		t.Fatalf("committed = %d, want 2", got)
+	}
+}
+
+func TestConsumerPermanentErrorSkipsRetries(t *testing.T) {
+	b := NewMemory()
+	publish(t, b, "orders", Message{Key: []byte("o-1"), Value: []byte("{")})
+
+	attempts := 0
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		attempts++
+		return Permanent(errors.New("malformed payload"))
+	})
+	dead := make(chan Message, 1)
+	stopDLQ := consume(b, "orders.dlq", "dlq", func(ctx context.Context, msg Message) error {
+		dead <- msg
+		return nil
+	})
+	defer stopDLQ()
+
+	msg := wait(t, dead)
+	stop()
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+	if got := header(msg, HeaderErrorAttempts); got != "1" {
+		t.Fatalf("%s = %q, want 1", HeaderErrorAttempts, got)
+	}
+}
+
+func TestConsumerPreservesKeyOrder(t *testing.T) {
+	b := NewMemory()
+	var msgs []Message
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("o-%d", i%3)
+		msgs = append(msgs, Message{Key: []byte(key), Value: []byte(fmt.Sprint(i))})
+	}
+	publish(t, b, "orders", msgs...)
+
+	// Ошибка на каждом втором сообщении: повтор не должен пропустить вперёд следующее того же ключа.
+	failed := map[string]bool{}
+	got := map[string][]string{}
+	handled := make(chan Message, len(msgs))
+	stop := consume(b, "orders", "g", func(ctx context.Context, msg Message) error {
+		v := string(msg.Value)
+		if msg.Offset%2 == 0 && !failed[v] {
+			failed[v] = true
+			return errors.New("transient")
+		}
+		got[string(msg.Key)] = append(got[string(msg.Key)], v)
+		handled <- msg
+		return nil
+	})
+	for range msgs {
+		wait(t, handled)
+	}
+	stop()
+
+	for i, msg := range msgs {
+		key := string(msg.Key)
+		want := fmt.Sprint(i)
+		if len(got[key]) == 0 || got[key][0] != want {
+			t.Fatalf("key %s: got %v, next expected %s", key, got[key], want)
+		}
+		got[key] = got[key][1:]
+	}
+}
+
+func TestConsumerConfigBackoffFloor(t *testing.T) {
+	first, limit := ConsumerConfig{}.backoffs()
+	if first != minBackoff || limit != minBackoff {
+		t.Fatalf("zero config backoffs = %v, %v, want %v", first, limit, minBackoff)
+	}
+	first, limit = ConsumerConfig{Backoff: time.Second, MaxBackoff: time.Millisecond}.backoffs()
+	if first != time.Second || limit != time.Second {
+		t.Fatalf("backoffs = %v, %v, want max not below first", first, limit)
+	}
+}
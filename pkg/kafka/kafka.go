@@ -11,7 +11,8 @@ import (
 )
 
 type Client struct {
-	Brokers []string
+	Brokers           []string
+	ReplicationFactor int // для топиков, создаваемых EnsureTopics
 }
 
 func NewClient(brokersCSV string) *Client {
@@ -22,7 +23,7 @@ func NewClient(brokersCSV string) *Client {
 			brokers = append(brokers, b)
 		}
 	}
-	return &Client{Brokers: brokers}
+	return &Client{Brokers: brokers, ReplicationFactor: 1}
 }
 
 func (c *Client) Enabled() bool {
@@ -38,6 +39,15 @@ func (c *Client) NewWriter(topic string) *kafka.Writer {
 	}
 }
 
+// NewBatchWriter — writer для relay: пачка до size сообщений на партицию уходит одним запросом,
+// неполная ждёт добора не дольше linger (у kafka-go по умолчанию 100 сообщений и 1s).
+func (c *Client) NewBatchWriter(topic string, size int, linger time.Duration) *kafka.Writer {
+	w := c.NewWriter(topic)
+	w.BatchSize = size
+	w.BatchTimeout = linger
+	return w
+}
+
 func (c *Client) NewReader(topic, groupID string) *kafka.Reader {
 	return kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  c.Brokers,
@@ -57,3 +67,89 @@ func PublishJSON(ctx context.Context, writer *kafka.Writer, key string, payload
 }
 
 var ErrDisabled = errors.New("kafka disabled")
+
+// Client реализует Broker поверх Kafka: ключ задаёт партицию (Hash), Ack фиксирует смещение группы.
+
+func (c *Client) Publisher(topic string, batchSize int, linger time.Duration) Publisher {
+	w := c.NewBatchWriter(topic, batchSize, linger)
+	w.AllowAutoTopicCreation = true
+	return &kafkaPublisher{w: w}
+}
+
+func (c *Client) Subscribe(topic, group string) Subscription {
+	return &kafkaSubscription{r: c.NewReader(topic, group)}
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	out := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		out[i] = kafka.Message{Key: m.Key, Value: m.Value, Headers: toKafkaHeaders(m.Headers), Time: m.Time}
+	}
+	err := p.w.WriteMessages(ctx, out...)
+	var werrs kafka.WriteErrors
+	if errors.As(err, &werrs) {
+		return WriteErrors(werrs)
+	}
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return MessageTooLargeError{Message: fromKafkaMessage(tooLarge.Message)}
+	}
+	return err
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.w.Close()
+}
+
+type kafkaSubscription struct {
+	r *kafka.Reader
+}
+
+func (s *kafkaSubscription) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.r.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return fromKafkaMessage(msg), nil
+}
+
+func (s *kafkaSubscription) Ack(ctx context.Context, msg Message) error {
+	return s.r.CommitMessages(ctx, kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+}
+
+func (s *kafkaSubscription) Close() error {
+	return s.r.Close()
+}
+
+func fromKafkaMessage(m kafka.Message) Message {
+	headers := make([]Header, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = Header{Key: h.Key, Value: h.Value}
+	}
+	return Message{
+		Topic:         m.Topic,
+		Partition:     m.Partition,
+		Offset:        m.Offset,
+		HighWaterMark: m.HighWaterMark,
+		Key:           m.Key,
+		Value:         m.Value,
+		Headers:       headers,
+		Time:          m.Time,
+	}
+}
+
+func toKafkaHeaders(headers []Header) []kafka.Header {
+	out := make([]kafka.Header, len(headers))
+	for i, h := range headers {
+		out[i] = kafka.Header{Key: h.Key, Value: h.Value}
+	}
+	return out
+}
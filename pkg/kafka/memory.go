@@ -0,0 +1,161 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("broker closed")
+
+// Memory — брокер внутри процесса: у каждого топика одна партиция-лог, у группы — позиция
+// чтения и подтверждённое смещение. Нужен для бенчмарков без сетевого транспорта
+// и герметичных тестов; сообщения не переживают перезапуск.
+type Memory struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+	closed bool
+}
+
+type memoryTopic struct {
+	log    []Message
+	groups map[string]*memoryGroup
+	// wake закрывается при публикации и заменяется новым: так будятся все ждущие Fetch.
+	wake chan struct{}
+}
+
+type memoryGroup struct {
+	next      int64 // следующее смещение к выдаче
+	committed int64 // всё до committed подтверждено
+	subs      int
+}
+
+func NewMemory() *Memory {
+	return &Memory{topics: map[string]*memoryTopic{}}
+}
+
+func (b *Memory) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{groups: map[string]*memoryGroup{}, wake: make(chan struct{})}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *Memory) Publisher(topic string, batchSize int, linger time.Duration) Publisher {
+	return &memoryPublisher{b: b, topic: topic}
+}
+
+// Subscribe присоединяет подписку к группе. Первая подписка группы начинает с подтверждённого
+// смещения — так неподтверждённые сообщения доставляются повторно, как после ребалансировки Kafka.
+func (b *Memory) Subscribe(topic, group string) Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.topic(topic)
+	g, ok := t.groups[group]
+	if !ok {
+		g = &memoryGroup{}
+		t.groups[group] = g
+	}
+	if g.subs == 0 {
+		g.next = g.committed
+	}
+	g.subs++
+	return &memorySubscription{b: b, topic: topic, group: g}
+}
+
+// Close будит ждущие Fetch; они возвращают ошибку.
+func (b *Memory) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, t := range b.topics {
+		close(t.wake)
+		t.wake = make(chan struct{})
+	}
+	return nil
+}
+
+type memoryPublisher struct {
+	b     *Memory
+	topic string
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+	if p.b.closed {
+		return errClosed
+	}
+	t := p.b.topic(p.topic)
+	for _, m := range msgs {
+		m.Topic = p.topic
+		m.Offset = int64(len(t.log))
+		if m.Time.IsZero() {
+			m.Time = time.Now().UTC()
+		}
+		t.log = append(t.log, m)
+	}
+	close(t.wake)
+	t.wake = make(chan struct{})
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+type memorySubscription struct {
+	b      *Memory
+	topic  string
+	group  *memoryGroup
+	closed bool
+}
+
+func (s *memorySubscription) Fetch(ctx context.Context) (Message, error) {
+	for {
+		s.b.mu.Lock()
+		if s.b.closed || s.closed {
+			s.b.mu.Unlock()
+			return Message{}, errClosed
+		}
+		t := s.b.topic(s.topic)
+		if s.group.next < int64(len(t.log)) {
+			msg := t.log[s.group.next]
+			msg.HighWaterMark = int64(len(t.log))
+			s.group.next++
+			s.b.mu.Unlock()
+			return msg, nil
+		}
+		wake := t.wake
+		s.b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (s *memorySubscription) Ack(ctx context.Context, msg Message) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.group.committed = max(s.group.committed, msg.Offset+1)
+	return nil
+}
+
+func (s *memorySubscription) Close() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.group.subs--
+	}
+	return nil
+}
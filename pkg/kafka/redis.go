@@ -0,0 +1,301 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Поля записи Redis Stream: ключ, тело, время публикации и заголовки с префиксом "h:".
+const (
+	redisFieldKey    = "key"
+	redisFieldValue  = "value"
+	redisFieldTime   = "time"
+	redisHeaderField = "h:"
+)
+
+// Redis — брокер на Redis Streams: topic — stream, публикация — XADD, consumer group —
+// XGROUP/XREADGROUP, Ack — XACK. Партиций нет, поэтому порядок общий для всего stream.
+// После рестарта подписка сначала дочитывает свои неподтверждённые записи, а записи упавших
+// потребителей группы, простаивающие дольше ClaimIdle, забирает XAUTOCLAIM (Redis 6.2+).
+type Redis struct {
+	Addr      string
+	Consumer  string        // имя потребителя в группе, по умолчанию hostname-pid
+	Block     time.Duration // сколько XREADGROUP ждёт новых записей
+	ClaimIdle time.Duration
+	Timeout   time.Duration // таймаут команды, если у ctx нет дедлайна
+}
+
+func NewRedis(addr string) *Redis {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "consumer"
+	}
+	return &Redis{
+		Addr:      addr,
+		Consumer:  fmt.Sprintf("%s-%d", host, os.Getpid()),
+		Block:     time.Second,
+		ClaimIdle: 30 * time.Second,
+		Timeout:   5 * time.Second,
+	}
+}
+
+// Publisher — XADD каждой записи; пачка уходит конвейером за один сетевой обмен.
+func (b *Redis) Publisher(topic string, batchSize int, linger time.Duration) Publisher {
+	return &redisPublisher{b: b, stream: topic}
+}
+
+func (b *Redis) Subscribe(topic, group string) Subscription {
+	return &redisSubscription{b: b, stream: topic, group: group}
+}
+
+func (b *Redis) Close() error {
+	return nil
+}
+
+func (b *Redis) deadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(b.Timeout)
+}
+
+type redisPublisher struct {
+	b      *Redis
+	stream string
+
+	mu   sync.Mutex
+	conn *respConn
+}
+
+func (p *redisPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		conn, err := dialRESP(ctx, p.b.Addr)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	for _, m := range msgs {
+		args := []any{"XADD", p.stream, "*", redisFieldKey, m.Key, redisFieldValue, m.Value}
+		if !m.Time.IsZero() {
+			args = append(args, redisFieldTime, m.Time.UnixNano())
+		}
+		for _, h := range m.Headers {
+			args = append(args, redisHeaderField+h.Key, h.Value)
+		}
+		p.conn.send(args...)
+	}
+	if err := p.conn.flush(p.b.deadline(ctx)); err != nil {
+		p.reset()
+		return err
+	}
+	errs := make(WriteErrors, len(msgs))
+	failed := false
+	for i := range msgs {
+		reply, err := p.conn.read()
+		if err != nil {
+			// Часть записей могла уйти: пачка будет опубликована повторно, дубли отсечёт inbox.
+			p.reset()
+			return err
+		}
+		if rerr, ok := reply.(redisError); ok {
+			errs[i] = rerr
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (p *redisPublisher) reset() {
+	_ = p.conn.Close()
+	p.conn = nil
+}
+
+func (p *redisPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.reset()
+	}
+	return nil
+}
+
+type redisSubscription struct {
+	b      *Redis
+	stream string
+	group  string
+
+	mu      sync.Mutex
+	conn    *respConn
+	ready   bool // группа создана
+	backlog bool // дочитываем свои неподтверждённые записи
+	claimed time.Time
+	buf     []Message
+}
+
+func (s *redisSubscription) Fetch(ctx context.Context) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 {
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		if err := s.poll(ctx); err != nil {
+			if _, ok := err.(redisError); ok {
+				if strings.HasPrefix(err.Error(), "NOGROUP") {
+					s.ready = false
+				}
+			} else if s.conn != nil {
+				_ = s.conn.Close()
+				s.conn = nil
+			}
+			return Message{}, err
+		}
+	}
+	msg := s.buf[0]
+	s.buf = s.buf[1:]
+	return msg, nil
+}
+
+// poll заполняет buf: свои неподтверждённые, затем зависшие у других потребителей, затем новые.
+func (s *redisSubscription) poll(ctx context.Context) error {
+	if s.conn == nil {
+		conn, err := dialRESP(ctx, s.b.Addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if !s.ready {
+		_, err := s.conn.do(s.b.deadline(ctx), "XGROUP", "CREATE", s.stream, s.group, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		s.ready, s.backlog = true, true
+	}
+	if s.backlog {
+		reply, err := s.conn.do(s.b.deadline(ctx), "XREADGROUP", "GROUP", s.group, s.b.Consumer, "COUNT", 100, "STREAMS", s.stream, "0")
+		if err != nil {
+			return err
+		}
+		if err := s.collect(ctx, streamEntries(reply)); err != nil {
+			return err
+		}
+		s.backlog = len(s.buf) > 0
+		return nil
+	}
+	if time.Since(s.claimed) >= s.b.ClaimIdle {
+		s.claimed = time.Now()
+		reply, err := s.conn.do(s.b.deadline(ctx), "XAUTOCLAIM", s.stream, s.group, s.b.Consumer, s.b.ClaimIdle.Milliseconds(), "0-0", "COUNT", 100)
+		if err != nil {
+			return err
+		}
+		if parts, ok := reply.([]any); ok && len(parts) >= 2 {
+			entries, _ := parts[1].([]any)
+			if err := s.collect(ctx, entries); err != nil {
+				return err
+			}
+		}
+		if len(s.buf) > 0 {
+			return nil
+		}
+	}
+	reply, err := s.conn.do(time.Now().Add(s.b.Block+s.b.Timeout),
+		"XREADGROUP", "GROUP", s.group, s.b.Consumer, "COUNT", 100, "BLOCK", s.b.Block.Milliseconds(), "STREAMS", s.stream, ">")
+	if err != nil {
+		return err
+	}
+	return s.collect(ctx, streamEntries(reply))
+}
+
+// collect разбирает записи stream в buf; удалённые из stream записи (без полей) сразу подтверждает.
+func (s *redisSubscription) collect(ctx context.Context, entries []any) error {
+	for _, e := range entries {
+		entry, ok := e.([]any)
+		if !ok || len(entry) < 2 {
+			continue
+		}
+		id, _ := entry[0].([]byte)
+		fields, _ := entry[1].([]any)
+		if fields == nil {
+			if _, err := s.conn.do(s.b.deadline(ctx), "XACK", s.stream, s.group, id); err != nil {
+				return err
+			}
+			continue
+		}
+		msg := Message{Topic: s.stream, ID: string(id)}
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := fields[i].([]byte)
+			value, _ := fields[i+1].([]byte)
+			switch f := string(name); {
+			case f == redisFieldKey:
+				msg.Key = value
+			case f == redisFieldValue:
+				msg.Value = value
+			case f == redisFieldTime:
+				if ns, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+					msg.Time = time.Unix(0, ns).UTC()
+				}
+			case strings.HasPrefix(f, redisHeaderField):
+				msg.Headers = append(msg.Headers, Header{Key: strings.TrimPrefix(f, redisHeaderField), Value: value})
+			}
+		}
+		s.buf = append(s.buf, msg)
+	}
+	return nil
+}
+
+// streamEntries достаёт записи единственного stream из ответа XREADGROUP.
+func streamEntries(reply any) []any {
+	streams, _ := reply.([]any)
+	if len(streams) == 0 {
+		return nil
+	}
+	stream, _ := streams[0].([]any)
+	if len(stream) < 2 {
+		return nil
+	}
+	entries, _ := stream[1].([]any)
+	return entries
+}
+
+func (s *redisSubscription) Ack(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		// Соединение потеряно после Fetch: запись останется в pending и будет доставлена снова.
+		conn, err := dialRESP(ctx, s.b.Addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	_, err := s.conn.do(s.b.deadline(ctx), "XACK", s.stream, s.group, msg.ID)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			_ = s.conn.Close()
+			s.conn = nil
+		}
+	}
+	return err
+}
+
+func (s *redisSubscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
@@ -34,3 +34,151 @@ func NewServerMetrics(service string) *ServerMetrics {
 func Handler() http.Handler {
 	return promhttp.Handler()
 }
+
+// TwoPCMetrics — метрики координатора 2PC по участникам и фазам.
+type TwoPCMetrics struct {
+	ParticipantLatencyMS *prometheus.HistogramVec
+}
+
+func NewTwoPCMetrics(service string) *TwoPCMetrics {
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "twopc_participant_duration_ms",
+		Help:      "2PC participant call latency per phase in milliseconds (including retries).",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	}, []string{"participant", "phase", "fanout", "outcome"})
+
+	prometheus.MustRegister(latency)
+	return &TwoPCMetrics{ParticipantLatencyMS: latency}
+}
+
+// StockMetrics — метрики конкуренции за остатки в inventory-service по стратегии блокировок.
+type StockMetrics struct {
+	Retries    *prometheus.CounterVec
+	LockWaitMS *prometheus.HistogramVec
+}
+
+func NewStockMetrics(service string) *StockMetrics {
+	retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "stock_reservation_retries_total",
+		Help:      "Stock reservation retries (version conflicts, missed escrow shards, escrow reservations split across shards).",
+	}, []string{"strategy", "reason"})
+	lockWait := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "stock_lock_wait_ms",
+		Help:      "Time spent in the locking statement of a stock reservation in milliseconds.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500},
+	}, []string{"strategy"})
+
+	prometheus.MustRegister(retries, lockWait)
+	return &StockMetrics{Retries: retries, LockWaitMS: lockWait}
+}
+
+// OutboxMetrics — счётчики relay outbox (взято в аренду, опубликовано, не опубликовано,
+// перенесено в outbox_dead) и задержка от вставки записи до публикации.
+type OutboxMetrics struct {
+	Claimed   prometheus.Counter
+	Published prometheus.Counter
+	Failed    prometheus.Counter
+	Dead      prometheus.Counter
+	Purged    prometheus.Counter
+	LagMS     prometheus.Histogram
+}
+
+func NewOutboxMetrics(service string) *OutboxMetrics {
+	claimed := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_claimed_total",
+		Help:      "Outbox records claimed by this relay.",
+	})
+	published := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_published_total",
+		Help:      "Outbox records published to the broker.",
+	})
+	failed := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_failed_total",
+		Help:      "Outbox publish attempts that failed.",
+	})
+	dead := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_dead_total",
+		Help:      "Outbox records moved to outbox_dead after the retry limit.",
+	})
+	purged := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_purged_total",
+		Help:      "Sent outbox records deleted after the retention window.",
+	})
+
+	lag := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "outbox_publish_lag_ms",
+		Help:      "Time from outbox insert (created_at) to publish in milliseconds.",
+		Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
+	})
+
+	prometheus.MustRegister(claimed, published, failed, dead, purged, lag)
+	return &OutboxMetrics{Claimed: claimed, Published: published, Failed: failed, Dead: dead, Purged: purged, LagMS: lag}
+}
+
+// ConsumerMetrics — итоги обработки сообщений потребителем Kafka (ok, dlq), повторы обработчика
+// и отставание группы от конца партиции.
+type ConsumerMetrics struct {
+	Messages *prometheus.CounterVec
+	Retries  *prometheus.CounterVec
+	Lag      *prometheus.GaugeVec
+}
+
+func NewConsumerMetrics(service string) *ConsumerMetrics {
+	messages := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "consumer_messages_total",
+		Help:      "Consumed messages by outcome (ok, dlq).",
+	}, []string{"topic", "outcome"})
+	retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "consumer_retries_total",
+		Help:      "Handler retries after a failed attempt.",
+	}, []string{"topic"})
+	lag := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "consumer_lag",
+		Help:      "Messages between the last fetched offset and the partition high watermark.",
+	}, []string{"topic", "partition"})
+
+	prometheus.MustRegister(messages, retries, lag)
+	return &ConsumerMetrics{Messages: messages, Retries: retries, Lag: lag}
+}
+
+// IdempotencyMetrics — исходы запросов с Idempotency-Key: ответ сохранён, повторён из хранилища
+// или отклонён (запрос ещё выполняется, ключ с другим телом).
+type IdempotencyMetrics struct {
+	Requests *prometheus.CounterVec
+}
+
+func NewIdempotencyMetrics(service string) *IdempotencyMetrics {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txlab",
+		Subsystem: service,
+		Name:      "idempotency_requests_total",
+		Help:      "Requests with an Idempotency-Key by outcome (stored, replayed, in_flight, mismatch).",
+	}, []string{"outcome"})
+
+	prometheus.MustRegister(requests)
+	return &IdempotencyMetrics{Requests: requests}
+}
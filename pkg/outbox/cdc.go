@@ -0,0 +1,443 @@
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CDC-relay (log-tailing): вместо опроса таблицы outbox вставки читаются из слота логической
+// репликации (pgoutput, протокол v1). Слот хранит WAL до подтверждённой позиции, а позиция
+// дублируется в outbox_cdc_offsets, поэтому после рестарта чтение продолжается с последней
+// опубликованной транзакции. Требуется wal_level=logical.
+
+// LSN — позиция в WAL.
+type LSN uint64
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+// ParseLSN разбирает LSN в текстовом виде Postgres ("16/B374D848").
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %w", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+// CDCStream — поток вставок в outbox из слота Slot по публикации Publication.
+type CDCStream struct {
+	ConnString     string // DSN базы; replication=database добавляется сам
+	Slot           string
+	Publication    string
+	StatusInterval time.Duration // как часто подтверждать позицию серверу без его запроса
+
+	conn       *pgconn.PgConn
+	relations  map[uint32]cdcRelation
+	acked      LSN
+	lastStatus time.Time
+}
+
+type cdcRelation struct {
+	name    string
+	columns []string
+}
+
+// Setup создаёт публикацию (только INSERT в outbox) и слот, если их ещё нет.
+// Параллельный Setup с другой реплики не считается ошибкой.
+func (s *CDCStream) Setup(ctx context.Context, pool *pgxpool.Pool) error {
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname=$1)`, s.Publication).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		_, err := pool.Exec(ctx, `CREATE PUBLICATION `+quoteIdent(s.Publication)+` FOR TABLE outbox WITH (publish = 'insert')`)
+		if err != nil && !isDuplicate(err) {
+			return err
+		}
+	}
+	_, err := pool.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'pgoutput')
+		WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name=$1)`, s.Slot)
+	if err != nil && !isDuplicate(err) {
+		return err
+	}
+	return nil
+}
+
+// Start открывает replication-соединение и запускает поток с позиции from
+// (0 — с confirmed_flush_lsn слота). Слот может читать только одно соединение:
+// у остальных реплик Start завершается ошибкой, пока слот занят.
+func (s *CDCStream) Start(ctx context.Context, from LSN) error {
+	config, err := pgconn.ParseConfig(s.ConnString)
+	if err != nil {
+		return err
+	}
+	config.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL %s (proto_version '1', publication_names '%s')",
+		quoteIdent(s.Slot), from, s.Publication)
+	conn.Frontend().Send(&pgproto3.Query{String: sql})
+	if err := conn.Frontend().Flush(); err != nil {
+		_ = conn.Close(ctx)
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			_ = conn.Close(ctx)
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			s.conn = conn
+			s.relations = make(map[uint32]cdcRelation)
+			s.acked = from
+			s.lastStatus = time.Now()
+			return nil
+		case *pgproto3.ErrorResponse:
+			_ = conn.Close(ctx)
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// Next возвращает вставки в outbox следующей закоммиченной транзакции и её конечный LSN.
+// Транзакции без вставок в outbox пропускаются. Пока данных нет, Next отвечает на keepalive
+// сервера и периодически сообщает ему подтверждённую позицию.
+func (s *CDCStream) Next(ctx context.Context) ([]Record, LSN, error) {
+	var records []Record
+	for {
+		if time.Since(s.lastStatus) >= s.StatusInterval {
+			if err := s.sendStatus(); err != nil {
+				return nil, 0, err
+			}
+		}
+		recvCtx, cancel := context.WithDeadline(ctx, s.lastStatus.Add(s.StatusInterval))
+		msg, err := s.conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return nil, 0, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case 'k': // Primary keepalive: walEnd, время, нужен ли ответ
+				if len(msg.Data) >= 18 && msg.Data[17] == 1 {
+					if err := s.sendStatus(); err != nil {
+						return nil, 0, err
+					}
+				}
+			case 'w': // XLogData: walStart, walEnd, время, сообщение pgoutput
+				if len(msg.Data) < 25 {
+					return nil, 0, errors.New("cdc: short XLogData")
+				}
+				commit, rec, err := s.decode(msg.Data[25:])
+				if err != nil {
+					return nil, 0, err
+				}
+				if rec != nil {
+					records = append(records, *rec)
+				}
+				if commit != 0 {
+					if len(records) > 0 {
+						return records, commit, nil
+					}
+					// Вызывающий подтвердил всё предыдущее до вызова Next, поэтому позицию
+					// пустой транзакции можно подтвердить сразу — слот не держит лишний WAL.
+					s.acked = commit
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			return nil, 0, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyDone:
+			return nil, 0, errors.New("cdc: replication stream closed by server")
+		}
+	}
+}
+
+// Ack подтверждает, что всё до lsn опубликовано: слот может освободить WAL,
+// а следующий Start без сохранённой позиции начнёт после lsn.
+func (s *CDCStream) Ack(lsn LSN) error {
+	if lsn > s.acked {
+		s.acked = lsn
+	}
+	return s.sendStatus()
+}
+
+func (s *CDCStream) Close(ctx context.Context) {
+	if s.conn != nil {
+		_ = s.conn.Close(ctx)
+		s.conn = nil
+	}
+}
+
+// sendStatus — Standby status update: write/flush/apply = подтверждённая позиция.
+func (s *CDCStream) sendStatus() error {
+	buf := make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], uint64(s.acked))
+	binary.BigEndian.PutUint64(buf[9:], uint64(s.acked))
+	binary.BigEndian.PutUint64(buf[17:], uint64(s.acked))
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	s.conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	if err := s.conn.Frontend().Flush(); err != nil {
+		return err
+	}
+	s.lastStatus = time.Now()
+	return nil
+}
+
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// decode разбирает сообщение pgoutput. Возвращает конечный LSN для Commit
+// и запись для Insert в outbox; остальные сообщения пропускаются.
+func (s *CDCStream) decode(data []byte) (LSN, *Record, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	r := &cdcReader{data: data[1:]}
+	switch data[0] {
+	case 'R': // Relation: id, схема, имя, replica identity, колонки
+		id := r.uint32()
+		r.string()
+		rel := cdcRelation{name: r.string()}
+		r.byte()
+		n := int(r.uint16())
+		for i := 0; i < n; i++ {
+			r.byte()
+			rel.columns = append(rel.columns, r.string())
+			r.uint32()
+			r.uint32()
+		}
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		s.relations[id] = rel
+	case 'I': // Insert: id отношения, 'N', новый кортеж
+		id := r.uint32()
+		rel, ok := s.relations[id]
+		if !ok {
+			return 0, nil, fmt.Errorf("cdc: unknown relation %d", id)
+		}
+		r.byte()
+		values := r.tuple(rel.columns)
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		if rel.name != "outbox" {
+			return 0, nil, nil
+		}
+		rec, err := recordFromTuple(values)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, rec, nil
+	case 'C': // Commit: флаги, LSN коммита, конечный LSN, время
+		r.byte()
+		r.uint64()
+		end := r.uint64()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		return LSN(end), nil, nil
+	}
+	return 0, nil, nil
+}
+
+func recordFromTuple(values map[string]string) (*Record, error) {
+	id, err := strconv.ParseInt(values["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cdc: outbox id: %w", err)
+	}
+	rec := &Record{
+		ID:      id,
+		EventID: values["event_id"],
+		Topic:   values["topic"],
+		Key:     values["key"],
+		Payload: []byte(values["payload"]),
+	}
+	if h, ok := values["headers"]; ok && h != "" {
+		if err := json.Unmarshal([]byte(h), &rec.Headers); err != nil {
+			return nil, fmt.Errorf("cdc: outbox headers: %w", err)
+		}
+	}
+	// timestamptz в текстовом виде ISO; смещение бывает как "+00", так и "+05:30".
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00"} {
+		if t, err := time.Parse(layout, values["created_at"]); err == nil {
+			rec.CreatedAt = t
+			break
+		}
+	}
+	return rec, nil
+}
+
+// cdcReader читает поля сообщения pgoutput; первая ошибка запоминается.
+type cdcReader struct {
+	data []byte
+	err  error
+}
+
+func (r *cdcReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errors.New("cdc: truncated pgoutput message")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *cdcReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *cdcReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *cdcReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *cdcReader) uint64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *cdcReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, c := range r.data {
+		if c == 0 {
+			s := string(r.data[:i])
+			r.data = r.data[i+1:]
+			return s
+		}
+	}
+	r.err = errors.New("cdc: unterminated string")
+	return ""
+}
+
+// tuple читает TupleData: NULL ('n') и неизменённые TOAST ('u') дают пустую строку.
+func (r *cdcReader) tuple(columns []string) map[string]string {
+	n := int(r.uint16())
+	values := make(map[string]string, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		kind := r.byte()
+		if kind != 't' {
+			continue
+		}
+		size := int(r.uint32())
+		b := r.take(size)
+		if i < len(columns) {
+			values[columns[i]] = string(b)
+		}
+	}
+	return values
+}
+
+// LoadOffset — сохранённая позиция слота; 0, если relay ещё ничего не публиковал.
+func LoadOffset(ctx context.Context, pool *pgxpool.Pool, slot string) (LSN, error) {
+	var lsn string
+	err := pool.QueryRow(ctx, `SELECT lsn FROM outbox_cdc_offsets WHERE slot=$1`, slot).Scan(&lsn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ParseLSN(lsn)
+}
+
+// CommitOffset отмечает опубликованные записи отправленными и сохраняет позицию
+// одной транзакцией.
+func CommitOffset(ctx context.Context, pool *pgxpool.Pool, slot string, lsn LSN, records []Record) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `UPDATE outbox SET sent_at=now() WHERE id = ANY($1) AND sent_at IS NULL`, ids(records)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO outbox_cdc_offsets(slot, lsn) VALUES ($1, $2)
+		ON CONFLICT (slot) DO UPDATE SET lsn=EXCLUDED.lsn, updated_at=now()`, slot, lsn.String()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DropSlot удаляет слот и его сохранённую позицию, когда CDC-relay не используется: слот без
+// читателя удерживает WAL с момента последнего подтверждения, и диск базы рано или поздно кончится.
+// Слот, который ещё читает реплика в режиме outbox-cdc (например, во время rolling update),
+// не трогается: busy — повторить позже. Публикация остаётся, WAL она не держит.
+func DropSlot(ctx context.Context, pool *pgxpool.Pool, slot string) (busy bool, err error) {
+	var active bool
+	err = pool.QueryRow(ctx, `SELECT active FROM pg_replication_slots WHERE slot_name=$1`, slot).Scan(&active)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return false, err
+	case active:
+		return true, nil
+	default:
+		if _, err := pool.Exec(ctx, `SELECT pg_drop_replication_slot($1)`, slot); err != nil {
+			var pgErr *pgconn.PgError
+			// 55006 object_in_use — реплика успела подключиться к слоту; 42704 — слот удалил кто-то другой.
+			if errors.As(err, &pgErr) && pgErr.Code == "55006" {
+				return true, nil
+			}
+			if !errors.As(err, &pgErr) || pgErr.Code != "42704" {
+				return false, err
+			}
+		}
+	}
+	_, err = pool.Exec(ctx, `DELETE FROM outbox_cdc_offsets WHERE slot=$1`, slot)
+	return false, err
+}
+
+func isDuplicate(err error) bool {
+	var pgErr *pgconn.PgError
+	// 42710 duplicate_object (публикация или слот), 23505 — гонка в каталоге.
+	return errors.As(err, &pgErr) && (pgErr.Code == "42710" || pgErr.Code == "23505")
+}
+
+func quoteIdent(s string) string {
+	return `"` + s + `"`
+}
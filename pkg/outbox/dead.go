@@ -0,0 +1,87 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DeadRecord — запись, перенесённая из outbox после исчерпания попыток публикации.
+type DeadRecord struct {
+	ID        int64             `json:"id"`
+	EventID   string            `json:"event_id"`
+	Topic     string            `json:"topic"`
+	Key       string            `json:"key"`
+	Payload   json.RawMessage   `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"last_error"`
+	CreatedAt time.Time         `json:"created_at"`
+	DeadAt    time.Time         `json:"dead_at"`
+}
+
+func ListDead(ctx context.Context, pool *pgxpool.Pool, limit int) ([]DeadRecord, error) {
+	rows, err := pool.Query(ctx, `SELECT id, event_id, topic, key, payload, headers, attempts, COALESCE(last_error, ''), created_at, dead_at
+		FROM outbox_dead ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DeadRecord{}
+	for rows.Next() {
+		var rec DeadRecord
+		if err := rows.Scan(&rec.ID, &rec.EventID, &rec.Topic, &rec.Key, &rec.Payload, &rec.Headers, &rec.Attempts, &rec.LastError, &rec.CreatedAt, &rec.DeadAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// Requeue возвращает записи из outbox_dead в outbox (пустой ids — все) с обнулёнными попытками.
+// Записи вставляются заново, поэтому их видят и polling, и CDC relay.
+func Requeue(ctx context.Context, pool *pgxpool.Pool, ids []int64) (int64, error) {
+	if ids == nil {
+		ids = []int64{}
+	}
+	return move(ctx, pool, `WITH d AS (
+			DELETE FROM outbox_dead WHERE cardinality($1::bigint[]) = 0 OR id = ANY($1)
+			RETURNING id, event_id, topic, key, payload, headers
+		)
+		INSERT INTO outbox(event_id, topic, key, payload, headers)
+		SELECT event_id, topic, key, payload, headers FROM d ORDER BY id`, ids)
+}
+
+// Replay ставит на повторную публикацию уже отправленные записи с created_at в [from, to).
+// Доступны только записи, ещё не удалённые по retention; дубли отсекает inbox потребителя.
+func Replay(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) (int64, error) {
+	return move(ctx, pool, `WITH r AS (
+			DELETE FROM outbox WHERE sent_at IS NOT NULL AND created_at >= $1 AND created_at < $2
+			RETURNING id, event_id, topic, key, payload, headers
+		)
+		INSERT INTO outbox(event_id, topic, key, payload, headers)
+		SELECT event_id, topic, key, payload, headers FROM r ORDER BY id`, from, to)
+}
+
+// move выполняет перенос записей в outbox и будит relay.
+func move(ctx context.Context, pool *pgxpool.Pool, sql string, args ...any) (int64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() > 0 {
+		if err := notifyRelay(ctx, tx); err != nil {
+			return 0, err
+		}
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
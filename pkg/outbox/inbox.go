@@ -0,0 +1,41 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Handler — побочные эффекты обработки входящего события; выполняются в транзакции inbox.
+type Handler func(ctx context.Context, tx pgx.Tx) error
+
+// Receive обрабатывает событие eventID не более одного раза: event_id записывается в inbox и fn
+// выполняется в одной транзакции. Ошибка fn откатывает и отметку, и изменения — событие будет
+// обработано заново при повторной доставке. false — событие уже обработано, fn не вызывалась.
+// Параллельная доставка того же события ждёт на вставке в inbox и получает false после коммита.
+func Receive(ctx context.Context, pool *pgxpool.Pool, eventID string, fn Handler) (bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	fresh, err := MarkReceived(ctx, tx, eventID)
+	if err != nil || !fresh {
+		return false, err
+	}
+	if err := fn(ctx, tx); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// MarkReceived записывает event_id в inbox в транзакции вызывающего; false — событие уже обработано.
+func MarkReceived(ctx context.Context, tx pgx.Tx, eventID string) (bool, error) {
+	tag, err := tx.Exec(ctx, `INSERT INTO inbox(event_id) VALUES ($1) ON CONFLICT (event_id) DO NOTHING`, eventID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,84 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Channel — канал pg_notify, в который Insert сообщает о новой записи.
+const Channel = "txlab_outbox"
+
+// Notify включает pg_notify в Insert (OUTBOX_NOTIFY). По умолчанию выключено: NOTIFY
+// сериализует коммиты на глобальной блокировке очереди уведомлений.
+var Notify bool
+
+// Waiter задаёт ритм relay: следующий проход — по уведомлению LISTEN (если Listen)
+// или по истечении Interval. Опрос по таймеру остаётся страховкой: уведомления теряются,
+// пока relay переподключается.
+type Waiter struct {
+	Pool     *pgxpool.Pool
+	Listen   bool
+	Interval time.Duration
+
+	conn *pgxpool.Conn
+}
+
+// Wait блокируется до следующего прохода. more — прошлый проход забрал полную пачку,
+// тогда ждать не нужно. Ошибка возвращается только при отмене ctx.
+func (w *Waiter) Wait(ctx context.Context, more bool) error {
+	if more {
+		return ctx.Err()
+	}
+	if w.Listen {
+		if err := w.listen(ctx); err != nil {
+			log.Printf("outbox listen error: %v", err)
+		} else {
+			waitCtx, cancel := context.WithTimeout(ctx, w.Interval)
+			_, err := w.conn.Conn().WaitForNotification(waitCtx)
+			cancel()
+			if err != nil && w.conn.Conn().IsClosed() {
+				w.conn.Release()
+				w.conn = nil
+			}
+			// Уведомление или таймаут — в обоих случаях пора делать проход.
+			return ctx.Err()
+		}
+	}
+	timer := time.NewTimer(w.Interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Close закрывает соединение LISTEN: с подпиской оно в пул не возвращается.
+func (w *Waiter) Close() {
+	if w.conn != nil {
+		_ = w.conn.Conn().Close(context.Background())
+		w.conn.Release()
+		w.conn = nil
+	}
+}
+
+// listen держит отдельное соединение из пула с активным LISTEN.
+func (w *Waiter) listen(ctx context.Context) error {
+	if w.conn != nil {
+		return nil
+	}
+	conn, err := w.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		conn.Release()
+		return err
+	}
+	w.conn = conn
+	return nil
+}
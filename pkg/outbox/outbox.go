@@ -3,37 +3,100 @@ package outbox
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/contracts"
 )
 
+// Querier — общее у *pgxpool.Pool и pgx.Tx. Передача pgx.Tx записывает событие
+// в транзакции вызывающего, атомарно с изменением бизнес-данных.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
 type Record struct {
-	ID        int64           `json:"id"`
-	EventID   string          `json:"event_id"`
-	Topic     string          `json:"topic"`
-	Key       string          `json:"key"`
-	Payload   json.RawMessage `json:"payload"`
-	CreatedAt time.Time       `json:"created_at"`
-	SentAt    *time.Time      `json:"sent_at"`
+	ID        int64             `json:"id"`
+	EventID   string            `json:"event_id"`
+	Topic     string            `json:"topic"`
+	Key       string            `json:"key"`
+	Payload   json.RawMessage   `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	SentAt    *time.Time        `json:"sent_at"`
 }
 
-func Insert(ctx context.Context, pool *pgxpool.Pool, eventID, topic, key string, payload any) error {
+// Insert кладёт событие в outbox; headers relay отправит заголовками сообщения.
+func Insert(ctx context.Context, q Querier, eventID, topic, key string, headers map[string]string, payload any) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	_, err = pool.Exec(ctx, `INSERT INTO outbox(event_id, topic, key, payload) VALUES ($1, $2, $3, $4)`, eventID, topic, key, data)
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	_, err = q.Exec(ctx, `INSERT INTO outbox(event_id, topic, key, payload, headers) VALUES ($1, $2, $3, $4, $5)`, eventID, topic, key, data, headers)
+	if err != nil {
+		return err
+	}
+	return notifyRelay(ctx, q)
+}
+
+// InsertEvent кладёт событие в outbox с топиком и ключом по routing и заголовками события.
+func InsertEvent(ctx context.Context, q Querier, routing contracts.Routing, evt contracts.Event) error {
+	topic, key := routing.Route(evt)
+	return Insert(ctx, q, evt.EventID, topic, key, evt.Headers(), evt)
+}
+
+// notifyRelay будит relay, если включён Notify. Уведомление уходит при коммите транзакции q;
+// одинаковые уведомления в ней склеиваются.
+func notifyRelay(ctx context.Context, q Querier) error {
+	if !Notify {
+		return nil
+	}
+	_, err := q.Exec(ctx, `SELECT pg_notify($1, '')`, Channel)
 	return err
 }
 
-func MarkSent(ctx context.Context, pool *pgxpool.Pool, id int64) error {
-	_, err := pool.Exec(ctx, `UPDATE outbox SET sent_at=now() WHERE id=$1`, id)
+// MarkSent отмечает опубликованную пачку одним UPDATE.
+func MarkSent(ctx context.Context, pool *pgxpool.Pool, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	_, err := pool.Exec(ctx, `UPDATE outbox SET sent_at=now(), locked_by=NULL, locked_until=NULL WHERE id = ANY($1)`, ids(records))
 	return err
 }
 
-func FetchPending(ctx context.Context, pool *pgxpool.Pool, limit int) ([]Record, error) {
-	rows, err := pool.Query(ctx, `SELECT id, event_id, topic, key, payload, created_at, sent_at FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1`, limit)
+// Claim берёт до limit неотправленных записей в аренду owner на lease. Строки, которые прямо сейчас
+// забирает другой relay, пропускаются (FOR UPDATE SKIP LOCKED), а арендованные — до истечения
+// locked_until, поэтому реплики делят outbox без дублей, а записи упавшей реплики освобождаются сами.
+// Запись берётся, только если все более ранние неотправленные записи её ключа входят в ту же пачку:
+// ключ (order_id) в каждый момент публикует один relay, и события заказа уходят по порядку. Проверка
+// идёт по всем неотправленным, а не по аренде: аренда, которую другой relay ещё не закоммитил, не видна,
+// а запись, отложенная после ошибки (Fail), держит свой ключ до отправки или переноса в outbox_dead.
+func Claim(ctx context.Context, pool *pgxpool.Pool, owner string, lease time.Duration, limit int) ([]Record, error) {
+	rows, err := pool.Query(ctx, `WITH c AS (
+			SELECT id, key FROM outbox
+			WHERE sent_at IS NULL AND (locked_until IS NULL OR locked_until < now())
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE outbox SET locked_by=$1, locked_until=now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT c.id FROM c
+			WHERE NOT EXISTS (
+				SELECT 1 FROM outbox p
+				WHERE p.key = c.key AND p.id < c.id AND p.sent_at IS NULL
+					AND p.id NOT IN (SELECT id FROM c)
+			)
+		)
+		RETURNING id, event_id, topic, key, payload, headers, created_at, sent_at`, owner, lease.Seconds(), limit)
 	if err != nil {
 		return nil, err
 	}
@@ -42,10 +105,123 @@ func FetchPending(ctx context.Context, pool *pgxpool.Pool, limit int) ([]Record,
 	var out []Record
 	for rows.Next() {
 		var rec Record
-		if err := rows.Scan(&rec.ID, &rec.EventID, &rec.Topic, &rec.Key, &rec.Payload, &rec.CreatedAt, &rec.SentAt); err != nil {
+		if err := rows.Scan(&rec.ID, &rec.EventID, &rec.Topic, &rec.Key, &rec.Payload, &rec.Headers, &rec.CreatedAt, &rec.SentAt); err != nil {
 			return nil, err
 		}
 		out = append(out, rec)
 	}
-	return out, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING не гарантирует порядок, публикуем в порядке вставки.
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Release снимает аренду owner с неотправленных записей, чтобы их сразу мог взять другой relay.
+func Release(ctx context.Context, pool *pgxpool.Pool, owner string, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	_, err := pool.Exec(ctx, `UPDATE outbox SET locked_by=NULL, locked_until=NULL
+		WHERE id = ANY($1) AND locked_by=$2 AND sent_at IS NULL`, ids(records), owner)
+	return err
+}
+
+// Fail засчитывает попытку записям, которые не удалось опубликовать: запись откладывается на
+// backoff*2^(попытка-1), но не больше минуты, а после maxAttempts попыток переносится в outbox_dead
+// и больше не блокирует свой ключ. owner "" — записи без аренды (CDC-relay).
+// Возвращает число перенесённых записей.
+func Fail(ctx context.Context, pool *pgxpool.Pool, owner string, records []Record, reason string, maxAttempts int, backoff time.Duration) (int64, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `UPDATE outbox SET attempts=attempts+1, last_error=$3, locked_by=NULL,
+			locked_until=now() + make_interval(secs => least(60, $4::float8 * power(2, attempts)))
+		WHERE id = ANY($1) AND ($2 = '' OR locked_by=$2) AND sent_at IS NULL`,
+		ids(records), owner, reason, backoff.Seconds()); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, `WITH d AS (
+			DELETE FROM outbox WHERE id = ANY($1) AND attempts >= $2 AND sent_at IS NULL
+			RETURNING id, event_id, topic, key, payload, headers, attempts, last_error, created_at
+		)
+		INSERT INTO outbox_dead(id, event_id, topic, key, payload, headers, attempts, last_error, created_at)
+		SELECT id, event_id, topic, key, payload, headers, attempts, last_error, created_at FROM d`, ids(records), maxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+// Pending оставляет из records те, что ещё не отправлены и не перенесены в outbox_dead.
+func Pending(ctx context.Context, pool *pgxpool.Pool, records []Record) ([]Record, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	rows, err := pool.Query(ctx, `SELECT id FROM outbox WHERE id = ANY($1) AND sent_at IS NULL`, ids(records))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make(map[int64]bool, len(records))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		pending[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]Record, 0, len(pending))
+	for _, rec := range records {
+		if pending[rec.ID] {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// Purge удаляет отправленные записи старше retention пачками по limit, чтобы не держать
+// долгую блокировку на outbox.
+func Purge(ctx context.Context, pool *pgxpool.Pool, retention time.Duration, limit int) (int64, error) {
+	var total int64
+	for {
+		tag, err := pool.Exec(ctx, `DELETE FROM outbox WHERE id IN (
+				SELECT id FROM outbox WHERE sent_at < now() - make_interval(secs => $1) LIMIT $2
+			)`, retention.Seconds(), limit)
+		if err != nil {
+			return total, err
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < int64(limit) {
+			return total, nil
+		}
+	}
+}
+
+func ids(records []Record) []int64 {
+	out := make([]int64, 0, len(records))
+	for _, rec := range records {
+		out = append(out, rec.ID)
+	}
+	return out
+}
+
+// Owner — имя relay для locked_by: hostname (имя пода) и pid.
+func Owner() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "relay"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
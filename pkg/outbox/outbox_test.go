@@ -0,0 +1,212 @@
+package outbox_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// testPool подключается к OUTBOX_TEST_DATABASE_URL и готовит чистый outbox по схеме order-service.
+// Таблицы outbox очищаются, поэтому переменная должна указывать на отдельную тестовую базу.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("OUTBOX_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("OUTBOX_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	schema, err := os.ReadFile("../../deploy/sql/order.sql")
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, string(schema)); err != nil {
+		t.Fatalf("apply schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `TRUNCATE outbox, outbox_dead`); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	return pool
+}
+
+// insertRow кладёт в outbox запись eventID ключа key в порядке вызовов; payload — сам eventID.
+func insertRow(t *testing.T, pool *pgxpool.Pool, eventID, key string) {
+	t.Helper()
+	_, err := pool.Exec(context.Background(), `INSERT INTO outbox(event_id, topic, key, payload)
+		VALUES ($1, 'txlab.events', $2, to_jsonb($1::text))`, eventID, key)
+	if err != nil {
+		t.Fatalf("insert %s: %v", eventID, err)
+	}
+}
+
+func claim(t *testing.T, pool *pgxpool.Pool, owner string, limit int) []outbox.Record {
+	t.Helper()
+	records, err := outbox.Claim(context.Background(), pool, owner, time.Minute, limit)
+	if err != nil {
+		t.Fatalf("claim %s: %v", owner, err)
+	}
+	return records
+}
+
+func eventIDs(records []outbox.Record) string {
+	ids := make([]string, 0, len(records))
+	for _, rec := range records {
+		ids = append(ids, rec.EventID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestClaimSerializesKeyAcrossRelays(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-1")
+	insertRow(t, pool, "e3", "o-2")
+
+	// Relay A выбрал e1, но ещё не закоммитил аренду: строка заблокирована его транзакцией.
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, err := tx.Exec(ctx, `SELECT id FROM outbox WHERE event_id='e1' FOR UPDATE`); err != nil {
+		t.Fatalf("lock e1: %v", err)
+	}
+	if got := eventIDs(claim(t, pool, "relay-b", 10)); got != "e3" {
+		t.Fatalf("relay B claimed %q while e1 is being claimed, want e3", got)
+	}
+	_ = tx.Rollback(ctx)
+
+	// A арендовал e1: e2 ждёт, пока e1 не отправлена.
+	if got := eventIDs(claim(t, pool, "relay-a", 1)); got != "e1" {
+		t.Fatalf("relay A claimed %q, want e1", got)
+	}
+	if got := eventIDs(claim(t, pool, "relay-b", 10)); got != "" {
+		t.Fatalf("relay B claimed %q while e1 is leased, want nothing", got)
+	}
+	if _, err := pool.Exec(ctx, `UPDATE outbox SET sent_at=now() WHERE event_id='e1'`); err != nil {
+		t.Fatalf("mark e1 sent: %v", err)
+	}
+	if got := eventIDs(claim(t, pool, "relay-b", 10)); got != "e2" {
+		t.Fatalf("relay B claimed %q after e1 was sent, want e2", got)
+	}
+}
+
+func TestClaimTwoRelaysKeepKeyOrder(t *testing.T) {
+	pool := testPool(t)
+	const keys, perKey = 10, 20
+	for i := 0; i < keys*perKey; i++ {
+		insertRow(t, pool, fmt.Sprintf("e%03d", i), fmt.Sprintf("o-%d", i%keys))
+	}
+
+	// Два relay разбирают outbox параллельно; «публикация» — запись в общий журнал.
+	var mu sync.Mutex
+	var published []outbox.Record
+	var wg sync.WaitGroup
+	for _, owner := range []string{"relay-a", "relay-b"} {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			for idle := 0; idle < 3; {
+				records, err := outbox.Claim(context.Background(), pool, owner, time.Minute, 7)
+				if err != nil {
+					t.Errorf("claim %s: %v", owner, err)
+					return
+				}
+				if len(records) == 0 {
+					idle++
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				idle = 0
+				mu.Lock()
+				published = append(published, records...)
+				mu.Unlock()
+				for _, rec := range records {
+					if _, err := pool.Exec(context.Background(), `UPDATE outbox SET sent_at=now() WHERE id=$1`, rec.ID); err != nil {
+						t.Errorf("mark sent: %v", err)
+						return
+					}
+				}
+			}
+		}(owner)
+	}
+	wg.Wait()
+
+	if len(published) != keys*perKey {
+		t.Fatalf("published %d records, want %d", len(published), keys*perKey)
+	}
+	last := map[string]int64{}
+	for _, rec := range published {
+		if rec.ID <= last[rec.Key] {
+			t.Fatalf("key %s: record %d published after %d", rec.Key, rec.ID, last[rec.Key])
+		}
+		last[rec.Key] = rec.ID
+	}
+}
+
+func TestFailDefersRecordAndHoldsItsKey(t *testing.T) {
+	pool := testPool(t)
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-1")
+	insertRow(t, pool, "e3", "o-2")
+
+	records := claim(t, pool, "relay-a", 10)
+	if got := eventIDs(records); got != "e1 e2 e3" {
+		t.Fatalf("claimed %q, want e1 e2 e3", got)
+	}
+	// e1 упала: откладывается, e2 возвращается в очередь, но ждёт e1.
+	dead, err := outbox.Fail(context.Background(), pool, "relay-a", records[:1], "broker rejected", 5, time.Minute)
+	if err != nil || dead != 0 {
+		t.Fatalf("fail: dead=%d err=%v", dead, err)
+	}
+	if err := outbox.Release(context.Background(), pool, "relay-a", records[1:2]); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if got := eventIDs(claim(t, pool, "relay-b", 10)); got != "" {
+		t.Fatalf("claimed %q while e1 is deferred, want nothing", got)
+	}
+	var attempts int
+	var lastError string
+	if err := pool.QueryRow(context.Background(), `SELECT attempts, last_error FROM outbox WHERE event_id='e1'`).
+		Scan(&attempts, &lastError); err != nil {
+		t.Fatalf("read e1: %v", err)
+	}
+	if attempts != 1 || lastError != "broker rejected" {
+		t.Fatalf("e1 attempts=%d last_error=%q", attempts, lastError)
+	}
+}
+
+func TestFailMovesRecordToDeadAfterMaxAttempts(t *testing.T) {
+	pool := testPool(t)
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-1")
+
+	records := claim(t, pool, "relay-a", 1)
+	dead, err := outbox.Fail(context.Background(), pool, "relay-a", records, "too large", 1, time.Minute)
+	if err != nil || dead != 1 {
+		t.Fatalf("fail: dead=%d err=%v, want 1 dead", dead, err)
+	}
+	list, err := outbox.ListDead(context.Background(), pool, 10)
+	if err != nil {
+		t.Fatalf("list dead: %v", err)
+	}
+	if len(list) != 1 || list[0].EventID != "e1" || list[0].Attempts != 1 || list[0].LastError != "too large" {
+		t.Fatalf("dead = %+v, want e1 after 1 attempt", list)
+	}
+	// Мёртвая запись больше не держит ключ.
+	if got := eventIDs(claim(t, pool, "relay-b", 10)); got != "e2" {
+		t.Fatalf("claimed %q after e1 moved to dead, want e2", got)
+	}
+}
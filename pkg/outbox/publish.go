@@ -0,0 +1,170 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+)
+
+// Result — итог публикации пачки: Sent ушли в брокер, Failed не ушли из-за собственной ошибки
+// (им засчитывается попытка), Unsent не публиковались или заблокированы упавшей записью ключа.
+type Result struct {
+	Sent   []Record
+	Failed []Record
+	Unsent []Record
+}
+
+// Publish отправляет пачку в топики записей (Record.Topic): записи каждого топика уходят через
+// publishTopic, топики публикуются параллельно, итоги складываются. Ошибка — первая
+// ошибка публикации по порядку топиков в пачке.
+func Publish(ctx context.Context, pubs *kafka.Publishers, records []Record) (Result, error) {
+	var topics []string
+	groups := map[string][]Record{}
+	for _, rec := range records {
+		if _, ok := groups[rec.Topic]; !ok {
+			topics = append(topics, rec.Topic)
+		}
+		groups[rec.Topic] = append(groups[rec.Topic], rec)
+	}
+	if len(topics) == 1 {
+		return publishTopic(ctx, pubs.Topic(topics[0]), records)
+	}
+
+	results := make([]Result, len(topics))
+	errs := make([]error, len(topics))
+	var wg sync.WaitGroup
+	for i, topic := range topics {
+		wg.Add(1)
+		go func(i int, topic string) {
+			defer wg.Done()
+			results[i], errs[i] = publishTopic(ctx, pubs.Topic(topic), groups[topic])
+		}(i, topic)
+	}
+	wg.Wait()
+
+	var res Result
+	var first error
+	for i := range topics {
+		res.Sent = append(res.Sent, results[i].Sent...)
+		res.Failed = append(res.Failed, results[i].Failed...)
+		res.Unsent = append(res.Unsent, results[i].Unsent...)
+		if first == nil {
+			first = errs[i]
+		}
+	}
+	return res, first
+}
+
+// publishTopic отправляет записи одного топика и делит их по итогу. Записи разных ключей уходят
+// одним вызовом pub.Publish. Если у ключа (order_id) несколько записей, они уходят раундами:
+// в раунде не больше одной записи ключа, и следующая запись ключа отправляется только после того,
+// как брокер принял предыдущую. Поэтому при ошибке брокер не примет позднее событие заказа раньше упавшего: все
+// следующие записи ключа не отправляются и остаются в Unsent, повторная публикация идёт по порядку,
+// дубль отсекает inbox потребителя. Ошибка — первая ошибка публикации.
+func publishTopic(ctx context.Context, pub kafka.Publisher, records []Record) (Result, error) {
+	var rounds [][]Record
+	depth := make(map[string]int)
+	for _, rec := range records {
+		d := depth[rec.Key]
+		depth[rec.Key]++
+		if d == len(rounds) {
+			rounds = append(rounds, nil)
+		}
+		rounds[d] = append(rounds[d], rec)
+	}
+
+	var res Result
+	var err error
+	failedKeys := make(map[string]bool)
+	for _, round := range rounds {
+		batch := make([]Record, 0, len(round))
+		for _, rec := range round {
+			if failedKeys[rec.Key] {
+				res.Unsent = append(res.Unsent, rec)
+				continue
+			}
+			batch = append(batch, rec)
+		}
+		r, werr := writeRound(ctx, pub, batch)
+		res.Sent = append(res.Sent, r.Sent...)
+		res.Failed = append(res.Failed, r.Failed...)
+		res.Unsent = append(res.Unsent, r.Unsent...)
+		for _, rec := range r.Failed {
+			failedKeys[rec.Key] = true
+		}
+		for _, rec := range r.Unsent {
+			failedKeys[rec.Key] = true
+		}
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return res, err
+}
+
+// writeRound отправляет записи разных ключей одним вызовом pub.Publish. При частичной ошибке
+// (kafka.WriteErrors) в Failed попадают только упавшие записи.
+func writeRound(ctx context.Context, pub kafka.Publisher, records []Record) (Result, error) {
+	if len(records) == 0 {
+		return Result{}, nil
+	}
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, rec := range records {
+		msgs = append(msgs, kafka.Message{Key: []byte(rec.Key), Value: rec.Payload, Headers: messageHeaders(rec.Headers), Time: time.Now().UTC()})
+	}
+	err := pub.Publish(ctx, msgs...)
+	if err == nil {
+		return Result{Sent: records}, nil
+	}
+
+	var res Result
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		// Раунд не отправлялся: виновата одна запись, остальные вернутся в очередь.
+		for i, rec := range records {
+			if rec.Key == string(tooLarge.Message.Key) && bytes.Equal(rec.Payload, tooLarge.Message.Value) {
+				res.Failed = append(res.Failed, rec)
+				res.Unsent = append(res.Unsent, records[:i]...)
+				res.Unsent = append(res.Unsent, records[i+1:]...)
+				return res, err
+			}
+		}
+	}
+	var werrs kafka.WriteErrors
+	if !errors.As(err, &werrs) || len(werrs) != len(records) {
+		// Ошибка до отправки (метаданные, отмена ctx): попытку не засчитываем.
+		return Result{Unsent: records}, err
+	}
+	for i, rec := range records {
+		if werrs[i] != nil {
+			res.Failed = append(res.Failed, rec)
+			continue
+		}
+		res.Sent = append(res.Sent, rec)
+	}
+	for _, e := range werrs {
+		if e != nil {
+			return res, e
+		}
+	}
+	return res, err
+}
+
+// messageHeaders — заголовки записи в порядке ключей, чтобы повторная публикация давала то же сообщение.
+func messageHeaders(headers map[string]string) []kafka.Header {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]kafka.Header, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, kafka.Header{Key: k, Value: []byte(headers[k])})
+	}
+	return out
+}
@@ -0,0 +1,192 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// fakePublisher запоминает каждый вызов Publish и роняет сообщения из fail и ключа failKey.
+type fakePublisher struct {
+	mu      sync.Mutex
+	fail    map[string]bool // value сообщения → ошибка записи
+	failKey string
+	err     error // ошибка всего вызова
+	writes  []string
+	sent    []kafka.Message // принятые брокером сообщения
+}
+
+func (w *fakePublisher) Publish(_ context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	values := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		values = append(values, string(m.Value))
+	}
+	w.writes = append(w.writes, strings.Join(values, " "))
+	if w.err != nil {
+		return w.err
+	}
+	werrs := make(kafka.WriteErrors, len(msgs))
+	failed := false
+	for i, m := range msgs {
+		if w.fail[string(m.Value)] || (w.failKey != "" && string(m.Key) == w.failKey) {
+			werrs[i] = errors.New("broker rejected " + string(m.Value))
+			failed = true
+			continue
+		}
+		w.sent = append(w.sent, m)
+	}
+	if failed {
+		return werrs
+	}
+	return nil
+}
+
+func (w *fakePublisher) Close() error { return nil }
+
+// fakeBroker отдаёт один fakePublisher на все топики; подписки тестам не нужны.
+type fakeBroker struct {
+	kafka.Broker
+	pub *fakePublisher
+}
+
+func (b fakeBroker) Publisher(string, int, time.Duration) kafka.Publisher { return b.pub }
+
+func publishers(w *fakePublisher) *kafka.Publishers {
+	return kafka.NewPublishers(fakeBroker{pub: w}, 10, 0)
+}
+
+// records собирает пачку из пар «payload ключ»; payload заодно служит меткой записи.
+func records(pairs ...string) []outbox.Record {
+	out := make([]outbox.Record, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, outbox.Record{ID: int64(i/2 + 1), Key: pairs[i+1], Payload: []byte(pairs[i])})
+	}
+	return out
+}
+
+func payloads(records []outbox.Record) string {
+	out := make([]string, 0, len(records))
+	for _, rec := range records {
+		out = append(out, string(rec.Payload))
+	}
+	return strings.Join(out, " ")
+}
+
+func TestPublishDistinctKeysInOneWrite(t *testing.T) {
+	w := &fakePublisher{}
+	res, err := outbox.Publish(context.Background(), publishers(w), records("1", "o-1", "2", "o-2", "3", "o-3"))
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if got := strings.Join(w.writes, "|"); got != "1 2 3" {
+		t.Fatalf("writes = %q, want one write", got)
+	}
+	if payloads(res.Sent) != "1 2 3" || len(res.Failed)+len(res.Unsent) != 0 {
+		t.Fatalf("result %+v", res)
+	}
+}
+
+func TestPublishRepeatedKeyGoesInRounds(t *testing.T) {
+	w := &fakePublisher{}
+	res, err := outbox.Publish(context.Background(), publishers(w), records("1", "o-1", "2", "o-2", "3", "o-1", "4", "o-1"))
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if got := strings.Join(w.writes, "|"); got != "1 2|3|4" {
+		t.Fatalf("writes = %q, want rounds 1 2|3|4", got)
+	}
+	if payloads(res.Sent) != "1 2 3 4" {
+		t.Fatalf("sent %q", payloads(res.Sent))
+	}
+}
+
+func TestPublishHoldsBackKeyAfterFailedRecord(t *testing.T) {
+	// Упала только ранняя запись ключа o-1: поздняя не должна уйти в брокер раньше неё.
+	w := &fakePublisher{fail: map[string]bool{"1": true}}
+	res, err := outbox.Publish(context.Background(), publishers(w), records("1", "o-1", "2", "o-2", "3", "o-1", "4", "o-2"))
+	if err == nil {
+		t.Fatal("publish: want error")
+	}
+	if got := strings.Join(w.writes, "|"); got != "1 2|4" {
+		t.Fatalf("writes = %q, record 3 must not be written", got)
+	}
+	if payloads(res.Sent) != "2 4" || payloads(res.Failed) != "1" || payloads(res.Unsent) != "3" {
+		t.Fatalf("sent %q failed %q unsent %q, want sent 2 4, failed 1, unsent 3",
+			payloads(res.Sent), payloads(res.Failed), payloads(res.Unsent))
+	}
+}
+
+func TestPublishWholeWriteError(t *testing.T) {
+	w := &fakePublisher{err: errors.New("broker down")}
+	res, err := outbox.Publish(context.Background(), publishers(w), records("1", "o-1", "2", "o-1", "3", "o-2"))
+	if err == nil {
+		t.Fatal("publish: want error")
+	}
+	// Ошибка до отправки: попытка не засчитывается, вся пачка возвращается.
+	if len(res.Sent)+len(res.Failed) != 0 || len(res.Unsent) != 3 {
+		t.Fatalf("result %+v, want everything unsent", res)
+	}
+	if len(w.writes) != 1 {
+		t.Fatalf("writes = %q, later rounds of failed keys must not be written", w.writes)
+	}
+}
+
+func TestPublishMessageTooLargeFailsOnlyThatRecord(t *testing.T) {
+	w := &fakePublisher{err: kafka.MessageTooLargeError{Message: kafka.Message{Key: []byte("o-1"), Value: []byte("1")}}}
+	res, err := outbox.Publish(context.Background(), publishers(w), records("1", "o-1", "2", "o-2", "3", "o-1"))
+	if err == nil {
+		t.Fatal("publish: want error")
+	}
+	if payloads(res.Failed) != "1" || payloads(res.Unsent) != "2 3" || len(res.Sent) != 0 {
+		t.Fatalf("failed %q unsent %q sent %q, want failed 1, unsent 2 3",
+			payloads(res.Failed), payloads(res.Unsent), payloads(res.Sent))
+	}
+}
+
+func TestPublishThroughMemoryBroker(t *testing.T) {
+	b := kafka.NewMemory()
+	recs := records("1", "o-1", "2", "o-2", "3", "o-1")
+	for i := range recs {
+		recs[i].Topic = "orders"
+	}
+	res, err := outbox.Publish(context.Background(), kafka.NewPublishers(b, 10, 0), recs)
+	if err != nil || len(res.Sent) != 3 {
+		t.Fatalf("publish: sent %d, err %v", len(res.Sent), err)
+	}
+	sub := b.Subscribe("orders", "g")
+	defer sub.Close()
+	var got []string
+	for range res.Sent {
+		msg, err := sub.Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		got = append(got, string(msg.Key)+"="+string(msg.Value))
+	}
+	if strings.Join(got, " ") != "o-1=1 o-2=2 o-1=3" {
+		t.Fatalf("consumed %v", got)
+	}
+}
+
+func TestPublishFailedKeyHoldsOnlyItsTopic(t *testing.T) {
+	w := &fakePublisher{fail: map[string]bool{"1": true}}
+	recs := records("1", "o-1", "2", "o-1", "3", "o-1")
+	recs[0].Topic, recs[1].Topic, recs[2].Topic = "orders", "orders", "payments"
+	res, err := outbox.Publish(context.Background(), publishers(w), recs)
+	if err == nil {
+		t.Fatal("publish: want error")
+	}
+	// Порядок ключа держится внутри топика: payments не ждёт упавшую запись orders.
+	if payloads(res.Sent) != "3" || payloads(res.Failed) != "1" || payloads(res.Unsent) != "2" {
+		t.Fatalf("sent %q failed %q unsent %q, want sent 3, failed 1, unsent 2",
+			payloads(res.Sent), payloads(res.Failed), payloads(res.Unsent))
+	}
+}
@@ -0,0 +1,137 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/kafka"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+)
+
+// RelayConfig — параметры relay; сервисы заполняют их из OUTBOX_*.
+type RelayConfig struct {
+	PollInterval time.Duration // OUTBOX_POLL_MS
+	BatchSize    int           // OUTBOX_BATCH
+	Lease        time.Duration // OUTBOX_LEASE_MS
+	Linger       time.Duration // OUTBOX_LINGER_MS
+	Notify       bool          // OUTBOX_NOTIFY
+	MaxAttempts  int           // OUTBOX_MAX_ATTEMPTS
+	RetryBackoff time.Duration // OUTBOX_RETRY_BACKOFF_MS
+	Retention    time.Duration // OUTBOX_RETENTION_MS, 0 — не удалять
+}
+
+// purgeInterval — как часто relay удаляет отправленные записи старше Retention.
+const purgeInterval = time.Minute
+
+// Relay публикует outbox сервиса в брокер: берёт пачку в аренду (Claim), отправляет её в топики
+// записей раундами по ключам (Publish), отмечает отправленное, упавшее откладывает или переносит в outbox_dead
+// (Fail) и раз в минуту чистит старые отправленные записи (Purge).
+type Relay struct {
+	Pool    *pgxpool.Pool
+	Writer  *kafka.Publishers
+	Config  RelayConfig
+	Metrics *metrics.OutboxMetrics
+	Owner   string
+
+	purged time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewRelay создаёт relay с отправителями, настроенными на пачки Config.BatchSize и Config.Linger.
+func NewRelay(pool *pgxpool.Pool, broker kafka.Broker, cfg RelayConfig, m *metrics.OutboxMetrics) *Relay {
+	return &Relay{
+		Pool:    pool,
+		Writer:  kafka.NewPublishers(broker, cfg.BatchSize, cfg.Linger),
+		Config:  cfg,
+		Metrics: m,
+		Owner:   Owner(),
+	}
+}
+
+// Start запускает цикл relay в фоне; он работает до отмены ctx или Stop.
+func (r *Relay) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	r.purged = time.Now()
+	waiter := &Waiter{Pool: r.Pool, Listen: r.Config.Notify, Interval: r.Config.PollInterval}
+	go func() {
+		defer close(r.done)
+		defer r.Writer.Close()
+		defer waiter.Close()
+		more := false
+		for {
+			if err := waiter.Wait(ctx, more); err != nil {
+				return
+			}
+			var err error
+			more, err = r.RunOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("outbox relay error: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop останавливает цикл и ждёт завершения текущего прохода.
+func (r *Relay) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// RunOnce — один проход relay. more — пачка была полной, следующую стоит брать без ожидания.
+func (r *Relay) RunOnce(ctx context.Context) (bool, error) {
+	m := r.Metrics
+	records, err := Claim(ctx, r.Pool, r.Owner, r.Config.Lease, r.Config.BatchSize)
+	if err != nil {
+		return false, err
+	}
+	m.Claimed.Add(float64(len(records)))
+	more := len(records) == r.Config.BatchSize
+
+	res, err := Publish(ctx, r.Writer, records)
+	if err != nil {
+		log.Printf("outbox publish error: %v", err)
+		m.Failed.Add(float64(len(res.Failed)))
+		// Упавшие записи откладываются с backoff и после MaxAttempts уходят в outbox_dead,
+		// остальное неопубликованное сразу возвращаем, не дожидаясь истечения аренды.
+		dead, err := Fail(ctx, r.Pool, r.Owner, res.Failed, err.Error(), r.Config.MaxAttempts, r.Config.RetryBackoff)
+		if err != nil {
+			log.Printf("outbox fail error: %v", err)
+		}
+		if dead > 0 {
+			log.Printf("outbox: %d records moved to outbox_dead", dead)
+			m.Dead.Add(float64(dead))
+		}
+		_ = Release(ctx, r.Pool, r.Owner, res.Unsent)
+		more = false
+	}
+	if err := MarkSent(ctx, r.Pool, res.Sent); err != nil {
+		// Записи останутся в аренде и уйдут повторно после её истечения.
+		log.Printf("outbox mark sent error: %v", err)
+	}
+	m.Published.Add(float64(len(res.Sent)))
+	for _, rec := range res.Sent {
+		m.LagMS.Observe(float64(time.Since(rec.CreatedAt).Milliseconds()))
+	}
+	r.purge(ctx)
+	return more, nil
+}
+
+func (r *Relay) purge(ctx context.Context) {
+	if r.Config.Retention <= 0 || time.Since(r.purged) < purgeInterval {
+		return
+	}
+	r.purged = time.Now()
+	n, err := Purge(ctx, r.Pool, r.Config.Retention, 1000)
+	if err != nil {
+		log.Printf("outbox purge error: %v", err)
+	}
+	r.Metrics.Purged.Add(float64(n))
+}
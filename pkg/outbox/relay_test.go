@@ -0,0 +1,130 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/metrics"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/outbox"
+)
+
+// Метрики регистрируются глобально, поэтому создаются один раз на пакет.
+var outboxMetrics = metrics.NewOutboxMetrics("outbox_test")
+
+var relayConfig = outbox.RelayConfig{BatchSize: 10, Lease: time.Minute, MaxAttempts: 3, RetryBackoff: time.Minute}
+
+func newRelay(pool *pgxpool.Pool, w *fakePublisher, cfg outbox.RelayConfig) *outbox.Relay {
+	return &outbox.Relay{Pool: pool, Writer: publishers(w), Config: cfg, Metrics: outboxMetrics, Owner: "relay-test"}
+}
+
+// published — eventID принятых брокером сообщений по ключам в порядке отправки.
+func published(t *testing.T, w *fakePublisher) string {
+	t.Helper()
+	byKey := map[string][]string{}
+	for _, m := range w.sent {
+		var id string
+		if err := json.Unmarshal(m.Value, &id); err != nil {
+			t.Fatalf("decode %s: %v", m.Value, err)
+		}
+		byKey[string(m.Key)] = append(byKey[string(m.Key)], id)
+	}
+	return fmt.Sprint(byKey)
+}
+
+// pending — неотправленные записи outbox с числом попыток.
+func pending(t *testing.T, pool *pgxpool.Pool) string {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), `SELECT event_id, attempts FROM outbox WHERE sent_at IS NULL ORDER BY id`)
+	if err != nil {
+		t.Fatalf("pending: %v", err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		var attempts int
+		if err := rows.Scan(&id, &attempts); err != nil {
+			t.Fatalf("pending: %v", err)
+		}
+		out = append(out, fmt.Sprintf("%s/%d", id, attempts))
+	}
+	return strings.Join(out, " ")
+}
+
+func TestRelayPublishesInKeyOrder(t *testing.T) {
+	pool := testPool(t)
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-2")
+	insertRow(t, pool, "e3", "o-1")
+	insertRow(t, pool, "e4", "o-1")
+
+	w := &fakePublisher{}
+	if _, err := newRelay(pool, w, relayConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := pending(t, pool); got != "" {
+		t.Fatalf("pending after run = %s, want none", got)
+	}
+	if got := published(t, w); got != "map[o-1:[e1 e3 e4] o-2:[e2]]" {
+		t.Fatalf("published %s", got)
+	}
+}
+
+func TestRelayDefersFailedRecordAndItsKey(t *testing.T) {
+	pool := testPool(t)
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-2")
+	insertRow(t, pool, "e3", "o-1")
+
+	w := &fakePublisher{failKey: "o-1"}
+	if _, err := newRelay(pool, w, relayConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// e1 упала и отложена с засчитанной попыткой, e3 даже не отправлялась, o-2 ушла.
+	if got := pending(t, pool); got != "e1/1 e3/0" {
+		t.Fatalf("pending after run = %s", got)
+	}
+	if got := published(t, w); got != "map[o-2:[e2]]" {
+		t.Fatalf("published %s", got)
+	}
+
+	// Отложенная e1 не берётся до истечения backoff и держит e3.
+	w = &fakePublisher{}
+	if _, err := newRelay(pool, w, relayConfig).RunOnce(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := pending(t, pool); got != "e1/1 e3/0" {
+		t.Fatalf("pending after second run = %s", got)
+	}
+	if len(w.writes) != 0 {
+		t.Fatalf("writes = %q, want none while e1 is deferred", w.writes)
+	}
+}
+
+func TestRelayMovesRecordToDeadAfterMaxAttempts(t *testing.T) {
+	pool := testPool(t)
+	insertRow(t, pool, "e1", "o-1")
+	insertRow(t, pool, "e2", "o-2")
+
+	cfg := relayConfig
+	cfg.MaxAttempts = 1
+	if _, err := newRelay(pool, &fakePublisher{failKey: "o-1"}, cfg).RunOnce(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := pending(t, pool); got != "" {
+		t.Fatalf("pending after run = %s, want none", got)
+	}
+	dead, err := outbox.ListDead(context.Background(), pool, 10)
+	if err != nil {
+		t.Fatalf("list dead: %v", err)
+	}
+	if len(dead) != 1 || dead[0].EventID != "e1" || dead[0].Attempts != 1 {
+		t.Fatalf("outbox_dead = %+v, want e1 after 1 attempt", dead)
+	}
+}
@@ -0,0 +1,30 @@
+package common
+
+import "errors"
+
+var (
+	// ErrVoteNo — участник отказался подготовиться (бизнес-отказ).
+	ErrVoteNo = errors.New("participant voted no")
+	// ErrParticipantUnavailable — участник не ответил голосом (таймаут, 5xx, обрыв) даже после повторов.
+	ErrParticipantUnavailable = errors.New("participant unavailable")
+	// ErrCommitPending — решение COMMIT принято, но не все участники подтвердили commit;
+	// транзакция остаётся в COMMITTING и будет доведена восстановлением.
+	ErrCommitPending = errors.New("commit pending")
+)
+
+// VoteNoError — бизнес-отказ участника с причиной; errors.Is(err, ErrVoteNo) == true.
+type VoteNoError struct {
+	Reason string
+}
+
+func VoteNo(reason string) error {
+	return &VoteNoError{Reason: reason}
+}
+
+func (e *VoteNoError) Error() string {
+	return e.Reason
+}
+
+func (e *VoteNoError) Is(target error) bool {
+	return target == ErrVoteNo
+}
@@ -2,7 +2,8 @@ package common
 
 import (
 	"context"
-	"tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
 )
 
 type TwoPCParticipantClient interface {
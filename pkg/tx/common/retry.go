@@ -0,0 +1,38 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+var DefaultRetry = RetryPolicy{Attempts: 3, Backoff: 50 * time.Millisecond}
+
+// Retry выполняет fn до успеха или исчерпания попыток, удваивая паузу между попытками.
+func Retry(ctx context.Context, p RetryPolicy, fn func(ctx context.Context) error) error {
+	attempts := p.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	backoff := p.Backoff
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if i == attempts-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
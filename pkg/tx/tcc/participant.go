@@ -0,0 +1,180 @@
+package tcc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Статусы tcc_operations.
+const (
+	StatusTry     = "TRY"
+	StatusConfirm = "CONFIRM"
+	StatusCancel  = "CANCEL"
+)
+
+var (
+	// ErrCancelled — Try/Confirm пришёл после Cancel (в том числе пустого): транзакция закрыта,
+	// повторно открыть её нельзя (защита от "подвешивания" ресурса).
+	ErrCancelled = errors.New("tcc: transaction already cancelled")
+	// ErrNotTried — Confirm без успешного Try.
+	ErrNotTried = errors.New("tcc: confirm without try")
+)
+
+// Op — идентификатор операции участника (тело /tcc/*).
+type Op struct {
+	TxID    string
+	OrderID string
+	Step    string
+}
+
+// Action меняет ресурс участника в транзакции, которая фиксирует статус в tcc_operations.
+type Action func(ctx context.Context, tx pgx.Tx) error
+
+// Result описывает, что фактически сделал вызов.
+type Result struct {
+	Status string
+	// Duplicate — повторная доставка: статус уже был достигнут, ресурс не трогали.
+	Duplicate bool
+	// EmptyRollback — Cancel без предшествующего Try: ресурс не резервировался,
+	// но отмена записана, чтобы опоздавший Try был отклонён.
+	EmptyRollback bool
+}
+
+// Note — пометка для логов и ответа: "duplicate", "empty_rollback" или пусто.
+func (r Result) Note() string {
+	switch {
+	case r.EmptyRollback:
+		return "empty_rollback"
+	case r.Duplicate:
+		return "duplicate"
+	}
+	return ""
+}
+
+// Participant реализует переходы TCC поверх tcc_operations (txid — ключ операции):
+//
+//	(нет)   --Try-->     TRY      --Confirm--> CONFIRM
+//	(нет)   --Cancel-->  CANCEL (пустой откат)
+//	TRY/CONFIRM --Cancel--> CANCEL
+//
+// Повтор любого перехода идемпотентен; Try и Confirm после Cancel отклоняются.
+type Participant struct {
+	Pool *pgxpool.Pool
+}
+
+func NewParticipant(pool *pgxpool.Pool) *Participant {
+	return &Participant{Pool: pool}
+}
+
+// Try резервирует ресурс. Ошибка action откатывает и резерв, и запись TRY,
+// поэтому следующий Cancel будет пустым.
+func (p *Participant) Try(ctx context.Context, op Op, action Action) (Result, error) {
+	return p.inTx(ctx, func(tx pgx.Tx) (Result, error) {
+		inserted, err := insertOp(ctx, tx, op, StatusTry, false)
+		if err != nil {
+			return Result{}, err
+		}
+		if !inserted {
+			status, err := lockOp(ctx, tx, op.TxID)
+			if err != nil {
+				return Result{}, err
+			}
+			if status == StatusCancel {
+				return Result{Status: status}, ErrCancelled
+			}
+			return Result{Status: status, Duplicate: true}, nil
+		}
+		if err := action(ctx, tx); err != nil {
+			return Result{}, err
+		}
+		return Result{Status: StatusTry}, nil
+	})
+}
+
+// Confirm фиксирует зарезервированный ресурс.
+func (p *Participant) Confirm(ctx context.Context, op Op, action Action) (Result, error) {
+	return p.inTx(ctx, func(tx pgx.Tx) (Result, error) {
+		status, err := lockOp(ctx, tx, op.TxID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Result{}, ErrNotTried
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		switch status {
+		case StatusConfirm:
+			return Result{Status: status, Duplicate: true}, nil
+		case StatusCancel:
+			return Result{Status: status}, ErrCancelled
+		}
+		if err := action(ctx, tx); err != nil {
+			return Result{}, err
+		}
+		return Result{Status: StatusConfirm}, setStatus(ctx, tx, op.TxID, StatusConfirm)
+	})
+}
+
+// Cancel освобождает ресурс (после Try) или компенсирует его (после Confirm).
+// Без Try записывает пустой откат.
+func (p *Participant) Cancel(ctx context.Context, op Op, action Action) (Result, error) {
+	return p.inTx(ctx, func(tx pgx.Tx) (Result, error) {
+		inserted, err := insertOp(ctx, tx, op, StatusCancel, true)
+		if err != nil {
+			return Result{}, err
+		}
+		if inserted {
+			return Result{Status: StatusCancel, EmptyRollback: true}, nil
+		}
+		status, err := lockOp(ctx, tx, op.TxID)
+		if err != nil {
+			return Result{}, err
+		}
+		if status == StatusCancel {
+			return Result{Status: status, Duplicate: true}, nil
+		}
+		if err := action(ctx, tx); err != nil {
+			return Result{}, err
+		}
+		return Result{Status: StatusCancel}, setStatus(ctx, tx, op.TxID, StatusCancel)
+	})
+}
+
+func (p *Participant) inTx(ctx context.Context, fn func(tx pgx.Tx) (Result, error)) (Result, error) {
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	res, err := fn(tx)
+	if err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// insertOp создаёт запись операции. Конкурентная вставка того же txid ждёт завершения
+// первой транзакции, поэтому Try и Cancel одного txid сериализуются.
+func insertOp(ctx context.Context, tx pgx.Tx, op Op, status string, emptyRollback bool) (bool, error) {
+	tag, err := tx.Exec(ctx, `INSERT INTO tcc_operations(txid, order_id, step, status, empty_rollback)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (txid) DO NOTHING`, op.TxID, op.OrderID, op.Step, status, emptyRollback)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func lockOp(ctx context.Context, tx pgx.Tx, txid string) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, `SELECT status FROM tcc_operations WHERE txid=$1 FOR UPDATE`, txid).Scan(&status)
+	return status, err
+}
+
+func setStatus(ctx context.Context, tx pgx.Tx, txid, status string) error {
+	_, err := tx.Exec(ctx, `UPDATE tcc_operations SET status=$2, updated_at=now() WHERE txid=$1`, txid, status)
+	return err
+}
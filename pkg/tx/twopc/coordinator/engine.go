@@ -3,8 +3,11 @@ package coordinator
 import (
 	"context"
 	"errors"
-	"tx-lab-ecommerce-go/pkg/tx/common"
-	"tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+	"fmt"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
 )
 
 type Participant struct {
@@ -17,50 +20,134 @@ type Participant struct {
 
 type Engine struct {
 	Log TxLogStore
+	// Retry — политика повторов prepare (при сбое транспорта)/commit/abort (по умолчанию common.DefaultRetry).
+	Retry *common.RetryPolicy
+	// Fanout — порядок рассылки фаз участникам (по умолчанию FanoutSequential).
+	Fanout Fanout
+	// PhaseTimeout — общий дедлайн одной фазы на всех участников; 0 — только дедлайн ctx.
+	PhaseTimeout time.Duration
+}
+
+// Result — итог Execute/Resolve: финальный (или текущий, если commit не завершён) статус.
+type Result struct {
+	Status    common.TxStatus
+	Reason    string
+	Latencies []ParticipantLatency
 }
 
-func (e *Engine) Execute(ctx context.Context, txid common.TxID, orderID string, correlationID common.CorrelationID, parts []Participant) error {
+// Execute создаёт запись в журнале и проводит обе фазы.
+// Ошибка возвращается, если транзакция не зафиксирована: при отказе на PREPARE —
+// обёртка над common.ErrVoteNo или common.ErrParticipantUnavailable (Status=ABORTED,
+// причина сохраняется в журнале), при незавершённом COMMIT — common.ErrCommitPending
+// (Status=COMMITTING).
+func (e *Engine) Execute(ctx context.Context, txid common.TxID, orderID string, correlationID common.CorrelationID, parts []Participant) (Result, error) {
 	if err := e.Log.Create(ctx, txid, orderID, mapRefs(parts)); err != nil {
+		return Result{Status: common.TxStarted}, err
+	}
+	_ = e.Log.SetStatus(ctx, txid, common.TxPreparing)
+
+	// Phase 1: PREPARE; в параллельном режиме первый отказ отменяет остальные запросы.
+	latencies, err := e.fanOut(ctx, PhasePrepare, parts, true, func(ctx context.Context, p Participant) error {
+		return e.prepare(ctx, txid, orderID, correlationID, p)
+	})
+	if err != nil {
+		_ = e.Log.SetReason(ctx, txid, err.Error())
+		// presumed abort: abort получают все, включая тех, чей ответ на PREPARE потерян
+		res := e.abort(ctx, txid, orderID, parts)
+		res.Reason = err.Error()
+		res.Latencies = append(latencies, res.Latencies...)
+		return res, err
+	}
+
+	// Phase 2: COMMIT
+	_ = e.Log.SetStatus(ctx, txid, common.TxCommitting)
+	res, err := e.commit(ctx, txid, orderID, parts)
+	res.Latencies = append(latencies, res.Latencies...)
+	return res, err
+}
+
+// Resolve доводит до конца транзакцию из журнала (после падения координатора):
+// COMMITTING — повторяет commit, остальные незавершённые статусы — abort.
+func (e *Engine) Resolve(ctx context.Context, entry TxLogEntry, parts []Participant) (Result, error) {
+	switch entry.Status {
+	case common.TxCommitted, common.TxAborted:
+		return Result{Status: entry.Status}, nil
+	case common.TxCommitting:
+		return e.commit(ctx, entry.TxID, entry.OrderID, parts)
+	default:
+		res := e.abort(ctx, entry.TxID, entry.OrderID, parts)
+		res.Reason = "recovered from " + string(entry.Status)
+		return res, nil
+	}
+}
+
+// prepare запрашивает голос участника. Транспортные сбои повторяются (PREPARE у участников
+// идемпотентен по txid), голос "нет" — окончательный и не повторяется.
+func (e *Engine) prepare(ctx context.Context, txid common.TxID, orderID string, correlationID common.CorrelationID, p Participant) error {
+	req := protocol.PrepareRequest{
+		TxID:          string(txid),
+		OrderID:       orderID,
+		Step:          string(p.Step),
+		CorrelationID: string(correlationID),
+		Payload:       p.PayloadBuilder(),
+	}
+	var resp protocol.PrepareResponse
+	err := common.Retry(ctx, e.retryPolicy(), func(ctx context.Context) error {
+		var err error
+		resp, err = p.Client.Prepare(ctx, req)
 		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", p.Ref.Name, common.ErrParticipantUnavailable, err)
 	}
-	_ = e.Log.SetStatus(ctx, txid, TxPreparing)
+	if !resp.VoteYes {
+		return fmt.Errorf("%s: %w", p.Ref.Name, common.VoteNo(resp.Reason))
+	}
+	return nil
+}
 
-	// Phase 1: PREPARE
-	prepared := make([]Participant, 0, len(parts))
-	for _, p := range parts {
-		resp, err := p.Client.Prepare(ctx, protocol.PrepareRequest{
-			TxID:          txid,
-			OrderID:       orderID,
-			Step:          p.Step,
-			CorrelationID: correlationID,
-			Payload:       p.PayloadBuilder(),
+func (e *Engine) commit(ctx context.Context, txid common.TxID, orderID string, parts []Participant) (Result, error) {
+	latencies, err := e.fanOut(ctx, PhaseCommit, parts, false, func(ctx context.Context, p Participant) error {
+		err := common.Retry(ctx, e.retryPolicy(), func(ctx context.Context) error {
+			return p.Client.Commit(ctx, protocol.CommitRequest{TxID: string(txid), OrderID: orderID})
 		})
-		if err != nil || !resp.VoteYes {
-			_ = e.Log.SetStatus(ctx, txid, TxAborting)
-			// abort всех, кто успел подготовиться
-			for i := len(prepared) - 1; i >= 0; i-- {
-				_ = prepared[i].Client.Abort(ctx, protocol.AbortRequest{TxID: txid})
-			}
-			_ = e.Log.SetStatus(ctx, txid, TxAborted)
-			if err != nil {
-				return err
-			}
-			return errors.New(resp.Reason)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Ref.Name, err)
 		}
-		prepared = append(prepared, p)
+		return nil
+	})
+	if err != nil {
+		// Решение уже принято — откатывать нельзя, запись остаётся в COMMITTING для Resolve.
+		return Result{Status: common.TxCommitting, Reason: err.Error(), Latencies: latencies},
+			errors.Join(common.ErrCommitPending, err)
 	}
+	if err := e.Log.SetStatus(ctx, txid, common.TxCommitted); err != nil {
+		return Result{Status: common.TxCommitting, Latencies: latencies}, errors.Join(common.ErrCommitPending, err)
+	}
+	return Result{Status: common.TxCommitted, Latencies: latencies}, nil
+}
 
-	// Phase 2: COMMIT
-	_ = e.Log.SetStatus(ctx, txid, TxCommitting)
-	for _, p := range prepared {
-		if err := p.Client.Commit(ctx, protocol.CommitRequest{TxID: txid}); err != nil {
-			// Для “минимального” 2PC на демо достаточно ретраев.
-			// Полноценное решение требует восстановления по журналу.
-			return err
-		}
+func (e *Engine) abort(ctx context.Context, txid common.TxID, orderID string, parts []Participant) Result {
+	_ = e.Log.SetStatus(ctx, txid, common.TxAborting)
+	// последовательный откат идёт в обратном порядке подготовки
+	reversed := make([]Participant, 0, len(parts))
+	for i := len(parts) - 1; i >= 0; i-- {
+		reversed = append(reversed, parts[i])
 	}
-	_ = e.Log.SetStatus(ctx, txid, TxCommitted)
-	return nil
+	latencies, _ := e.fanOut(ctx, PhaseAbort, reversed, false, func(ctx context.Context, p Participant) error {
+		return common.Retry(ctx, e.retryPolicy(), func(ctx context.Context) error {
+			return p.Client.Abort(ctx, protocol.AbortRequest{TxID: string(txid), OrderID: orderID})
+		})
+	})
+	_ = e.Log.SetStatus(ctx, txid, common.TxAborted)
+	return Result{Status: common.TxAborted, Latencies: latencies}
+}
+
+func (e *Engine) retryPolicy() common.RetryPolicy {
+	if e.Retry != nil {
+		return *e.Retry
+	}
+	return common.DefaultRetry
 }
 
 func mapRefs(parts []Participant) []ParticipantRef {
@@ -0,0 +1,117 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+)
+
+type Fanout string
+
+const (
+	FanoutSequential Fanout = "sequential"
+	FanoutParallel   Fanout = "parallel"
+)
+
+// ParseFanout разбирает значение конфига; неизвестные значения дают FanoutSequential.
+func ParseFanout(s string) Fanout {
+	if strings.EqualFold(strings.TrimSpace(s), string(FanoutParallel)) {
+		return FanoutParallel
+	}
+	return FanoutSequential
+}
+
+const (
+	PhasePrepare = "prepare"
+	PhaseCommit  = "commit"
+	PhaseAbort   = "abort"
+)
+
+// ParticipantLatency — время одного участника в одной фазе (с учётом повторов).
+type ParticipantLatency struct {
+	Participant string
+	Phase       string
+	Duration    time.Duration
+	Outcome     string // ok | vote_no | cancelled | error
+}
+
+// fanOut вызывает call для всех участников под общим дедлайном фазы: последовательно
+// или параллельно в зависимости от e.Fanout. При failFast первая ошибка прекращает
+// последовательный обход, а в параллельном режиме отменяет ещё не ответивших участников.
+// Возвращается первая по времени ошибка.
+func (e *Engine) fanOut(ctx context.Context, phase string, parts []Participant, failFast bool, call func(context.Context, Participant) error) ([]ParticipantLatency, error) {
+	if e.PhaseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.PhaseTimeout)
+		defer cancel()
+	}
+
+	if e.Fanout != FanoutParallel {
+		latencies := make([]ParticipantLatency, 0, len(parts))
+		var firstErr error
+		for _, p := range parts {
+			start := time.Now()
+			err := call(ctx, p)
+			latencies = append(latencies, newLatency(p, phase, start, err))
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				if failFast {
+					break
+				}
+			}
+		}
+		return latencies, firstErr
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	latencies := make([]ParticipantLatency, len(parts))
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i, p := range parts {
+		wg.Add(1)
+		go func(i int, p Participant) {
+			defer wg.Done()
+			start := time.Now()
+			err := call(ctx, p)
+			latencies[i] = newLatency(p, phase, start, err)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				if failFast {
+					cancel()
+				}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return latencies, firstErr
+}
+
+func newLatency(p Participant, phase string, start time.Time, err error) ParticipantLatency {
+	outcome := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, common.ErrVoteNo):
+		outcome = "vote_no"
+	case errors.Is(err, context.Canceled):
+		outcome = "cancelled"
+	default:
+		outcome = "error"
+	}
+	return ParticipantLatency{Participant: p.Ref.Name, Phase: phase, Duration: time.Since(start), Outcome: outcome}
+}
@@ -0,0 +1,81 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// HTTPParticipant — клиент участника 2PC поверх /2pc/prepare, /2pc/commit, /2pc/abort.
+type HTTPParticipant struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewHTTPParticipant(baseURL string, client *http.Client) *HTTPParticipant {
+	return &HTTPParticipant{BaseURL: strings.TrimRight(baseURL, "/"), Client: client}
+}
+
+// Prepare возвращает голос участника из тела protocol.PrepareResponse (200 — "да", 409 — "нет").
+// Любой другой исход (таймаут, 5xx, нечитаемое тело) — ошибка транспорта, а не голос.
+func (p *HTTPParticipant) Prepare(ctx context.Context, req protocol.PrepareRequest) (protocol.PrepareResponse, error) {
+	code, body, err := p.post(ctx, "/2pc/prepare", req)
+	if err != nil {
+		return protocol.PrepareResponse{}, err
+	}
+	if code != http.StatusOK && code != http.StatusConflict {
+		return protocol.PrepareResponse{}, fmt.Errorf("status %d", code)
+	}
+	var resp protocol.PrepareResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return protocol.PrepareResponse{}, fmt.Errorf("status %d: bad vote body: %w", code, err)
+	}
+	if code == http.StatusConflict && resp.VoteYes {
+		return protocol.PrepareResponse{}, fmt.Errorf("status %d with vote_yes=true", code)
+	}
+	return resp, nil
+}
+
+func (p *HTTPParticipant) Commit(ctx context.Context, req protocol.CommitRequest) error {
+	return p.expect2xx(ctx, "/2pc/commit", req)
+}
+
+func (p *HTTPParticipant) Abort(ctx context.Context, req protocol.AbortRequest) error {
+	return p.expect2xx(ctx, "/2pc/abort", req)
+}
+
+func (p *HTTPParticipant) expect2xx(ctx context.Context, path string, body any) error {
+	code, _, err := p.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	if code < 200 || code >= 300 {
+		return fmt.Errorf("status %d", code)
+	}
+	return nil
+}
+
+func (p *HTTPParticipant) post(ctx context.Context, path string, body any) (int, []byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, respBody, nil
+}
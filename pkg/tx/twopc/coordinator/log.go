@@ -2,16 +2,45 @@ package coordinator
 
 import (
 	"context"
-	"tx-lab-ecommerce-go/pkg/tx/common"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
 )
 
 type ParticipantRef struct {
 	Name string `json:"name"` // payment/inventory/shipping
-	// можно хранить endpoint/baseURL для отладки
+	URL  string `json:"url"`  // base URL участника; нужен восстановлению после рестарта
+}
+
+// TxLogEntry — запись журнала координатора.
+type TxLogEntry struct {
+	TxID         common.TxID
+	OrderID      string
+	Status       common.TxStatus
+	Participants []ParticipantRef
 }
 
 type TxLogStore interface {
 	Create(ctx context.Context, txid common.TxID, orderID string, participants []ParticipantRef) error
-	SetStatus(ctx context.Context, txid common.TxID, status TxStatus) error
-	GetStatus(ctx context.Context, txid common.TxID) (TxStatus, error)
+	SetStatus(ctx context.Context, txid common.TxID, status common.TxStatus) error
+	// Get возвращает запись журнала; для неизвестного txid — ошибка хранилища "нет строк".
+	Get(ctx context.Context, txid common.TxID) (TxLogEntry, error)
+	// SetReason сохраняет причину отказа (голос "нет" или недоступность участника).
+	SetReason(ctx context.Context, txid common.TxID, reason string) error
+	// ClaimInDoubt забирает незавершённые транзакции, не обновлявшиеся дольше olderThan.
+	ClaimInDoubt(ctx context.Context, olderThan time.Duration, limit int) ([]TxLogEntry, error)
+}
+
+// Decision переводит статус журнала в решение для участника: COMMITTING уже означает
+// commit, ABORTING — abort, STARTED/PREPARING — решение ещё не принято.
+func Decision(status common.TxStatus) string {
+	switch status {
+	case common.TxCommitting, common.TxCommitted:
+		return protocol.DecisionCommit
+	case common.TxAborting, common.TxAborted:
+		return protocol.DecisionAbort
+	default:
+		return protocol.DecisionPending
+	}
 }
@@ -0,0 +1,48 @@
+package participant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// HTTPDecisionClient спрашивает решение у координатора через GET /2pc/tx/{txid}.
+type HTTPDecisionClient struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewHTTPDecisionClient(baseURL string, client *http.Client) *HTTPDecisionClient {
+	return &HTTPDecisionClient{BaseURL: strings.TrimRight(baseURL, "/"), Client: client}
+}
+
+// Decision возвращает protocol.Decision*. Транзакция, неизвестная координатору (404),
+// по правилу presumed abort считается откатанной.
+func (c *HTTPDecisionClient) Decision(ctx context.Context, txid string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/2pc/tx/"+url.PathEscape(txid), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return protocol.DecisionAbort, nil
+	default:
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body protocol.DecisionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Decision, nil
+}
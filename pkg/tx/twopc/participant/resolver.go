@@ -0,0 +1,92 @@
+package participant
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/logging"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/protocol"
+)
+
+// Resolver разрешает зависшие у участника PREPARED-транзакции: по истечении expires_at
+// спрашивает решение координатора и применяет commit или abort, освобождая резервы.
+type Resolver struct {
+	Service   string // имя сервиса для логов
+	Store     Store
+	Decisions interface {
+		Decision(ctx context.Context, txid string) (string, error)
+	}
+	// Apply переводит транзакцию участника в COMMITTED или ABORTED вместе с его ресурсами.
+	Apply func(ctx context.Context, tx PreparedTx, status string) error
+
+	Interval  time.Duration
+	Lease     time.Duration // на сколько продлевается expires_at при захвате и при decision=pending
+	BatchSize int
+}
+
+func (r *Resolver) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.RunOnce(ctx); err != nil {
+					log.Printf("2PC resolver error: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Resolver) RunOnce(ctx context.Context) error {
+	txs, err := r.Store.ClaimExpired(ctx, r.Lease, r.BatchSize)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		r.resolve(ctx, tx)
+	}
+	return nil
+}
+
+func (r *Resolver) resolve(ctx context.Context, tx PreparedTx) {
+	start := time.Now()
+	decision, err := r.Decisions.Decision(ctx, tx.TxID)
+	if err != nil {
+		// Координатор недоступен — участник обязан ждать; попробуем после продлённого expires_at.
+		r.log(tx, "decision_unavailable", start, err.Error())
+		return
+	}
+
+	status := ""
+	switch decision {
+	case protocol.DecisionCommit:
+		status = "COMMITTED"
+	case protocol.DecisionAbort:
+		status = "ABORTED"
+	default:
+		r.log(tx, "decision_pending", start, "")
+		return
+	}
+	if err := r.Apply(ctx, tx, status); err != nil {
+		r.log(tx, "apply_error", start, err.Error())
+		return
+	}
+	r.log(tx, "resolved_"+decision, start, "")
+}
+
+func (r *Resolver) log(tx PreparedTx, status string, start time.Time, message string) {
+	logging.Log(logging.Fields{
+		Service:    r.Service,
+		TxID:       tx.TxID,
+		OrderID:    tx.OrderID,
+		Step:       "2pc_resolve",
+		Status:     status,
+		DurationMS: time.Since(start).Milliseconds(),
+		Message:    message,
+	})
+}
@@ -0,0 +1,19 @@
+package participant
+
+import (
+	"context"
+	"time"
+)
+
+// PreparedTx — запись twopc_prepared_tx участника.
+type PreparedTx struct {
+	TxID    string
+	OrderID string
+	Step    string
+}
+
+type Store interface {
+	// ClaimExpired забирает PREPARED-транзакции с истёкшим expires_at, продлевая им
+	// expires_at на lease, чтобы их не взяла одновременно другая реплика участника.
+	ClaimExpired(ctx context.Context, lease time.Duration, limit int) ([]PreparedTx, error)
+}
@@ -1,13 +1,14 @@
 package protocol
 
-import "tx-lab-ecommerce-go/pkg/tx/common"
+// DTO намеренно не зависят от pkg/tx/common: common.TwoPCParticipantClient
+// ссылается на этот пакет, и обратный импорт дал бы цикл.
 
 type PrepareRequest struct {
-	TxID          common.TxID          `json:"tx_id"`
-	OrderID       string               `json:"order_id"`
-	Step          common.StepName      `json:"step"`
-	CorrelationID common.CorrelationID `json:"correlation_id"`
-	Payload       any                  `json:"payload"`
+	TxID          string `json:"txid"`
+	OrderID       string `json:"order_id"`
+	Step          string `json:"step"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Payload       any    `json:"payload"`
 }
 
 type PrepareResponse struct {
@@ -16,9 +17,25 @@ type PrepareResponse struct {
 }
 
 type CommitRequest struct {
-	TxID common.TxID `json:"tx_id"`
+	TxID    string `json:"txid"`
+	OrderID string `json:"order_id,omitempty"`
 }
 
 type AbortRequest struct {
-	TxID common.TxID `json:"tx_id"`
+	TxID    string `json:"txid"`
+	OrderID string `json:"order_id,omitempty"`
+}
+
+// Решение координатора по транзакции (GET /2pc/tx/{txid} на order-service).
+const (
+	DecisionCommit  = "commit"
+	DecisionAbort   = "abort"
+	DecisionPending = "pending"
+)
+
+type DecisionResponse struct {
+	TxID     string `json:"txid"`
+	OrderID  string `json:"order_id"`
+	Status   string `json:"status"`
+	Decision string `json:"decision"`
 }
@@ -0,0 +1,117 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/common"
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/coordinator"
+)
+
+// CoordinatorLog — coordinator.TxLogStore поверх таблицы twopc_tx_log (deploy/sql/order.sql).
+type CoordinatorLog struct {
+	Pool *pgxpool.Pool
+	// OnFinal, если задан, вызывается в той же транзакции, что и перевод записи
+	// в COMMITTED/ABORTED, — так сервис атомарно обновляет свой агрегат (например, orders).
+	OnFinal func(ctx context.Context, tx pgx.Tx, orderID string, status common.TxStatus) error
+}
+
+var _ coordinator.TxLogStore = (*CoordinatorLog)(nil)
+
+func NewCoordinatorLog(pool *pgxpool.Pool) *CoordinatorLog {
+	return &CoordinatorLog{Pool: pool}
+}
+
+func (l *CoordinatorLog) Create(ctx context.Context, txid common.TxID, orderID string, participants []coordinator.ParticipantRef) error {
+	participantsJSON, err := json.Marshal(participants)
+	if err != nil {
+		return err
+	}
+	_, err = l.Pool.Exec(ctx,
+		`INSERT INTO twopc_tx_log(txid, order_id, status, participants) VALUES($1, $2, $3, $4)`,
+		string(txid), orderID, string(common.TxStarted), participantsJSON,
+	)
+	return err
+}
+
+func (l *CoordinatorLog) SetStatus(ctx context.Context, txid common.TxID, status common.TxStatus) error {
+	final := status == common.TxCommitted || status == common.TxAborted
+	if !final || l.OnFinal == nil {
+		_, err := l.Pool.Exec(ctx, `UPDATE twopc_tx_log SET status=$2, updated_at=now() WHERE txid=$1`, string(txid), string(status))
+		return err
+	}
+
+	tx, err := l.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var orderID string
+	err = tx.QueryRow(ctx, `UPDATE twopc_tx_log SET status=$2, updated_at=now() WHERE txid=$1 RETURNING order_id`,
+		string(txid), string(status)).Scan(&orderID)
+	if err != nil {
+		return err
+	}
+	if err := l.OnFinal(ctx, tx, orderID, status); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (l *CoordinatorLog) SetReason(ctx context.Context, txid common.TxID, reason string) error {
+	_, err := l.Pool.Exec(ctx, `UPDATE twopc_tx_log SET reason=$2, updated_at=now() WHERE txid=$1`, string(txid), reason)
+	return err
+}
+
+func (l *CoordinatorLog) Get(ctx context.Context, txid common.TxID) (coordinator.TxLogEntry, error) {
+	var orderID, status string
+	var participantsJSON []byte
+	err := l.Pool.QueryRow(ctx, `SELECT order_id, status, participants FROM twopc_tx_log WHERE txid=$1`, string(txid)).
+		Scan(&orderID, &status, &participantsJSON)
+	if err != nil {
+		return coordinator.TxLogEntry{}, err
+	}
+	entry := coordinator.TxLogEntry{TxID: txid, OrderID: orderID, Status: common.TxStatus(status)}
+	_ = json.Unmarshal(participantsJSON, &entry.Participants)
+	return entry, nil
+}
+
+// ClaimInDoubt сдвигает updated_at выбранным записям, чтобы другие реплики
+// (и ещё живой /checkout) не брали их одновременно.
+func (l *CoordinatorLog) ClaimInDoubt(ctx context.Context, olderThan time.Duration, limit int) ([]coordinator.TxLogEntry, error) {
+	rows, err := l.Pool.Query(ctx, `UPDATE twopc_tx_log SET updated_at=now()
+		WHERE txid IN (
+			SELECT txid FROM twopc_tx_log
+			WHERE status IN ('STARTED','PREPARING','COMMITTING','ABORTING')
+			  AND updated_at < now() - make_interval(secs => $1)
+			ORDER BY updated_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING txid, order_id, status, participants`, olderThan.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []coordinator.TxLogEntry
+	for rows.Next() {
+		var txid, orderID, status string
+		var participantsJSON []byte
+		if err := rows.Scan(&txid, &orderID, &status, &participantsJSON); err != nil {
+			return nil, err
+		}
+		entry := coordinator.TxLogEntry{TxID: common.TxID(txid), OrderID: orderID, Status: common.TxStatus(status)}
+		if err := json.Unmarshal(participantsJSON, &entry.Participants); err != nil {
+			log.Printf("twopc_tx_log: bad participants for %s: %v", txid, err)
+		}
+		out = append(out, entry)
+	}
+	return out, rows.Err()
+}
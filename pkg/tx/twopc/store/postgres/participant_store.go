@@ -0,0 +1,47 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nazeru/tx-lab-ecommerce-go/pkg/tx/twopc/participant"
+)
+
+// ParticipantStore — participant.Store поверх twopc_prepared_tx (deploy/sql/{inventory,payment,shipping}.sql).
+type ParticipantStore struct {
+	Pool *pgxpool.Pool
+}
+
+var _ participant.Store = (*ParticipantStore)(nil)
+
+func NewParticipantStore(pool *pgxpool.Pool) *ParticipantStore {
+	return &ParticipantStore{Pool: pool}
+}
+
+func (s *ParticipantStore) ClaimExpired(ctx context.Context, lease time.Duration, limit int) ([]participant.PreparedTx, error) {
+	rows, err := s.Pool.Query(ctx, `UPDATE twopc_prepared_tx SET expires_at = now() + make_interval(secs => $1)
+		WHERE txid IN (
+			SELECT txid FROM twopc_prepared_tx
+			WHERE status = 'PREPARED' AND expires_at < now()
+			ORDER BY expires_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING txid, order_id, step`, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []participant.PreparedTx
+	for rows.Next() {
+		var tx participant.PreparedTx
+		if err := rows.Scan(&tx.TxID, &tx.OrderID, &tx.Step); err != nil {
+			return nil, err
+		}
+		out = append(out, tx)
+	}
+	return out, rows.Err()
+}
@@ -88,6 +88,7 @@ BENCH_RUNNER_GOARCH="$(trim "${BENCH_RUNNER_GOARCH:-}")"
 
 # TX modes
 TX_MODES_STR="$(trim "${TX_MODES:-}")"
+# outbox-cdc не входит по умолчанию: нужен Postgres с wal_level=logical (Helm: postgres.walLevel)
 TX_MODES_DEFAULT=("twopc" "saga-orch" "saga-chor" "tcc" "outbox")
 
 # Network profiles
@@ -146,6 +147,18 @@ FINAL_TIMEOUT="$(trim "${FINAL_TIMEOUT:-2m}")"
 FINAL_INTERVAL="$(trim "${FINAL_INTERVAL:-500ms}")"
 FINAL_STATUSES="$(trim "${FINAL_STATUSES:-CONFIRMED,COMMITTED}")"
 
+# Stock fixture: reset inventory before every run and record final stock (empty = keep stock as is)
+STOCK_FIXTURE="$(trim "${STOCK_FIXTURE:-}")"
+INVENTORY_BASE_URL="$(trim "${INVENTORY_BASE_URL:-}")"
+
+# Inventory lock strategy for the whole matrix (empty = leave deployment as is)
+INVENTORY_LOCK_STRATEGY="$(trim "${INVENTORY_LOCK_STRATEGY:-}")"
+INVENTORY_DEPLOYMENT="$(trim "${INVENTORY_DEPLOYMENT:-inventory}")"
+
+# Event transport for the whole matrix: kafka | redis | memory (empty = leave deployments as is)
+BROKER="$(trim "${BROKER:-}")"
+BROKER_DEPLOYMENTS_STR="$(trim "${BROKER_DEPLOYMENTS:-order inventory payment shipping notification}")"
+
 NETEM_TARGET_SELECTORS_STR="$(trim "${NETEM_TARGET_SELECTORS:-}")"
 NETEM_VALIDATE="$(trim "${NETEM_VALIDATE:-1}")"
 NETEM_VALIDATE_LOG_DIR="$(trim "${NETEM_VALIDATE_LOG_DIR:-${RESULTS_DIR}/netem-validate}")"
@@ -1045,6 +1058,9 @@ ensure_order_pf() {
 set_bench_base_url() {
   if [[ "$MANAGE_ORDER_PF" != "1" ]]; then
     BENCH_BASE_URL="$ORDER_BASE_URL"
+if [[ -n "$STOCK_FIXTURE" && -z "$INVENTORY_BASE_URL" ]]; then
+  die "STOCK_FIXTURE requires INVENTORY_BASE_URL"
+fi
     return 0
   fi
   if [[ "$ORDER_PF_MODE" == "pods" ]]; then
@@ -1109,6 +1125,9 @@ run_bench_json() {
   if [[ "$AWAIT_FINAL" == "1" ]]; then
     args+=(-await-final -final-timeout "$FINAL_TIMEOUT" -final-interval "$FINAL_INTERVAL" -final-statuses "$FINAL_STATUSES")
   fi
+  if [[ -n "$STOCK_FIXTURE" ]]; then
+    args+=(-inventory-url "$INVENTORY_BASE_URL" -stock-fixture "$STOCK_FIXTURE")
+  fi
   local cmd=("${args[@]}")
   if [[ "$BENCH_IN_CLUSTER" == "1" ]]; then
     ensure_bench_runner_pod
@@ -1215,6 +1234,24 @@ if [[ "$BENCH_IN_CLUSTER" == "1" ]]; then
   log "Bench runner pod ready: $BENCH_RUNNER_POD"
 fi
 
+if [[ -n "$INVENTORY_LOCK_STRATEGY" ]]; then
+  inventory_deploy="$(resolve_deployment "$INVENTORY_DEPLOYMENT" || true)"
+  [[ -n "${inventory_deploy//[[:space:]]/}" ]] || die "inventory deployment '$INVENTORY_DEPLOYMENT' not found"
+  log "Switching INVENTORY_LOCK_STRATEGY to '$INVENTORY_LOCK_STRATEGY' on $inventory_deploy"
+  kube -n "$NAMESPACE" set env "deployment/${inventory_deploy}" "INVENTORY_LOCK_STRATEGY=${INVENTORY_LOCK_STRATEGY}" >/dev/null
+  kube -n "$NAMESPACE" rollout status "deployment/${inventory_deploy}" --timeout="$ROLLOUT_TIMEOUT" >/dev/null
+fi
+
+if [[ -n "$BROKER" ]]; then
+  for name in $BROKER_DEPLOYMENTS_STR; do
+    broker_deploy="$(resolve_deployment "$name" || true)"
+    [[ -n "${broker_deploy//[[:space:]]/}" ]] || die "deployment '$name' not found"
+    log "Switching BROKER to '$BROKER' on $broker_deploy"
+    kube -n "$NAMESPACE" set env "deployment/${broker_deploy}" "BROKER=${BROKER}" >/dev/null
+    kube -n "$NAMESPACE" rollout status "deployment/${broker_deploy}" --timeout="$ROLLOUT_TIMEOUT" >/dev/null
+  done
+fi
+
 # ----------------------------
 # Main Loop
 # ----------------------------
@@ -1233,7 +1270,14 @@ for replicas in "${REPLICAS_LIST[@]}"; do
   for mode in "${TX_MODES[@]}"; do
     log "Switching TX_MODE to '$mode'"
     if [[ "$MANAGE_ORDER_PF" == "1" ]]; then stop_order_pf; fi
-    kube -n "$NAMESPACE" set env "deployment/${DEPLOYMENT}" "TX_MODE=${mode}" >/dev/null
+    # twopc-parallel — тот же 2PC, но с параллельной рассылкой фаз участникам
+    tx_mode="$mode"
+    twopc_fanout="sequential"
+    if [[ "$mode" == "twopc-parallel" ]]; then
+      tx_mode="twopc"
+      twopc_fanout="parallel"
+    fi
+    kube -n "$NAMESPACE" set env "deployment/${DEPLOYMENT}" "TX_MODE=${tx_mode}" "TWOPC_FANOUT=${twopc_fanout}" >/dev/null
     kube -n "$NAMESPACE" rollout restart "deployment/${DEPLOYMENT}" >/dev/null
     ensure_rollout
     wait_pods_stable
@@ -1359,6 +1403,8 @@ except: print("0 0")
   {
     "tx_mode": "$mode", "net_profile": "$profile", "replicas": $replicas, "concurrency": $conc, "run_id": $run_id,
     "transactions": $tx, "latency_ms": $effective_latency, "jitter_ms": $effective_jitter,
+    "lock_strategy": "${INVENTORY_LOCK_STRATEGY:-default}",
+    "broker": "${BROKER:-default}",
     "bench": $bench_json, "resources": ${metrics_summary:-null},
     "network": {"rx_bytes": $rx_delta, "tx_bytes": $tx_delta, "rx_kbps": $rx_kbps, "tx_kbps": $tx_kbps}
   }
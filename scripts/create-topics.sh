@@ -1,5 +1,6 @@
 #!/usr/bin/env bash
 set -euo pipefail
+# Сервисы сами создают топики при старте (kafka.EnsureTopics); скрипт — для ручного создания.
 BROKER=${BROKER:-localhost:9092}
 TOPIC=${TOPIC:-txlab.events}
 PARTITIONS=${PARTITIONS:-3}
@@ -55,23 +55,15 @@ fi
 repeat_resp="$(curl -s -w '\n%{http_code}' -H 'Content-Type: application/json' -H "Idempotency-Key: $idem" -d "$payload" "${BASE_URL%/}/checkout")"
 repeat_body="$(echo "$repeat_resp" | head -n1)"
 repeat_code="$(echo "$repeat_resp" | tail -n1)"
-if [[ "$repeat_code" != 2* ]]; then
-  echo "idempotent checkout failed: ${repeat_code} ${repeat_body}" >&2
+if [[ "$repeat_code" != "$code" || "$repeat_body" != "$body" ]]; then
+  echo "idempotent replay differs: ${code} ${body} vs ${repeat_code} ${repeat_body}" >&2
   exit 1
 fi
 
-repeat_id="$(python3 - <<'PY'
-import json,sys
-try:
-    data=json.loads(sys.stdin.read())
-    print(data.get('order_id',''))
-except Exception:
-    print('')
-PY
-<<<"$repeat_body")"
-
-if [[ "$repeat_id" != "$returned_id" ]]; then
-  echo "idempotency mismatch: ${returned_id} vs ${repeat_id}" >&2
+other_payload="$(python3 -c "import json; print(json.dumps({'order_id': '$order_id', 'total': 2400, 'items': [{'product_id': 'sku-1', 'quantity': 2}]}))")"
+mismatch_code="$(curl -s -o /dev/null -w '%{http_code}' -H 'Content-Type: application/json' -H "Idempotency-Key: $idem" -d "$other_payload" "${BASE_URL%/}/checkout")"
+if [[ "$mismatch_code" != "422" ]]; then
+  echo "idempotency key reused with another body: expected 422, got ${mismatch_code}" >&2
   exit 1
 fi
 